@@ -8,8 +8,10 @@ require (
 	github.com/PuerkitoBio/goquery v1.5.0
 	github.com/Skarlso/html-to-markdown v0.0.0-20191210071215-2cf06e949e49
 	github.com/dsnet/compress v0.0.1 // indirect
-	github.com/emersion/go-imap v1.0.0-rc.2
-	github.com/emersion/go-message v0.11.0
+	github.com/emersion/go-imap v1.2.1
+	github.com/emersion/go-message v0.15.0
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
+	github.com/emersion/go-smtp v0.15.0
 	github.com/go-ldap/ldap v3.0.3+incompatible // indirect
 	github.com/golang/protobuf v1.3.2 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20191106031601-ce3c9ade29de // indirect
@@ -18,6 +20,7 @@ require (
 	github.com/k3a/html2text v0.0.0-20190714173509-955615037597
 	github.com/lunny/html2md v0.0.0-20181018071239-7d234de44546
 	github.com/magefile/mage v1.9.0
+	github.com/martinlindhe/base36 v1.0.0 // indirect
 	github.com/mattermost/mattermost-server v0.0.0-20190626111855-f21a8a370f89
 	github.com/mattn/godown v0.0.0-20180312012330-2e9e17e0ea51
 	github.com/mholt/archiver v3.1.1+incompatible
@@ -25,17 +28,18 @@ require (
 	github.com/onsi/ginkgo v1.10.3 // indirect
 	github.com/onsi/gomega v1.7.1 // indirect
 	github.com/pelletier/go-toml v1.6.0 // indirect
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/smartystreets/assertions v1.0.1 // indirect
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.4.0
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/zap v1.10.0 // indirect
 	golang.org/x/crypto v0.0.0-20190621222207-cc06ce4a13d4 // indirect
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
-	golang.org/x/sys v0.0.0-20191210023423-ac6580df4449 // indirect
-	golang.org/x/text v0.3.2
+	golang.org/x/text v0.3.7
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
 
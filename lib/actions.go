@@ -0,0 +1,234 @@
+package mail2most
+
+import (
+	"context"
+	"strings"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// isZero reports whether the action does nothing
+func (a mailAction) isZero() bool {
+	return !a.Seen && !a.Flagged && a.Keyword == "" && a.Copy == "" && a.Move == "" && !a.Delete
+}
+
+// flags returns the flags added by the action
+func (a mailAction) flags() []interface{} {
+	var flags []interface{}
+	if a.Seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if a.Flagged {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	if a.Keyword != "" {
+		flags = append(flags, a.Keyword)
+	}
+	return flags
+}
+
+// runActions applies an action to the mails of a profile after they were posted (OnSuccess)
+// or failed to be posted (OnFailure)
+// mails of a folder are handled together, folders whose UIDVALIDITY changed in the meantime are skipped
+// ReadOnly profiles do not change their mails, so no actions are applied
+func (m Mail2Most) runActions(ctx context.Context, profile int, mails []Mail, action mailAction) error {
+	if action.isZero() || len(mails) == 0 {
+		return nil
+	}
+	if m.Config.Profiles[profile].Mail.ReadOnly {
+		m.Debug("mail actions skipped", map[string]interface{}{"profile": m.Config.Profiles[profile].Name, "status": "profile is read only"})
+		return nil
+	}
+	switch m.source(profile) {
+	case SOURCEPOP3:
+		return m.runPOP3Actions(ctx, profile, mails, action)
+	case SOURCEJMAP:
+		return m.runJMAPActions(ctx, profile, mails, action)
+	case SOURCEMAILDIR:
+		return m.runMaildirActions(profile, mails, action)
+	}
+
+	var folders []string
+	uids := make(map[string]map[uint32][]uint32)
+	for _, mail := range mails {
+		if _, ok := uids[mail.Folder]; !ok {
+			folders = append(folders, mail.Folder)
+			uids[mail.Folder] = make(map[uint32][]uint32)
+		}
+		uids[mail.Folder][mail.UIDValidity] = append(uids[mail.Folder][mail.UIDValidity], mail.ID)
+	}
+
+	c, release, err := m.acquire(ctx, profile)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		err = m.runFolderActions(c, folder, uids[folder], action)
+		if err != nil {
+			break
+		}
+	}
+	release(err)
+	return err
+}
+
+// mailActions runs the actions and logs errors, the mails are delivered already so errors are not fatal
+func (m Mail2Most) mailActions(ctx context.Context, profile int, mails []Mail, action mailAction) {
+	err := m.runActions(ctx, profile, mails, action)
+	if err != nil {
+		m.Error("mail action error", map[string]interface{}{
+			"profile": m.Config.Profiles[profile].Name,
+			"error":   err,
+		})
+	}
+}
+
+func (m Mail2Most) runFolderActions(c *client.Client, folder string, uids map[uint32][]uint32, action mailAction) error {
+	mbox, err := c.Select(folder, false)
+	if err != nil {
+		return err
+	}
+	seqset := new(imap.SeqSet)
+	for uidValidity, ids := range uids {
+		if uidValidity != mbox.UidValidity {
+			m.Info("skipping mail action", map[string]interface{}{
+				"folder": folder,
+				"uids":   ids,
+				"cause":  "uidvalidity changed",
+			})
+			continue
+		}
+		seqset.AddNum(ids...)
+	}
+	if seqset.Empty() {
+		return nil
+	}
+	m.Debug("mail action", map[string]interface{}{
+		"folder": folder,
+		"uids":   seqset.String(),
+		"action": action,
+	})
+
+	if flags := action.flags(); len(flags) > 0 {
+		err = c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if action.Copy != "" {
+		err = c.UidCopy(seqset, action.Copy)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case action.Move != "":
+		return moveMails(c, seqset, action.Move)
+	case action.Delete:
+		return deleteMails(c, seqset)
+	}
+	return nil
+}
+
+// moveMails moves mails to another folder
+// servers without the MOVE capability are handled using COPY and deleting the mails afterwards
+func moveMails(c *client.Client, seqset *imap.SeqSet, dest string) error {
+	ok, err := c.Support("MOVE")
+	if err != nil {
+		return err
+	}
+	if ok {
+		return c.UidMove(seqset, dest)
+	}
+	err = c.UidCopy(seqset, dest)
+	if err != nil {
+		return err
+	}
+	return deleteMails(c, seqset)
+}
+
+// deleteMails flags mails as deleted and expunges them
+// without UIDPLUS all mails flagged as deleted in the folder are expunged
+func deleteMails(c *client.Client, seqset *imap.SeqSet) error {
+	err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return err
+	}
+	ok, err := c.Support("UIDPLUS")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.Expunge(nil)
+	}
+	status, err := c.Execute(&uidExpunge{seqset: seqset}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// uidExpunge is the UID EXPUNGE command of the UIDPLUS extension (RFC 4315)
+type uidExpunge struct {
+	seqset *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "UID",
+		Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.seqset},
+	}
+}
+
+// checkKeywords warns if the folders of a profile do not allow the keywords used by its actions
+// only imap servers announce the keywords they allow
+func (m Mail2Most) checkKeywords(profile int) {
+	if m.source(profile) != SOURCEIMAP {
+		return
+	}
+	var keywords []string
+	for _, a := range []mailAction{m.Config.Profiles[profile].Mail.OnSuccess, m.Config.Profiles[profile].Mail.OnFailure} {
+		if a.Keyword != "" {
+			keywords = append(keywords, a.Keyword)
+		}
+	}
+	if len(keywords) == 0 {
+		return
+	}
+
+	flags, err := m.ListFlags(profile)
+	if err != nil {
+		m.Error("could not check keywords", map[string]interface{}{
+			"profile": m.Config.Profiles[profile].Name,
+			"error":   err,
+		})
+		return
+	}
+	for _, keyword := range keywords {
+		if strings.ContainsAny(keyword, " (){%*\"\\]") {
+			m.Error("invalid keyword", map[string]interface{}{
+				"profile": m.Config.Profiles[profile].Name,
+				"keyword": keyword,
+			})
+			continue
+		}
+		if !allowsKeyword(flags, keyword) {
+			m.Error("keyword not allowed by the mail server", map[string]interface{}{
+				"profile": m.Config.Profiles[profile].Name,
+				"keyword": keyword,
+				"flags":   flags,
+			})
+		}
+	}
+}
+
+// allowsKeyword reports whether a keyword is part of the flags or new keywords are allowed (\*)
+func allowsKeyword(flags []string, keyword string) bool {
+	for _, flag := range flags {
+		if flag == "\\*" || strings.EqualFold(flag, keyword) {
+			return true
+		}
+	}
+	return false
+}
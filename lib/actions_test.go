@@ -0,0 +1,111 @@
+package mail2most
+
+import (
+	"context"
+	"testing"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMailbox returns a mailbox of the test backend
+func testMailbox(t *testing.T, be testIMAPBackend, name string) *memory.Mailbox {
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.(*memory.Mailbox)
+}
+
+func TestRunActions(t *testing.T) {
+	addr, be, stop := newExtTestIMAPServer(t, false)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	// fetching mails does not mark them as seen
+	testMailbox(t, be, "INBOX").Messages[0].Flags = nil
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if !assert.Len(t, mails, 1) {
+		return
+	}
+	assert.NotContains(t, testMailbox(t, be, "INBOX").Messages[0].Flags, imap.SeenFlag)
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{})
+	assert.Nil(t, err)
+
+	// read only profiles do not change their mails
+	m2m.Config.Profiles[0].Mail.ReadOnly = true
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Flagged: true})
+	assert.Nil(t, err)
+	assert.NotContains(t, testMailbox(t, be, "INBOX").Messages[0].Flags, imap.FlaggedFlag)
+	m2m.Config.Profiles[0].Mail.ReadOnly = false
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Seen: true, Flagged: true, Keyword: "mail2most"})
+	assert.Nil(t, err)
+	inbox := testMailbox(t, be, "INBOX")
+	assert.Subset(t, inbox.Messages[0].Flags, []string{imap.SeenFlag, imap.FlaggedFlag, "mail2most"})
+
+	// mails of another uidvalidity are not touched
+	other := mails[0]
+	other.UIDValidity++
+	err = m2m.runActions(context.Background(), 0, []Mail{other}, mailAction{Delete: true})
+	assert.Nil(t, err)
+	assert.Len(t, inbox.Messages, 1)
+
+	u, err := be.Login(nil, "username", "password")
+	assert.Nil(t, err)
+	assert.Nil(t, u.CreateMailbox("Archive"))
+	assert.Nil(t, u.CreateMailbox("Backup"))
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Copy: "Backup", Move: "Archive"})
+	assert.Nil(t, err)
+	assert.Len(t, inbox.Messages, 0)
+	assert.Len(t, testMailbox(t, be, "Archive").Messages, 1)
+	assert.Len(t, testMailbox(t, be, "Backup").Messages, 1)
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Move: "Unknown"})
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Filter.Folders = []string{"Archive"}
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Delete: true})
+	assert.Nil(t, err)
+	assert.Len(t, testMailbox(t, be, "Archive").Messages, 0)
+}
+
+func TestAllowsKeyword(t *testing.T) {
+	assert.True(t, allowsKeyword([]string{imap.SeenFlag, "\\*"}, "mail2most"))
+	assert.True(t, allowsKeyword([]string{imap.SeenFlag, "Mail2Most"}, "mail2most"))
+	assert.False(t, allowsKeyword([]string{imap.SeenFlag}, "mail2most"))
+}
+
+func TestListFlags(t *testing.T) {
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	// the memory backend allows new keywords
+	flags, err := m2m.ListFlags(0)
+	assert.Nil(t, err)
+	assert.Contains(t, flags, "\\*")
+
+	// keywords of other sources are not checked on an imap server
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEPOP3, Pop3Server: addr, OnSuccess: mailAction{Keyword: "mail2most"}}
+	m2m.checkKeywords(0)
+	assert.Len(t, m2m.pool.conns, 1)
+}
@@ -9,13 +9,52 @@ import (
 type config struct {
 	General        general
 	Logging        logging
+	Outbox         outboxConfig
+	Health         healthConfig
+	Receiver       receiverConfig
 	Profiles       []profile `toml:"Profile"`
 	DefaultProfile profile
 }
 type general struct {
-	File         string
-	TimeInterval uint
-	NoLoop       bool
+	File           string
+	StateBackend   string
+	StateRetention string
+	// StateFile is the database of the bolt state backend, defaults to File with the extension .db
+	StateFile string
+	// DeliverStateFile is the bolt database of the deliver command, defaults to File with the extension .deliver.db
+	DeliverStateFile string
+	TimeInterval     uint
+	NoLoop           bool
+	// Workers is the number of profiles checked at the same time
+	Workers int
+	// ShutdownTimeout is the time running checks get to finish after a shutdown was requested
+	ShutdownTimeout string
+}
+
+type outboxConfig struct {
+	Path                string
+	MaxAttempts         int
+	Backoff, MaxBackoff string
+}
+
+// healthConfig configures the backoff of profiles whose mail server can not be reached
+type healthConfig struct {
+	Backoff, MaxBackoff string
+	FailureThreshold    int
+	Cooldown            string
+}
+
+// receiverConfig configures the smtp or lmtp listener the mail server delivers mails to
+type receiverConfig struct {
+	// Listen is a tcp address or a unix socket ("unix:/run/mail2most/lmtp.sock"), the receiver is disabled if empty
+	Listen string
+	// Protocol = ["smtp", "lmtp"] defaults to smtp
+	Protocol string
+	// Domain is announced in the greeting, defaults to localhost
+	Domain          string
+	MaxMessageBytes int
+	// CertFile and KeyFile enable STARTTLS
+	CertFile, KeyFile string
 }
 
 type logging struct {
@@ -26,24 +65,76 @@ type logging struct {
 }
 
 type profile struct {
+	// Name identifies the profile in the delivery state, if not set it is derived from the mail account
+	Name           string
 	IgnoreDefaults bool
 	Mail           maildata
 	Mattermost     mattermost
 	Filter         filter
+	Schedule       schedule
+}
+
+// schedule defines when a profile is checked
+type schedule struct {
+	// Interval overwrites General.TimeInterval for a profile (e.g. "30s", "5m")
+	Interval string
+	// Cron checks the profile at the times of a cron expression (e.g. "*/5 8-18 * * 1-5" or "@daily")
+	Cron string
+	// TimeZone is used for Cron and QuietHours, defaults to the local time zone
+	TimeZone string
+	// QuietHours are daily windows (e.g. "22:00-07:00") without checks,
+	// mails arriving in a window are posted when it ends
+	QuietHours []string
 }
 
 type maildata struct {
 	ImapServer, Username, Password string
 	ReadOnly                       bool
+	Idle                           bool
 	ImapTLS                        bool
 	VerifyTLS                      bool
+	TLSMode                        string
+	CAFile, ClientCert, ClientKey  string
+	ServerName, MinTLSVersion      string
+	Auth                           string
+	OAuth2                         oauth2Config
 	Limit                          uint32
+	// Source = ["imap", "pop3", "jmap", "maildir", "mbox", "receiver"] defines how mails are fetched, defaults to imap
+	Source     string
+	Pop3Server string
+	// JmapURL is the session resource of the jmap source (e.g. "https://api.fastmail.com/jmap/session")
+	JmapURL string
+	// Path is the Maildir directory or the mbox file of the local sources
+	Path string
+	// Recipients are the addresses accepted by the receiver for profiles using the receiver source
+	Recipients []string
+	// OnSuccess and OnFailure are applied to mails after posting them to mattermost succeeded or failed
+	OnSuccess, OnFailure mailAction
+}
+
+type mailAction struct {
+	Seen, Flagged bool
+	// Keyword is a custom flag added to the mail
+	Keyword string
+	// Copy and Move are folder names, Move takes precedence over Delete
+	Copy, Move string
+	Delete     bool
+}
+
+type oauth2Config struct {
+	// AccessToken is a static bearer token, if set no token is requested
+	AccessToken                                    string
+	TokenURL, ClientID, ClientSecret, RefreshToken string
+	Scopes                                         []string
 }
 
 type filter struct {
 	Folders, From, To, Subject []string
 	Unseen                     bool
 	TimeRange                  string
+
+	// ExcludeFolders removes folders matched by Folders
+	ExcludeFolders []string
 }
 
 type mattermost struct {
@@ -58,6 +149,34 @@ type mattermost struct {
 	HideFromEmail                              bool
 	HideSubject                                bool
 	MailAttachments                            bool
+
+	// Threads posts replies into the thread of the mail they answer
+	Threads bool
+	// ThreadWindow is how long mails without thread headers join the thread of a mail with the same subject (e.g. "24h")
+	ThreadWindow string
+	// Overflow defines how mails too long for a single post are posted: truncate, split or attach
+	Overflow string
+
+	// Template is the text/template of posts, the default template renders the layout defined by the options above
+	Template string
+	// ChannelTemplates overwrite the Template for single channels or users, the keys are written like in Channels and Users
+	ChannelTemplates map[string]string
+
+	// Render defines how mails are posted: text posts the message, attachment posts a message attachment
+	// with the template as text and the headers as fields
+	Render string
+	// AttachmentColor is the sidebar color of message attachments (e.g. "#439fe0")
+	AttachmentColor string
+	// ColorRules overwrite the AttachmentColor, the first matching rule is used
+	ColorRules []colorRule
+}
+
+type colorRule struct {
+	// Subject is a regular expression matched against the subject
+	Subject string
+	// Header is a header field (e.g. "X-Priority") matching the regular expression Value, any value matches if Value is empty
+	Header, Value string
+	Color         string
 }
 
 func parseConfig(fileName string, conf *config) error {
@@ -15,4 +15,48 @@ const (
 	LOGFORMATJSON string = "json"
 	// LOGFORMATTEXT .
 	LOGFORMATTEXT string = "text"
+	// STATEJSON .
+	STATEJSON string = "json"
+	// STATEBOLT .
+	STATEBOLT string = "bolt"
+	// TLSNONE .
+	TLSNONE string = "none"
+	// TLSSTARTTLS .
+	TLSSTARTTLS string = "starttls"
+	// TLSIMPLICIT .
+	TLSIMPLICIT string = "implicit"
+	// AUTHLOGIN .
+	AUTHLOGIN string = "login"
+	// AUTHXOAUTH2 .
+	AUTHXOAUTH2 string = "xoauth2"
+	// AUTHOAUTHBEARER .
+	AUTHOAUTHBEARER string = "oauthbearer"
+	// AUTHXOAUTH2NAME is the sasl mechanism name of XOAUTH2
+	AUTHXOAUTH2NAME string = "XOAUTH2"
+	// SOURCEIMAP .
+	SOURCEIMAP string = "imap"
+	// SOURCEPOP3 .
+	SOURCEPOP3 string = "pop3"
+	// SOURCEJMAP .
+	SOURCEJMAP string = "jmap"
+	// SOURCEMAILDIR .
+	SOURCEMAILDIR string = "maildir"
+	// SOURCEMBOX .
+	SOURCEMBOX string = "mbox"
+	// SOURCERECEIVER .
+	SOURCERECEIVER string = "receiver"
+	// RECEIVERSMTP .
+	RECEIVERSMTP string = "smtp"
+	// RECEIVERLMTP .
+	RECEIVERLMTP string = "lmtp"
+	// OVERFLOWTRUNCATE .
+	OVERFLOWTRUNCATE string = "truncate"
+	// OVERFLOWSPLIT .
+	OVERFLOWSPLIT string = "split"
+	// OVERFLOWATTACH .
+	OVERFLOWATTACH string = "attach"
+	// RENDERTEXT .
+	RENDERTEXT string = "text"
+	// RENDERATTACHMENT .
+	RENDERATTACHMENT string = "attachment"
 )
@@ -0,0 +1,108 @@
+package mail2most
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/emersion/go-smtp"
+)
+
+// exit codes of sysexits.h used by mail delivery agents
+const (
+	// EXOK .
+	EXOK int = 0
+	// EXUSAGE the command was used incorrectly
+	EXUSAGE int = 64
+	// EXDATAERR the mail could not be parsed
+	EXDATAERR int = 65
+	// EXNOUSER the profile does not exist
+	EXNOUSER int = 67
+	// EXTEMPFAIL the mail server should retry the delivery later
+	EXTEMPFAIL int = 75
+	// EXCONFIG the config could not be loaded
+	EXCONFIG int = 78
+)
+
+// errUnknownProfile is returned by Deliver for profile names not found in the config
+type errUnknownProfile string
+
+func (e errUnknownProfile) Error() string {
+	return "profile not found: " + string(e)
+}
+
+// configError is an error caused by the config, retrying the delivery does not help until the config is fixed
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return e.err.Error()
+}
+
+func (e configError) Unwrap() error {
+	return e.err
+}
+
+// isConfigError reports whether err is caused by the config
+func isConfigError(err error) bool {
+	var e configError
+	return errors.As(err, &e)
+}
+
+// Deliver reads a single mail from r and posts it to the mattermost of a profile (e.g. for .forward or pipe transports)
+// the mail runs through the filters of the profile, mails delivered before are skipped using the Message-Id
+// the delivered mails are stored in their own state (General.DeliverStateFile) so a running daemon is not disturbed,
+// concurrent deliveries wait for each other, mails older than General.StateRetention are pruned on every delivery
+func (m Mail2Most) Deliver(ctx context.Context, profile string, r io.Reader) error {
+	p := m.profileByName(profile)
+	if p < 0 {
+		return errUnknownProfile(profile)
+	}
+	err := m.checkSource(p)
+	if err != nil {
+		return configError{err}
+	}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	state, err := m.openBoltStateStore(m.deliverStateFile(), "")
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+	err = m.pruneState(state)
+	if err != nil {
+		return err
+	}
+	if m.mattermost != nil {
+		defer m.mattermost.close()
+	}
+
+	return m.deliver(ctx, p, raw, state)
+}
+
+// DeliveryExitCode translates the error of Deliver into a sysexits exit code
+// errors caused by the config are reported as such, all other errors may go away
+// (like an unreachable mattermost or a locked state) and ask for a retry
+func DeliveryExitCode(err error) int {
+	if isConfigError(err) {
+		return EXCONFIG
+	}
+	switch e := err.(type) {
+	case nil:
+		return EXOK
+	case errUnknownProfile:
+		return EXNOUSER
+	case *smtp.SMTPError:
+		if e.Code >= 500 {
+			return EXDATAERR
+		}
+		return EXTEMPFAIL
+	default:
+		return EXTEMPFAIL
+	}
+}
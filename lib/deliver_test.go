@@ -0,0 +1,150 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDeliver(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = filepath.Join(filet.TmpDir(t, ""), "data.json")
+	m2m.Config.Profiles[0].Name = "alerts"
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCERECEIVER}
+	m2m.Config.Profiles[0].Filter = filter{}
+	testMattermostProfile(&m2m, mm)
+
+	err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail("1", "alert")))
+	assert.Nil(t, err)
+	assert.Equal(t, EXOK, DeliveryExitCode(err))
+	assert.Len(t, mm.messages(), 1)
+
+	// delivered mails are known across runs
+	err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail("1", "alert")))
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 1)
+
+	// the deliver state is pruned as well
+	m2m.Config.General.StateRetention = "1ns"
+	err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail("1", "alert")))
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 2)
+	m2m.Config.General.StateRetention = ""
+
+	err = m2m.Deliver(context.Background(), "doesnotexist", strings.NewReader(testReceiverMail("2", "alert")))
+	assert.NotNil(t, err)
+	assert.Equal(t, EXNOUSER, DeliveryExitCode(err))
+
+	err = m2m.Deliver(context.Background(), "alerts", strings.NewReader("foo"))
+	assert.NotNil(t, err)
+	assert.Equal(t, EXDATAERR, DeliveryExitCode(err))
+
+	m2m.Config.Profiles[0].Mattermost.URL = "http://127.0.0.1:1"
+	err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail("2", "alert")))
+	assert.NotNil(t, err)
+	assert.Equal(t, EXTEMPFAIL, DeliveryExitCode(err))
+
+	assert.Equal(t, EXTEMPFAIL, DeliveryExitCode(fmt.Errorf("state is locked")))
+}
+
+func TestDeliverRunningDaemon(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	for _, backend := range []string{STATEJSON, STATEBOLT} {
+		m2m, err := New("../conf/mail2most.conf")
+		assert.Nil(t, err)
+		m2m.Config.General.File = filepath.Join(filet.TmpDir(t, ""), "data.json")
+		m2m.Config.General.StateBackend = backend
+		m2m.Config.Profiles[0].Name = "alerts"
+		m2m.Config.Profiles[0].Mail = maildata{Source: SOURCERECEIVER}
+		m2m.Config.Profiles[0].Filter = filter{}
+		testMattermostProfile(&m2m, mm)
+
+		// the daemon keeps its state open
+		daemon, err := m2m.openStateStore()
+		assert.Nil(t, err)
+		key := StateKey{Profile: "alerts", Folder: "INBOX", UIDValidity: 1}
+		assert.Nil(t, daemon.MarkSent(key, 1))
+
+		err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail(backend, "alert")))
+		assert.Nil(t, err, backend)
+		err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail(backend, "alert")))
+		assert.Nil(t, err, backend)
+
+		// neither state drops the changes of the other one
+		assert.Nil(t, daemon.MarkSent(key, 2))
+		assert.Nil(t, daemon.Close())
+		daemon, err = m2m.openStateStore()
+		assert.Nil(t, err)
+		for _, uid := range []uint32{1, 2} {
+			sent, err := daemon.Sent(key, uid)
+			assert.Nil(t, err)
+			assert.True(t, sent, backend)
+		}
+		assert.Nil(t, daemon.Close())
+	}
+	assert.Len(t, mm.messages(), 2)
+}
+
+func TestDeliveryExitCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{nil, EXOK},
+		{errUnknownProfile("foo"), EXNOUSER},
+		{errInvalidMessage, EXDATAERR},
+		{errDeliveryFailed, EXTEMPFAIL},
+		{errLocalError, EXTEMPFAIL},
+		{fmt.Errorf("mattermost is down"), EXTEMPFAIL},
+		{bolt.ErrTimeout, EXTEMPFAIL},
+		{configError{fmt.Errorf("unknown mail source: foo")}, EXCONFIG},
+		{fmt.Errorf("profile alerts: %w", configError{fmt.Errorf("unknown render mode: foo")}), EXCONFIG},
+	} {
+		assert.Equal(t, c.code, DeliveryExitCode(c.err), fmt.Sprint(c.err))
+	}
+}
+
+func TestDeliverConfigErrors(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	for name, broken := range map[string]func(m2m *Mail2Most){
+		"source":    func(m2m *Mail2Most) { m2m.Config.Profiles[0].Mail.Source = "foo" },
+		"retention": func(m2m *Mail2Most) { m2m.Config.General.StateRetention = "foo" },
+		"template":  func(m2m *Mail2Most) { m2m.Config.Profiles[0].Mattermost.Template = "{{.Mail.Missing}}" },
+		"render":    func(m2m *Mail2Most) { m2m.Config.Profiles[0].Mattermost.Render = "foo" },
+		"color": func(m2m *Mail2Most) {
+			m2m.Config.Profiles[0].Mattermost.Render = RENDERATTACHMENT
+			m2m.Config.Profiles[0].Mattermost.ColorRules = []colorRule{{Subject: "(", Color: "#ff0000"}}
+		},
+	} {
+		m2m, err := New("../conf/mail2most.conf")
+		assert.Nil(t, err)
+		m2m.Config.General.File = filepath.Join(filet.TmpDir(t, ""), "data.json")
+		m2m.Config.Profiles[0].Name = "alerts"
+		m2m.Config.Profiles[0].Mail = maildata{Source: SOURCERECEIVER}
+		m2m.Config.Profiles[0].Filter = filter{}
+		testMattermostProfile(&m2m, mm)
+		broken(&m2m)
+
+		err = m2m.Deliver(context.Background(), "alerts", strings.NewReader(testReceiverMail(name, "alert")))
+		assert.NotNil(t, err, name)
+		assert.Equal(t, EXCONFIG, DeliveryExitCode(err), name)
+	}
+	assert.Len(t, mm.messages(), 0)
+}
@@ -0,0 +1,129 @@
+package mail2most
+
+import (
+	"regexp"
+	"strings"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// isFolderPattern reports whether a folder name contains wildcards
+// * matches any characters including the hierarchy delimiter, % and ? do not cross hierarchy levels
+func isFolderPattern(folder string) bool {
+	return strings.ContainsAny(folder, "*%?")
+}
+
+// folderRegexp translates a folder pattern into a regular expression
+func folderRegexp(pattern, delim string) (*regexp.Regexp, error) {
+	level := "."
+	if delim != "" {
+		level = "[^" + regexp.QuoteMeta(delim) + "]"
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '%':
+			expr.WriteString(level + "*")
+		case '?':
+			expr.WriteString(level)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// matchFolder reports whether a mailbox name matches a folder pattern
+// INBOX is case-insensitive (RFC 3501 section 5.1)
+func matchFolder(pattern, name, delim string) (bool, error) {
+	if strings.EqualFold(name, "INBOX") && strings.EqualFold(pattern, "INBOX") {
+		return true, nil
+	}
+	re, err := folderRegexp(pattern, delim)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(name), nil
+}
+
+// hasFolderPatterns reports whether the folders of a profile have to be resolved using LIST
+func (m Mail2Most) hasFolderPatterns(profile int) bool {
+	if len(m.Config.Profiles[profile].Filter.ExcludeFolders) > 0 {
+		return true
+	}
+	for _, folder := range m.folders(profile) {
+		if isFolderPattern(folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFolders returns the mailboxes checked by a profile
+// folder patterns are expanded using the mailboxes listed by the server, excluded folders are removed
+func (m Mail2Most) resolveFolders(c *client.Client, profile int) ([]string, error) {
+	if !m.hasFolderPatterns(profile) {
+		return m.folders(profile), nil
+	}
+
+	mailboxes, err := m.listMailBoxInfos(c)
+	if err != nil {
+		return []string{}, err
+	}
+
+	var folders []string
+	seen := make(map[string]bool)
+	for _, pattern := range m.folders(profile) {
+		for _, mbox := range mailboxes {
+			if seen[mbox.Name] || hasAttribute(mbox, imap.NoSelectAttr) {
+				continue
+			}
+			ok, err := matchFolder(pattern, mbox.Name, mbox.Delimiter)
+			if err != nil {
+				return []string{}, err
+			}
+			if !ok {
+				continue
+			}
+			excluded, err := m.excludedFolder(profile, mbox)
+			if err != nil {
+				return []string{}, err
+			}
+			if excluded {
+				continue
+			}
+			seen[mbox.Name] = true
+			folders = append(folders, mbox.Name)
+		}
+	}
+	m.Debug("resolved folders", map[string]interface{}{
+		"patterns": m.folders(profile),
+		"exclude":  m.Config.Profiles[profile].Filter.ExcludeFolders,
+		"folders":  folders,
+	})
+	return folders, nil
+}
+
+func (m Mail2Most) excludedFolder(profile int, mbox *imap.MailboxInfo) (bool, error) {
+	for _, pattern := range m.Config.Profiles[profile].Filter.ExcludeFolders {
+		ok, err := matchFolder(pattern, mbox.Name, mbox.Delimiter)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func hasAttribute(mbox *imap.MailboxInfo, attr string) bool {
+	for _, a := range mbox.Attributes {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package mail2most
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchFolder(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"INBOX", "INBOX", true},
+		{"inbox", "INBOX", true},
+		{"Archive", "archive", false},
+		{"Customers/%/Support", "Customers/acme/Support", true},
+		{"Customers/%/Support", "Customers/acme/eu/Support", false},
+		{"Customers/*/Support", "Customers/acme/eu/Support", true},
+		{"Customers/*", "Customers/acme", true},
+		{"Customers/*", "Customers", false},
+		{"Team?", "Team1", true},
+		{"Team?", "Team/", false},
+		{"a.b", "axb", false},
+	}
+	for _, test := range tests {
+		ok, err := matchFolder(test.pattern, test.name, "/")
+		assert.Nil(t, err)
+		assert.Equal(t, test.match, ok, "%s %s", test.pattern, test.name)
+	}
+
+	assert.True(t, isFolderPattern("Customers/*"))
+	assert.False(t, isFolderPattern("Customers"))
+}
+
+func TestResolveFolders(t *testing.T) {
+	addr, be, stop := newTestIMAPServer(t)
+	defer stop()
+
+	u, err := be.Login(nil, "username", "password")
+	assert.Nil(t, err)
+	for _, name := range []string{"Customers", "Customers/acme", "Customers/acme/Support", "Customers/globex/Support",
+		"Customers/globex/Sales", "Customers/initech/eu/Support"} {
+		assert.Nil(t, u.CreateMailbox(name))
+	}
+	be.addMail(t, "Customers/acme/Support", "From: alice@acme.example.com\r\nSubject: help\r\nContent-Type: text/plain\r\n\r\nhelp")
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	c, release, err := m2m.acquire(context.Background(), 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// exact folder names are used without listing the mailboxes
+	folders, err := m2m.resolveFolders(c, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"INBOX"}, folders)
+
+	m2m.Config.Profiles[0].Filter.Folders = []string{"Customers/%/Support"}
+	folders, err = m2m.resolveFolders(c, 0)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"Customers/acme/Support", "Customers/globex/Support"}, folders)
+
+	m2m.Config.Profiles[0].Filter.Folders = []string{"INBOX", "Customers/*/Support", "Customers/acme/*"}
+	m2m.Config.Profiles[0].Filter.ExcludeFolders = []string{"Customers/globex/*"}
+	folders, err = m2m.resolveFolders(c, 0)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"INBOX", "Customers/acme/Support", "Customers/initech/eu/Support"}, folders)
+	release(nil)
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "INBOX", mails[0].Folder)
+		assert.Equal(t, "Customers/acme/Support", mails[1].Folder)
+	}
+}
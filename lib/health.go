@@ -0,0 +1,162 @@
+package mail2most
+
+import (
+	"sync"
+	"time"
+)
+
+// ProfileHealth describes whether the mail server of a profile could be checked
+type ProfileHealth struct {
+	Profile             string
+	LastSuccess         time.Time
+	LastError           string
+	LastErrorTime       time.Time
+	ConsecutiveFailures int
+	// NextAttempt is the earliest time the profile is checked again after a failure
+	NextAttempt time.Time
+	// CircuitOpen is set after Health.FailureThreshold consecutive failures
+	// the profile is then checked once every Health.Cooldown until it recovers
+	CircuitOpen bool
+}
+
+// healthTracker keeps the health of all profiles
+type healthTracker struct {
+	mu       sync.Mutex
+	profiles map[string]*ProfileHealth
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{profiles: make(map[string]*ProfileHealth)}
+}
+
+// get returns the health of a profile, h.mu has to be locked
+func (h *healthTracker) get(profile string) *ProfileHealth {
+	p, ok := h.profiles[profile]
+	if !ok {
+		p = &ProfileHealth{Profile: profile}
+		h.profiles[profile] = p
+	}
+	return p
+}
+
+// Health returns the health of all profiles
+func (m Mail2Most) Health() []ProfileHealth {
+	health := make([]ProfileHealth, len(m.Config.Profiles))
+	for p := range m.Config.Profiles {
+		health[p] = ProfileHealth{Profile: m.Config.Profiles[p].Name}
+		if m.health == nil {
+			continue
+		}
+		m.health.mu.Lock()
+		if h, ok := m.health.profiles[m.Config.Profiles[p].Name]; ok {
+			health[p] = *h
+		}
+		m.health.mu.Unlock()
+	}
+	return health
+}
+
+// profileDue reports whether a profile may be checked or is still backing off
+func (m Mail2Most) profileDue(profile int) bool {
+	if m.health == nil {
+		return true
+	}
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+	h, ok := m.health.profiles[m.Config.Profiles[profile].Name]
+	return !ok || !time.Now().Before(h.NextAttempt)
+}
+
+// profileSucceeded resets the failures of a profile
+func (m Mail2Most) profileSucceeded(profile int) {
+	if m.health == nil {
+		return
+	}
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+	h := m.health.get(m.Config.Profiles[profile].Name)
+	if h.ConsecutiveFailures > 0 {
+		m.Info("profile recovered", map[string]interface{}{
+			"profile":  h.Profile,
+			"failures": h.ConsecutiveFailures,
+		})
+	}
+	h.LastSuccess = time.Now()
+	h.ConsecutiveFailures = 0
+	h.NextAttempt = time.Time{}
+	h.CircuitOpen = false
+}
+
+// profileFailed records a failed check of a profile and computes when it is checked again
+// the wait time doubles with every failure, after Health.FailureThreshold failures the circuit opens
+func (m Mail2Most) profileFailed(profile int, cause error) error {
+	backoff, maxBackoff, cooldown, err := m.healthDurations()
+	if err != nil {
+		return err
+	}
+	if m.health == nil {
+		return nil
+	}
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+
+	now := time.Now()
+	h := m.health.get(m.Config.Profiles[profile].Name)
+	h.LastError = cause.Error()
+	h.LastErrorTime = now
+	h.ConsecutiveFailures++
+
+	if h.ConsecutiveFailures >= m.failureThreshold() {
+		if !h.CircuitOpen {
+			m.Error("circuit breaker opened", map[string]interface{}{
+				"profile":  h.Profile,
+				"failures": h.ConsecutiveFailures,
+				"cooldown": cooldown.String(),
+			})
+		}
+		h.CircuitOpen = true
+		h.NextAttempt = now.Add(cooldown)
+		return nil
+	}
+
+	d := backoff
+	for i := 1; i < h.ConsecutiveFailures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	h.NextAttempt = now.Add(d)
+	return nil
+}
+
+// healthDurations returns the backoff settings of failing profiles
+// the backoff starts at General.TimeInterval if Health.Backoff is not set
+func (m Mail2Most) healthDurations() (backoff, maxBackoff, cooldown time.Duration, err error) {
+	backoff = time.Duration(m.Config.General.TimeInterval) * time.Second
+	maxBackoff, cooldown = 30*time.Minute, 30*time.Minute
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{m.Config.Health.Backoff, &backoff},
+		{m.Config.Health.MaxBackoff, &maxBackoff},
+		{m.Config.Health.Cooldown, &cooldown},
+	} {
+		if d.value == "" {
+			continue
+		}
+		*d.dst, err = time.ParseDuration(d.value)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return backoff, maxBackoff, cooldown, nil
+}
+
+func (m Mail2Most) failureThreshold() int {
+	if m.Config.Health.FailureThreshold > 0 {
+		return m.Config.Health.FailureThreshold
+	}
+	return 5
+}
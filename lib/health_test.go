@@ -0,0 +1,78 @@
+package mail2most
+
+import (
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileHealth(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.TimeInterval = 10
+	m2m.Config.Health = healthConfig{FailureThreshold: 3, Cooldown: "1h"}
+
+	assert.True(t, m2m.profileDue(0))
+
+	// the wait time doubles with every failure
+	assert.Nil(t, m2m.profileFailed(0, assert.AnError))
+	h := m2m.Health()[0]
+	assert.Equal(t, 1, h.ConsecutiveFailures)
+	assert.Equal(t, assert.AnError.Error(), h.LastError)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), h.NextAttempt, time.Second)
+	assert.False(t, m2m.profileDue(0))
+	assert.True(t, m2m.profileDue(1))
+
+	assert.Nil(t, m2m.profileFailed(0, assert.AnError))
+	h = m2m.Health()[0]
+	assert.WithinDuration(t, time.Now().Add(20*time.Second), h.NextAttempt, time.Second)
+	assert.False(t, h.CircuitOpen)
+
+	assert.Nil(t, m2m.profileFailed(0, assert.AnError))
+	h = m2m.Health()[0]
+	assert.True(t, h.CircuitOpen)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), h.NextAttempt, time.Second)
+
+	m2m.profileSucceeded(0)
+	h = m2m.Health()[0]
+	assert.False(t, h.CircuitOpen)
+	assert.Equal(t, 0, h.ConsecutiveFailures)
+	assert.False(t, h.LastSuccess.IsZero())
+	assert.True(t, m2m.profileDue(0))
+
+	m2m.Config.Health.MaxBackoff = "foo"
+	assert.NotNil(t, m2m.profileFailed(0, assert.AnError))
+}
+
+func TestRunIsolatesProfiles(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.NoLoop = true
+	m2m.Config.Outbox.Path = dir + "/outbox"
+
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[1].Mail = m2m.Config.Profiles[0].Mail
+	m2m.Config.Profiles[1].Filter = m2m.Config.Profiles[0].Filter
+	// the first profile can not be reached
+	m2m.Config.Profiles[0].Mail = maildata{ImapServer: "127.0.0.1:1", Username: "username", Password: "password"}
+	for p := range m2m.Config.Profiles {
+		m2m.Config.Profiles[p].Mattermost.URL = "http://127.0.0.1:1"
+	}
+
+	err = m2m.Run()
+	assert.Nil(t, err)
+
+	health := m2m.Health()
+	assert.Equal(t, 1, health[0].ConsecutiveFailures)
+	assert.True(t, health[0].LastSuccess.IsZero())
+	assert.Equal(t, 0, health[1].ConsecutiveFailures)
+	assert.False(t, health[1].LastSuccess.IsZero())
+}
@@ -0,0 +1,193 @@
+package mail2most
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+var errIdleUnsupported = errors.New("server does not support IDLE")
+
+// idleWatchers keeps track of profiles served by IMAP IDLE
+// every watched folder has its own connection and triggers a check of its profile on new mails
+type idleWatchers struct {
+	mu       sync.Mutex
+	fallback map[int]bool
+	// pending are the profiles queued in notify
+	pending map[int]bool
+	notify  chan int
+}
+
+func newIdleWatchers(profiles int) *idleWatchers {
+	return &idleWatchers{
+		fallback: make(map[int]bool),
+		pending:  make(map[int]bool),
+		notify:   make(chan int, profiles),
+	}
+}
+
+// trigger requests a check of the profile, a profile already queued is not queued twice
+// notify holds one check per profile, so the send never blocks
+func (w *idleWatchers) trigger(profile int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending[profile] {
+		return
+	}
+	w.pending[profile] = true
+	w.notify <- profile
+}
+
+// received has to be called after a profile was taken from notify, later changes trigger it again
+func (w *idleWatchers) received(profile int) {
+	w.mu.Lock()
+	delete(w.pending, profile)
+	w.mu.Unlock()
+}
+
+// polling reports whether the profile has to be checked in the regular time interval
+func (m Mail2Most) polling(w *idleWatchers, profile int) bool {
+	// mails of receiver profiles are delivered by the mail server
+	if m.source(profile) == SOURCERECEIVER {
+		return false
+	}
+	if w == nil || !m.Config.Profiles[profile].Mail.Idle {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fallback[profile]
+}
+
+// startIdle starts an IDLE watcher for every folder of all profiles using IDLE
+// the watchers log out once ctx is cancelled
+func (m Mail2Most) startIdle(ctx context.Context) *idleWatchers {
+	w := newIdleWatchers(len(m.Config.Profiles))
+	for p := range m.Config.Profiles {
+		if !m.Config.Profiles[p].Mail.Idle {
+			continue
+		}
+		if m.source(p) != SOURCEIMAP {
+			m.Info("idle not supported", map[string]interface{}{
+				"profile": m.Config.Profiles[p].Name,
+				"source":  m.source(p),
+				"status":  "falling back to polling",
+			})
+			w.fallback[p] = true
+			continue
+		}
+		// the folders matching a pattern change over time so they are polled
+		if m.hasFolderPatterns(p) {
+			m.Info("idle not supported for folder patterns", map[string]interface{}{
+				"profile": m.Config.Profiles[p].Name,
+				"status":  "falling back to polling",
+			})
+			w.fallback[p] = true
+			continue
+		}
+		for _, folder := range m.folders(p) {
+			go m.watchFolder(ctx, p, folder, w)
+		}
+	}
+	return w
+}
+
+// watchFolder keeps an IDLE connection on a folder and reconnects on errors
+// if the server lacks the IDLE capability the profile falls back to polling
+func (m Mail2Most) watchFolder(ctx context.Context, profile int, folder string, w *idleWatchers) {
+	for {
+		err := m.idleFolder(ctx, profile, folder, w)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errIdleUnsupported {
+			m.Info("idle not supported", map[string]interface{}{
+				"server": m.Config.Profiles[profile].Mail.ImapServer,
+				"status": "falling back to polling",
+			})
+			w.mu.Lock()
+			w.fallback[profile] = true
+			w.mu.Unlock()
+			return
+		}
+		m.Error("idle error", map[string]interface{}{
+			"error":  err,
+			"server": m.Config.Profiles[profile].Mail.ImapServer,
+			"folder": folder,
+			"status": "reconnecting",
+		})
+		select {
+		case <-time.After(time.Duration(m.Config.General.TimeInterval) * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m Mail2Most) idleFolder(ctx context.Context, profile int, folder string, w *idleWatchers) error {
+	c, err := m.connect(ctx, profile)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+
+	ok, err := c.Support("IDLE")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errIdleUnsupported
+	}
+
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+	_, err = c.Select(folder, true)
+	if err != nil {
+		return err
+	}
+	m.Debug("idle", map[string]interface{}{
+		"server": m.Config.Profiles[profile].Mail.ImapServer,
+		"folder": folder,
+		"status": "waiting for new mails",
+	})
+	// mails could have arrived while we were not connected
+	w.trigger(profile)
+
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+	go func() {
+		done <- c.Idle(stop, nil)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			close(stop)
+			// updates are drained until the server ended the IDLE command
+			for {
+				select {
+				case <-updates:
+				case <-done:
+					return ctx.Err()
+				}
+			}
+		case u := <-updates:
+			if _, ok := u.(*client.MailboxUpdate); ok {
+				m.Debug("idle", map[string]interface{}{
+					"server": m.Config.Profiles[profile].Mail.ImapServer,
+					"folder": folder,
+					"status": "mailbox changed",
+				})
+				w.trigger(profile)
+			}
+		case err := <-done:
+			if err == nil {
+				err = errors.New("idle stopped")
+			}
+			return err
+		}
+	}
+}
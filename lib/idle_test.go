@@ -0,0 +1,64 @@
+package mail2most
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdle(t *testing.T) {
+	addr, be, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[0].Mail.Idle = true
+
+	w := newIdleWatchers(len(m2m.Config.Profiles))
+	assert.False(t, m2m.polling(w, 0))
+	assert.True(t, m2m.polling(w, 1))
+	assert.True(t, m2m.polling(nil, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m2m.watchFolder(ctx, 0, "INBOX", w)
+
+	// the watcher triggers a check after connecting
+	select {
+	case p := <-w.notify:
+		assert.Equal(t, 0, p)
+		w.received(p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no check triggered after connecting")
+	}
+
+	be.addMail(t, "INBOX", testMailString)
+	select {
+	case p := <-w.notify:
+		assert.Equal(t, 0, p)
+		w.received(p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no check triggered by a new mail")
+	}
+}
+
+func TestIdleTrigger(t *testing.T) {
+	w := newIdleWatchers(2)
+	// a profile with many folders does not hold back the checks of other profiles
+	for i := 0; i < 3; i++ {
+		w.trigger(0)
+	}
+	w.trigger(1)
+	assert.Len(t, w.notify, 2)
+
+	assert.Equal(t, 0, <-w.notify)
+	w.received(0)
+	w.trigger(0)
+	w.trigger(1)
+	assert.Len(t, w.notify, 2)
+	assert.Equal(t, 1, <-w.notify)
+	assert.Equal(t, 0, <-w.notify)
+}
@@ -1,34 +1,96 @@
 package mail2most
 
 import (
-	"crypto/tls"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	imap "github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 )
 
-func (m Mail2Most) connect(profile int) (*client.Client, error) {
+// statusHighestModSeq is the STATUS item of the CONDSTORE extension (RFC 7162)
+const statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// contextDialer dials IMAP servers until its context is cancelled
+type contextDialer struct {
+	ctx context.Context
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(d.ctx, network, addr)
+}
+
+// watchContext terminates the connection once ctx is cancelled, which aborts the running command
+// stop has to be called after the connection is not used anymore
+func watchContext(ctx context.Context, c *client.Client) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Terminate()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (m Mail2Most) connect(ctx context.Context, profile int) (*client.Client, error) {
 	var (
-		c   *client.Client
-		err error
+		c      *client.Client
+		err    error
+		server = m.Config.Profiles[profile].Mail.ImapServer
+		dialer = contextDialer{ctx: ctx}
 	)
-	if m.Config.Profiles[profile].Mail.ImapTLS {
-		var tlsconf tls.Config
-
-		if !m.Config.Profiles[profile].Mail.VerifyTLS {
-			tlsconf.InsecureSkipVerify = true
+	switch mode := m.tlsMode(profile); mode {
+	case TLSIMPLICIT, TLSSTARTTLS:
+		tlsconf, err := m.tlsConfig(profile, server)
+		if err != nil {
+			return nil, err
 		}
-		c, err = client.DialTLS(m.Config.Profiles[profile].Mail.ImapServer, &tlsconf)
-	} else {
-		c, err = client.Dial(m.Config.Profiles[profile].Mail.ImapServer)
+		if mode == TLSIMPLICIT {
+			c, err = client.DialWithDialerTLS(dialer, server, tlsconf)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		c, err = client.DialWithDialer(dialer, server)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := c.SupportStartTLS()
+		if err == nil && !ok {
+			err = fmt.Errorf("server does not support STARTTLS: %s", server)
+		}
+		if err == nil {
+			err = c.StartTLS(tlsconf)
+		}
+		if err != nil {
+			c.Logout()
+			return nil, err
+		}
+	case TLSNONE:
+		c, err = client.DialWithDialer(dialer, server)
+	default:
+		return nil, fmt.Errorf("unknown tls mode: %s", mode)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.Login(m.Config.Profiles[profile].Mail.Username, m.Config.Profiles[profile].Mail.Password)
+	stop := watchContext(ctx, c)
+	err = m.authenticate(ctx, c, profile)
+	stop()
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
+		c.Terminate()
 		return nil, err
 	}
 	m.Debug("mailserver", map[string]interface{}{
@@ -39,77 +101,133 @@ func (m Mail2Most) connect(profile int) (*client.Client, error) {
 	return c, nil
 }
 
+// folders returns the folders configured for a profile, INBOX is used if no folder is defined
+// the folders may contain patterns, see resolveFolders
+func (m Mail2Most) folders(profile int) []string {
+	if len(m.Config.Profiles[profile].Filter.Folders) > 0 {
+		return m.Config.Profiles[profile].Filter.Folders
+	}
+	return []string{"INBOX"}
+}
+
 // GetMail returns emails filter by profile id
 func (m Mail2Most) GetMail(profile int) ([]Mail, error) {
+	return m.GetMailContext(context.Background(), profile)
+}
+
+// GetMailContext returns emails filter by profile id, the mail server connection is closed if ctx is cancelled
+func (m Mail2Most) GetMailContext(ctx context.Context, profile int) ([]Mail, error) {
+	mails, _, err := m.getMail(ctx, profile, nil)
+	return mails, err
+}
+
+// folderSync is the synchronisation state of a mailbox after it was checked
+type folderSync struct {
+	key  StateKey
+	sync FolderSync
+	// examined are the ids of mails not passing the filters of sources without uids,
+	// they are marked as sent so they are not fetched again
+	examined []string
+}
+
+// getMail returns the emails of a profile not examined yet according to the state
+// the returned synchronisation states have to be stored after the mails are processed
+// if state is nil all mails are examined
+func (m Mail2Most) getMail(ctx context.Context, profile int, state StateStore) ([]Mail, []folderSync, error) {
+	switch m.source(profile) {
+	case SOURCEPOP3:
+		return m.getPOP3Mail(ctx, profile, state)
+	case SOURCEJMAP:
+		return m.getJMAPMail(ctx, profile, state)
+	case SOURCEMAILDIR:
+		return m.getMaildirMail(profile, state)
+	case SOURCEMBOX:
+		return m.getMboxMail(profile, state)
+	}
 
 	// Connect to server
-	c, err := m.connect(profile)
+	c, release, err := m.acquire(ctx, profile)
 	if err != nil {
-		return []Mail{}, err
+		return []Mail{}, nil, err
+	}
+	mails, syncs, err := m.fetchMails(c, profile, state)
+	release(err)
+	if ctx.Err() != nil {
+		return []Mail{}, nil, ctx.Err()
 	}
-	defer c.Logout()
+	return mails, syncs, err
+}
 
+// fetchMails returns the emails of all folders of a profile passing the filters
+func (m Mail2Most) fetchMails(c *client.Client, profile int, state StateStore) ([]Mail, []folderSync, error) {
 	// Select Folder
-	folders := []string{"INBOX"}
-	if len(m.Config.Profiles[profile].Filter.Folders) > 0 {
-		folders = m.Config.Profiles[profile].Filter.Folders
+	folders, err := m.resolveFolders(c, profile)
+	if err != nil {
+		return []Mail{}, nil, err
 	}
 	m.Debug("checking folders", map[string]interface{}{
 		"folders": folders,
 	})
 
-	var mails []Mail
+	var (
+		mails     []Mail
+		syncs     []folderSync
+		condstore bool
+	)
+	if state != nil {
+		condstore, err = c.Support("CONDSTORE")
+		if err != nil {
+			return []Mail{}, nil, err
+		}
+	}
 
 	for _, folder := range folders {
+		var modseq uint64
+		if condstore {
+			// unchanged mailboxes are skipped without selecting them
+			status, err := c.Status(folder, []imap.StatusItem{imap.StatusUidValidity, statusHighestModSeq})
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+			modseq = highestModSeq(status)
+			key := StateKey{Profile: m.Config.Profiles[profile].Name, Folder: folder, UIDValidity: status.UidValidity}
+			last, err := state.Sync(key)
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+			if modseq != 0 && last.HighestModSeq == modseq {
+				m.Debug("folder unchanged", map[string]interface{}{"folder": folder, "highestmodseq": modseq})
+				continue
+			}
+		}
+
 		mbox, err := c.Select(folder, m.Config.Profiles[profile].Mail.ReadOnly)
 		if err != nil {
-			return []Mail{}, err
+			return []Mail{}, nil, err
 		}
 
 		m.Info("processing mails", map[string]interface{}{
 			"folder": folder,
 		})
 
-		limit := (m.Config.Profiles[profile].Mail.Limit + 1) - 1
-		seqset := new(imap.SeqSet)
-		if m.Config.Profiles[profile].Filter.Unseen {
-			m.Debug("searching unseen", map[string]interface{}{"unseen": m.Config.Profiles[profile].Filter.Unseen})
-			criteria := imap.NewSearchCriteria()
-			criteria.WithoutFlags = []string{imap.SeenFlag}
-			ids, err := c.Search(criteria)
-			if len(ids) == 0 {
-				m.Debug("no mails found", nil)
-				continue
-			}
+		key := StateKey{Profile: m.Config.Profiles[profile].Name, Folder: folder, UIDValidity: mbox.UidValidity}
+		var last FolderSync
+		if state != nil {
+			last, err = state.Sync(key)
 			if err != nil {
-				return []Mail{}, err
-			}
-
-			// Avoid bucket overflows on ids[0:limit]
-			if limit > uint32(len(ids)) {
-				limit = uint32(len(ids))
+				return []Mail{}, nil, err
 			}
+		}
 
-			if limit > 0 {
-				m.Info("unseen mails limit found", map[string]interface{}{"ids": ids[0:limit], "limit": limit + 1})
-				seqset.AddNum(ids[0:limit]...)
-			} else {
-				m.Info("unseen mails", map[string]interface{}{"ids": ids})
-				seqset.AddNum(ids...)
-			}
-		} else {
-			from := uint32(1)
-			if limit > 0 {
-				if mbox.Messages > limit {
-					from = mbox.Messages - limit
-				}
-				seqset.AddRange(from, mbox.Messages)
-				m.Info("new mails", map[string]interface{}{"from": from, "to": mbox.Messages, "limit": limit + 1})
-			} else {
-				seqset.AddRange(uint32(1), mbox.Messages)
-				m.Info("unseen mails", map[string]interface{}{"from": uint32(1), "to": mbox.Messages, "count": mbox.Messages})
-			}
+		seqset, uid, synced, err := m.searchMails(c, profile, mbox, last.LastUID)
+		if err != nil {
+			return []Mail{}, nil, err
+		}
+		next := FolderSync{LastUID: last.LastUID, HighestModSeq: modseq}
+		if synced > next.LastUID {
+			next.LastUID = synced
 		}
+		syncs = append(syncs, folderSync{key: key, sync: next})
 
 		// nothing to do here
 		if seqset.Empty() {
@@ -120,17 +238,27 @@ func (m Mail2Most) GetMail(profile int) ([]Mail, error) {
 		messages := make(chan *imap.Message, 10000)
 		done := make(chan error, 1)
 		go func() {
-			done <- c.Fetch(seqset, []imap.FetchItem{imap.FetchEnvelope, "BODY[]", imap.FetchUid}, messages)
+			// BODY.PEEK[] does not set \Seen, flags are only changed by the actions
+			section := &imap.BodySectionName{Peek: true}
+			items := []imap.FetchItem{imap.FetchEnvelope, section.FetchItem(), imap.FetchUid}
+			if uid {
+				done <- c.UidFetch(seqset, items, messages)
+				return
+			}
+			done <- c.Fetch(seqset, items, messages)
 		}()
 
 		for msg := range messages {
 			m.Debug("processing message", map[string]interface{}{"uid": msg.Uid, "subject": msg.Envelope.Subject})
+			if msg.Uid > syncs[len(syncs)-1].sync.LastUID {
+				syncs[len(syncs)-1].sync.LastUID = msg.Uid
+			}
 			r := msg.GetBody(&imap.BodySectionName{})
 
 			mr, err := m.read(r)
 			if err != nil {
 				m.Error("Read Error in imap", map[string]interface{}{"Error": err})
-				return []Mail{}, err
+				return []Mail{}, nil, err
 			}
 
 			if mr == nil {
@@ -140,7 +268,7 @@ func (m Mail2Most) GetMail(profile int) ([]Mail, error) {
 			body, attachments, err := m.processReader(mr, profile)
 			if err != nil {
 				m.Error("Read Processing Error", map[string]interface{}{"Error": err})
-				return []Mail{}, err
+				return []Mail{}, nil, err
 			}
 
 			// Skip empty messages.
@@ -161,17 +289,22 @@ func (m Mail2Most) GetMail(profile int) ([]Mail, error) {
 
 			email := Mail{
 				ID:          msg.Uid,
+				Folder:      folder,
+				UIDValidity: mbox.UidValidity,
 				From:        msg.Envelope.From,
 				To:          msg.Envelope.To,
+				Cc:          msg.Envelope.Cc,
 				Subject:     msg.Envelope.Subject,
 				Body:        strings.TrimSuffix(body, "\n"),
 				Date:        msg.Envelope.Date,
 				Attachments: attachments,
+				Header:      headerFields(mr.Header),
 			}
+			setThreadHeaders(&email, mr.Header)
 
 			test, err := m.checkFilters(profile, email)
 			if err != nil {
-				return []Mail{}, err
+				return []Mail{}, nil, err
 			}
 
 			if test {
@@ -185,23 +318,176 @@ func (m Mail2Most) GetMail(profile int) ([]Mail, error) {
 		}
 
 		if err := <-done; err != nil {
-			return []Mail{}, err
+			return []Mail{}, nil, err
 		}
 	}
 
-	return mails, nil
+	return mails, syncs, nil
+}
+
+// searchMails returns the messages of the selected mailbox to fetch and the highest uid examined by it
+// if the profile filters can be expressed as search criteria or lastUID is known the server is searched
+// for uids above lastUID, otherwise the sequence range of the newest messages is returned
+func (m Mail2Most) searchMails(c *client.Client, profile int, mbox *imap.MailboxStatus, lastUID uint32) (*imap.SeqSet, bool, uint32, error) {
+	limit := m.Config.Profiles[profile].Mail.Limit
+	seqset := new(imap.SeqSet)
+	var synced uint32
+	if mbox.UidNext > 0 {
+		synced = mbox.UidNext - 1
+	}
+
+	// nothing arrived since the last check
+	if lastUID > 0 && mbox.UidNext > 0 && lastUID >= mbox.UidNext-1 {
+		return seqset, true, lastUID, nil
+	}
+
+	criteria, err := m.searchCriteria(profile)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if criteria == nil && lastUID == 0 {
+		if mbox.Messages == 0 {
+			return seqset, false, synced, nil
+		}
+		from := uint32(1)
+		if limit > 0 {
+			// the newest limit mails are fetched, like the uids of a search
+			if mbox.Messages > limit {
+				from = mbox.Messages - limit + 1
+			}
+			seqset.AddRange(from, mbox.Messages)
+			m.Info("new mails", map[string]interface{}{"from": from, "to": mbox.Messages, "count": mbox.Messages - from + 1, "limit": limit})
+		} else {
+			seqset.AddRange(uint32(1), mbox.Messages)
+			m.Info("unseen mails", map[string]interface{}{"from": uint32(1), "to": mbox.Messages, "count": mbox.Messages})
+		}
+		return seqset, false, synced, nil
+	}
+	if criteria == nil {
+		criteria = imap.NewSearchCriteria()
+	}
+	if lastUID > 0 {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(lastUID+1, 0)
+	}
+
+	m.Debug("searching mails", map[string]interface{}{"criteria": criteria.Format()})
+	found, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	// lastUID+1:* always contains the highest uid of the mailbox
+	var uids []uint32
+	for _, uid := range found {
+		if uid > lastUID {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return seqset, true, synced, nil
+	}
+	if uids[len(uids)-1] > synced {
+		synced = uids[len(uids)-1]
+	}
+
+	// Avoid bucket overflows on uids[0:limit]
+	if limit > 0 && limit < uint32(len(uids)) {
+		if m.Config.Profiles[profile].Filter.Unseen {
+			// the oldest unseen mails are processed first, the others are examined on the next check
+			uids = uids[0:limit]
+			synced = uids[len(uids)-1]
+		} else {
+			uids = uids[uint32(len(uids))-limit:]
+		}
+		m.Info("matching mails limit found", map[string]interface{}{"uids": uids, "count": len(uids), "limit": limit})
+	} else {
+		m.Info("matching mails", map[string]interface{}{"uids": uids})
+	}
+	seqset.AddNum(uids...)
+	return seqset, true, synced, nil
+}
+
+// highestModSeq returns the HIGHESTMODSEQ of a mailbox status, 0 if it is unknown
+func highestModSeq(status *imap.MailboxStatus) uint64 {
+	v, ok := status.Items[statusHighestModSeq]
+	if !ok || v == nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(fmt.Sprint(v), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// searchCriteria translates the filters of a profile into imap search criteria
+// servers match substrings of the whole header so the results are checked by checkFilters afterwards
+// it returns nil if no filter can be used for searching
+func (m Mail2Most) searchCriteria(profile int) (*imap.SearchCriteria, error) {
+	f := m.Config.Profiles[profile].Filter
+	if len(f.From) == 0 && len(f.To) == 0 && len(f.Subject) == 0 && f.TimeRange == "" && !f.Unseen {
+		return nil, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	addHeaderCriteria(criteria, "From", f.From)
+	addHeaderCriteria(criteria, "To", f.To)
+	addHeaderCriteria(criteria, "Subject", f.Subject)
+	if f.TimeRange != "" {
+		d, err := time.ParseDuration(f.TimeRange)
+		if err != nil {
+			return nil, err
+		}
+		// SINCE only compares dates in the timezone of the server, a day earlier never misses a mail
+		since := time.Now().Add(-d).AddDate(0, 0, -1)
+		criteria.Since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if f.Unseen {
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+	}
+	return criteria, nil
+}
+
+// addHeaderCriteria adds criteria matching a header containing any of the values
+func addHeaderCriteria(criteria *imap.SearchCriteria, header string, values []string) {
+	switch len(values) {
+	case 0:
+	case 1:
+		criteria.Header.Add(header, values[0])
+	default:
+		first, rest := imap.NewSearchCriteria(), imap.NewSearchCriteria()
+		addHeaderCriteria(first, header, values[:1])
+		addHeaderCriteria(rest, header, values[1:])
+		criteria.Or = append(criteria.Or, [2]*imap.SearchCriteria{first, rest})
+	}
 }
 
 // ListMailBoxes lists all available mailboxes
 func (m Mail2Most) ListMailBoxes(profile int) ([]string, error) {
 
 	// Connect to server
-	c, err := m.connect(profile)
+	c, release, err := m.acquire(context.Background(), profile)
+	if err != nil {
+		return []string{}, err
+	}
+	mboxes, err := m.listMailBoxes(c)
+	release(err)
+	return mboxes, err
+}
+
+func (m Mail2Most) listMailBoxes(c *client.Client) ([]string, error) {
+	infos, err := m.listMailBoxInfos(c)
 	if err != nil {
 		return []string{}, err
 	}
-	defer c.Logout()
+	var mboxes []string
+	for _, info := range infos {
+		mboxes = append(mboxes, info.Name)
+	}
+	return mboxes, nil
+}
 
+func (m Mail2Most) listMailBoxInfos(c *client.Client) ([]*imap.MailboxInfo, error) {
 	// List mailboxes
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
@@ -209,31 +495,36 @@ func (m Mail2Most) ListMailBoxes(profile int) ([]string, error) {
 		done <- c.List("", "*", mailboxes)
 	}()
 
-	var mboxes []string
+	var mboxes []*imap.MailboxInfo
 	for m := range mailboxes {
-		mboxes = append(mboxes, m.Name)
+		mboxes = append(mboxes, m)
 	}
 
 	if err := <-done; err != nil {
-		return []string{}, err
+		return nil, err
 	}
 	return mboxes, nil
 }
 
 // ListFlags lists all flags for profile
+// permanent flags are included, \* means the server allows new keywords
 func (m Mail2Most) ListFlags(profile int) ([]string, error) {
 
 	// Connect to server
-	c, err := m.connect(profile)
+	c, release, err := m.acquire(context.Background(), profile)
 	if err != nil {
 		return []string{}, err
 	}
-	defer c.Logout()
+	flags, err := m.listFlags(c, profile)
+	release(err)
+	return flags, err
+}
 
+func (m Mail2Most) listFlags(c *client.Client, profile int) ([]string, error) {
 	// Select Folder
-	folders := []string{"INBOX"}
-	if len(m.Config.Profiles[profile].Filter.Folders) > 0 {
-		folders = m.Config.Profiles[profile].Filter.Folders
+	folders, err := m.resolveFolders(c, profile)
+	if err != nil {
+		return []string{}, err
 	}
 	var flags []string
 	for _, folder := range folders {
@@ -243,6 +534,15 @@ func (m Mail2Most) ListFlags(profile int) ([]string, error) {
 		}
 
 		flags = append(flags, mbox.Flags...)
+	permanent:
+		for _, flag := range mbox.PermanentFlags {
+			for _, f := range flags {
+				if f == flag {
+					continue permanent
+				}
+			}
+			flags = append(flags, flag)
+		}
 	}
 	return flags, nil
 }
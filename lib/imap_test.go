@@ -1,8 +1,12 @@
 package mail2most
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	filet "github.com/Flaque/filet"
+	imap "github.com/emersion/go-imap"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,7 +14,7 @@ func TestMail(t *testing.T) {
 	m2m, err := New("../conf/mail2most.conf")
 	assert.Nil(t, err)
 
-	_, err = m2m.connect(0)
+	_, err = m2m.connect(context.Background(), 0)
 	assert.NotNil(t, err)
 
 	_, err = m2m.GetMail(0)
@@ -22,3 +26,207 @@ func TestMail(t *testing.T) {
 	_, err = m2m.ListFlags(0)
 	assert.NotNil(t, err)
 }
+
+func TestSearchCriteria(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	m2m.Config.Profiles[0].Filter = filter{}
+	criteria, err := m2m.searchCriteria(0)
+	assert.Nil(t, err)
+	assert.Nil(t, criteria)
+
+	m2m.Config.Profiles[0].Filter = filter{From: []string{"alice@example.com"}, Subject: []string{"alert"}, Unseen: true}
+	criteria, err = m2m.searchCriteria(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice@example.com"}, criteria.Header["From"])
+	assert.Equal(t, []string{"alert"}, criteria.Header["Subject"])
+	assert.Equal(t, []string{imap.SeenFlag}, criteria.WithoutFlags)
+
+	// multiple values are combined using OR
+	m2m.Config.Profiles[0].Filter = filter{To: []string{"a", "b", "c"}}
+	criteria, err = m2m.searchCriteria(0)
+	assert.Nil(t, err)
+	assert.Len(t, criteria.Or, 1)
+	assert.Equal(t, []string{"a"}, criteria.Or[0][0].Header["To"])
+	assert.Equal(t, []string{"b"}, criteria.Or[0][1].Or[0][0].Header["To"])
+	assert.Equal(t, []string{"c"}, criteria.Or[0][1].Or[0][1].Header["To"])
+
+	m2m.Config.Profiles[0].Filter = filter{TimeRange: "48h"}
+	criteria, err = m2m.searchCriteria(0)
+	assert.Nil(t, err)
+	assert.True(t, criteria.Since.Before(time.Now().Add(-72*time.Hour)))
+
+	m2m.Config.Profiles[0].Filter = filter{TimeRange: "foo"}
+	_, err = m2m.searchCriteria(0)
+	assert.NotNil(t, err)
+}
+
+func TestGetMailSearch(t *testing.T) {
+	addr, be, stop := newTestIMAPServer(t)
+	defer stop()
+
+	date := time.Now().Format(time.RFC1123Z)
+	for _, mail := range []string{
+		"From: alice@example.com\r\nTo: team@example.com\r\nSubject: alert: disk full\r\nDate: " + date + "\r\nContent-Type: text/plain\r\n\r\ndisk full",
+		"From: bob@example.com\r\nTo: team@example.com\r\nSubject: alert: cpu\r\nDate: " + date + "\r\nContent-Type: text/plain\r\n\r\ncpu",
+		"From: carol@example.com\r\nTo: team@example.com\r\nSubject: lunch\r\nDate: " + date + "\r\nContent-Type: text/plain\r\n\r\nlunch",
+	} {
+		be.addMail(t, "INBOX", mail)
+	}
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	m2m.Config.Profiles[0].Filter.From = []string{"alice", "carol"}
+	m2m.Config.Profiles[0].Filter.Subject = []string{"alert"}
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "alert: disk full", mails[0].Subject)
+	}
+
+	// the server matches the arrival date, the date header is checked afterwards
+	m2m.Config.Profiles[0].Filter = filter{Folders: []string{"INBOX"}, TimeRange: "1h"}
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 3)
+
+	m2m.Config.Profiles[0].Filter = filter{Folders: []string{"INBOX"}, To: []string{"team@"}}
+	m2m.Config.Profiles[0].Mail.Limit = 2
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "alert: cpu", mails[0].Subject)
+		assert.Equal(t, "lunch", mails[1].Subject)
+	}
+}
+
+func TestGetMailIncremental(t *testing.T) {
+	defer filet.CleanUp(t)
+	addr, be, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	state, err := m2m.openJSONStateStore(filet.TmpDir(t, "") + "/data.json")
+	assert.Nil(t, err)
+
+	mails, syncs, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+	if assert.Len(t, syncs, 1) {
+		assert.Equal(t, uint32(6), syncs[0].sync.LastUID)
+		assert.Nil(t, state.SetSync(syncs[0].key, syncs[0].sync))
+	}
+
+	date := time.Now().Format(time.RFC1123Z)
+	be.addMail(t, "INBOX", "From: carol@example.com\r\nSubject: lunch\r\nDate: "+date+"\r\nContent-Type: text/plain\r\n\r\nlunch")
+	be.addMail(t, "INBOX", "From: alice@example.com\r\nSubject: alert\r\nDate: "+date+"\r\nContent-Type: text/plain\r\n\r\nalert")
+
+	// only mails arrived after the last check are examined
+	m2m.Config.Profiles[0].Filter.Subject = []string{"alert"}
+	mails, syncs, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, uint32(8), mails[0].ID)
+	}
+	if assert.Len(t, syncs, 1) {
+		assert.Equal(t, uint32(8), syncs[0].sync.LastUID)
+		assert.Nil(t, state.SetSync(syncs[0].key, syncs[0].sync))
+	}
+
+	mails, syncs, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 0)
+	if assert.Len(t, syncs, 1) {
+		assert.Equal(t, uint32(8), syncs[0].sync.LastUID)
+	}
+
+	// without a state all mails are examined
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+}
+
+func TestGetMailLimit(t *testing.T) {
+	defer filet.CleanUp(t)
+	addr, be, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[0].Mail.Limit = 2
+	defer m2m.pool.close()
+
+	date := time.Now().Format(time.RFC1123Z)
+	for _, subject := range []string{"one", "two", "three"} {
+		be.addMail(t, "INBOX", "From: carol@example.com\r\nSubject: "+subject+"\r\nDate: "+date+"\r\nContent-Type: text/plain\r\n\r\n"+subject)
+	}
+
+	// the sequence range and the uid search fetch the same number of mails
+	state, err := m2m.openJSONStateStore(filet.TmpDir(t, "") + "/data.json")
+	assert.Nil(t, err)
+	mails, syncs, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "two", mails[0].Subject)
+		assert.Equal(t, "three", mails[1].Subject)
+	}
+	if assert.Len(t, syncs, 1) {
+		syncs[0].sync.LastUID = 7
+		assert.Nil(t, state.SetSync(syncs[0].key, syncs[0].sync))
+	}
+	be.addMail(t, "INBOX", "From: carol@example.com\r\nSubject: four\r\nDate: "+date+"\r\nContent-Type: text/plain\r\n\r\nfour")
+
+	mails, _, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "three", mails[0].Subject)
+		assert.Equal(t, "four", mails[1].Subject)
+	}
+}
+
+func TestGetMailCondstore(t *testing.T) {
+	defer filet.CleanUp(t)
+	addr, be, stop := newExtTestIMAPServer(t, true)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	state, err := m2m.openJSONStateStore(filet.TmpDir(t, "") + "/data.json")
+	assert.Nil(t, err)
+
+	mails, syncs, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+	if !assert.Len(t, syncs, 1) {
+		return
+	}
+	assert.Equal(t, uint64(1), syncs[0].sync.HighestModSeq)
+
+	// unchanged folders are skipped even if they were never examined completely
+	assert.Nil(t, state.SetSync(syncs[0].key, FolderSync{HighestModSeq: 1}))
+	mails, syncs, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 0)
+	assert.Len(t, syncs, 0)
+
+	be.addMail(t, "INBOX", "From: alice@example.com\r\nSubject: alert\r\nContent-Type: text/plain\r\n\r\nalert")
+	mails, syncs, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 2)
+	if assert.Len(t, syncs, 1) {
+		assert.Equal(t, uint64(2), syncs[0].sync.HighestModSeq)
+		assert.Equal(t, uint32(7), syncs[0].sync.LastUID)
+	}
+}
@@ -0,0 +1,122 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// imapPool keeps one authenticated connection per mail account
+// profiles using the same server and credentials share a connection
+type imapPool struct {
+	mu    sync.Mutex
+	conns map[string]*imapConn
+}
+
+// imapConn is a pooled connection, only one user at a time is allowed
+type imapConn struct {
+	mu sync.Mutex
+	c  *client.Client
+}
+
+func newIMAPPool() *imapPool {
+	return &imapPool{conns: make(map[string]*imapConn)}
+}
+
+// account returns the key of the connection used by a profile
+func (m Mail2Most) account(profile int) string {
+	mail := m.Config.Profiles[profile].Mail
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%t\x00%s\x00%s\x00%s\x00%s\x00%s",
+		mail.ImapServer, mail.Username, mail.Password, mail.Auth, oauth2CacheKey(mail.OAuth2)+"\x00"+mail.OAuth2.AccessToken,
+		m.tlsMode(profile), mail.VerifyTLS, mail.CAFile, mail.ClientCert, mail.ClientKey, mail.ServerName, mail.MinTLSVersion,
+	)
+}
+
+// acquire returns an authenticated connection for a profile
+// pooled connections are checked using NOOP and replaced if they are broken
+// release has to be called after using the connection, if err is not nil the connection is dropped
+// the connection is terminated if ctx is cancelled before release is called
+func (m Mail2Most) acquire(ctx context.Context, profile int) (*client.Client, func(err error), error) {
+	if m.pool == nil {
+		c, err := m.connect(ctx, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		stop := watchContext(ctx, c)
+		return c, func(error) {
+			stop()
+			c.Logout()
+		}, nil
+	}
+
+	key := m.account(profile)
+	m.pool.mu.Lock()
+	conn, ok := m.pool.conns[key]
+	if !ok {
+		conn = &imapConn{}
+		m.pool.conns[key] = conn
+	}
+	m.pool.mu.Unlock()
+
+	conn.mu.Lock()
+	if conn.c != nil {
+		// a hung server must not block the shutdown
+		stop := watchContext(ctx, conn.c)
+		err := conn.c.Noop()
+		stop()
+		if err != nil || conn.c.State() == imap.LogoutState {
+			m.Info("mailserver", map[string]interface{}{
+				"status": "connection lost, reconnecting",
+				"server": m.Config.Profiles[profile].Mail.ImapServer,
+				"error":  err,
+			})
+			conn.c.Terminate()
+			conn.c = nil
+		}
+	}
+	if conn.c == nil {
+		c, err := m.connect(ctx, profile)
+		if err != nil {
+			conn.mu.Unlock()
+			return nil, nil, err
+		}
+		conn.c = c
+	}
+
+	c := conn.c
+	stop := watchContext(ctx, c)
+	release := func(err error) {
+		stop()
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			m.Debug("mailserver", map[string]interface{}{
+				"status": "dropping connection after error",
+				"server": m.Config.Profiles[profile].Mail.ImapServer,
+				"error":  err,
+			})
+			c.Logout()
+			conn.c = nil
+		}
+		conn.mu.Unlock()
+	}
+	return c, release, nil
+}
+
+// close logs out all pooled connections
+func (p *imapPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conn := range p.conns {
+		conn.mu.Lock()
+		if conn.c != nil {
+			conn.c.Logout()
+		}
+		conn.mu.Unlock()
+		delete(p.conns, key)
+	}
+}
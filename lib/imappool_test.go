@@ -0,0 +1,133 @@
+package mail2most
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIMAPPool(t *testing.T) {
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[1].Mail = m2m.Config.Profiles[0].Mail
+	defer m2m.pool.close()
+
+	c, release, err := m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	release(nil)
+
+	// the connection is reused and shared by profiles using the same account
+	c2, release, err := m2m.acquire(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, c == c2)
+	release(nil)
+
+	// broken connections are replaced
+	c.Terminate()
+	c2, release, err = m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.False(t, c == c2)
+	release(nil)
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+
+	mboxes, err := m2m.ListMailBoxes(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"INBOX"}, mboxes)
+
+	// errors drop the connection
+	c, release, err = m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	release(assert.AnError)
+	c2, release, err = m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.False(t, c == c2)
+	release(nil)
+
+	// connections are not pooled without a pool
+	m2m.pool = nil
+	c, release, err = m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.False(t, c == c2)
+	release(nil)
+}
+
+// hangingProxy forwards connections to addr until hang is called, from then on the server seems to hang
+func hangingProxy(t *testing.T, addr string) (string, func(), func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hung int32
+	forward := func(dst, src net.Conn) {
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				dst.Close()
+				return
+			}
+			if atomic.LoadInt32(&hung) == 0 {
+				dst.Write(buf[:n])
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go forward(server, conn)
+			go forward(conn, server)
+		}
+	}()
+	return l.Addr().String(), func() { atomic.StoreInt32(&hung, 1) }, func() { l.Close() }
+}
+
+func TestIMAPPoolHungServer(t *testing.T) {
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+	addr, hang, stopProxy := hangingProxy(t, addr)
+	defer stopProxy()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	defer m2m.pool.close()
+
+	_, release, err := m2m.acquire(context.Background(), 0)
+	assert.Nil(t, err)
+	release(nil)
+
+	// the check of the pooled connection is aborted with the context
+	hang()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := m2m.acquire(ctx, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire did not stop")
+	}
+}
@@ -1,6 +1,178 @@
 package mail2most
 
-import "time"
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// testIMAPBackend is an in memory imap backend (user "username", password "password")
+// updates pushed into the updates channel are sent to all connected clients
+type testIMAPBackend struct {
+	*memory.Backend
+	updates chan backend.Update
+}
+
+func (b testIMAPBackend) Updates() <-chan backend.Update {
+	return b.updates
+}
+
+// addMail appends a mail to a mailbox of the test backend and notifies all clients
+func (b testIMAPBackend) addMail(t *testing.T, mailbox, mail string) {
+	u, err := b.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mbox.CreateMessage([]string{}, time.Now(), bytes.NewBufferString(mail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate("username", mailbox), MailboxStatus: status}
+}
+
+// newTestIMAPServer starts a plaintext imap server on localhost
+func newTestIMAPServer(t *testing.T) (string, testIMAPBackend, func()) {
+	be := testIMAPBackend{Backend: memory.New(), updates: make(chan backend.Update, 10)}
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	addr, stop := serveTestIMAP(t, s)
+	return addr, be, stop
+}
+
+// serveTestIMAP serves s on a random port of localhost
+func serveTestIMAP(t *testing.T, s *server.Server) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String(), func() { s.Close() }
+}
+
+// newTestIMAPServerTLS starts an imap server on localhost offering STARTTLS
+func newTestIMAPServerTLS(t *testing.T, tlsconf *tls.Config) (string, func()) {
+	s := server.New(memory.New())
+	s.TLSConfig = tlsconf
+	return serveTestIMAP(t, s)
+}
+
+// testExtBackend adds MOVE and the HIGHESTMODSEQ status item of CONDSTORE to the test backend
+// the HIGHESTMODSEQ of a mailbox is its number of messages
+type testExtBackend struct {
+	testIMAPBackend
+}
+
+func (b testExtBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := b.testIMAPBackend.Login(connInfo, username, password)
+	return testExtUser{u}, err
+}
+
+type testExtUser struct {
+	backend.User
+}
+
+func (u testExtUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return testExtMailbox{Mailbox: mbox, user: u.User}, nil
+}
+
+type testExtMailbox struct {
+	backend.Mailbox
+	user backend.User
+}
+
+func (mbox testExtMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.Mailbox.Status(append(items, imap.StatusMessages))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := status.Items[statusHighestModSeq]; ok {
+		status.Items[statusHighestModSeq] = status.Messages
+	}
+	return status, nil
+}
+
+func (mbox testExtMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	err := mbox.CopyMessages(uid, seqset, dest)
+	if err != nil {
+		return err
+	}
+	err = mbox.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag})
+	if err != nil {
+		return err
+	}
+	return mbox.Expunge()
+}
+
+// ListMessages sets \Seen if a body is fetched without BODY.PEEK like real servers do
+func (mbox testExtMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err == nil && !section.Peek {
+			err = mbox.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.SeenFlag})
+			if err != nil {
+				close(ch)
+				return err
+			}
+			break
+		}
+	}
+	return mbox.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+// condstoreExtension advertises the CONDSTORE capability
+type condstoreExtension struct{}
+
+func (condstoreExtension) Capabilities(c server.Conn) []string {
+	return []string{"CONDSTORE"}
+}
+
+func (condstoreExtension) Command(name string) server.HandlerFactory {
+	return nil
+}
+
+// newExtTestIMAPServer starts a plaintext imap server on localhost using testExtBackend
+func newExtTestIMAPServer(t *testing.T, condstore bool) (string, testIMAPBackend, func()) {
+	be := testIMAPBackend{Backend: memory.New(), updates: make(chan backend.Update, 10)}
+	s := server.New(testExtBackend{be})
+	s.AllowInsecureAuth = true
+	if condstore {
+		s.Enable(condstoreExtension{})
+	}
+	addr, stop := serveTestIMAP(t, s)
+	return addr, be, stop
+}
+
+// testIMAPProfile points profile 0 to the test imap server
+func testIMAPProfile(m2m *Mail2Most, addr string) {
+	m2m.Config.Profiles[0].Mail = maildata{ImapServer: addr, Username: "username", Password: "password"}
+	m2m.Config.Profiles[0].Filter = filter{Folders: []string{"INBOX"}}
+}
 
 var testDate, _ = time.Parse(time.RFC1123Z, "Sat, 18 Jun 2016 12:00:00 +0900")
 
@@ -75,3 +247,148 @@ const testBodyString = "--message-boundary\r\n" +
 	"\r\n--message-boundary--\r\n"
 
 const testMailString = testHeaderString + testBodyString
+
+// testMattermost is a mattermost server accepting posts to every channel
+// users are only found by their username, so mails are posted using the from line of the mail
+// the access token "mytoken" and the sessions of logins (user "username", password "password") are accepted
+type testMattermost struct {
+	*httptest.Server
+	mu    sync.Mutex
+	posts []map[string]interface{}
+	// fail lets all posts fail with an internal server error, failing only the posts of some channel ids
+	fail    bool
+	failing map[string]bool
+	// sessions are the valid session tokens
+	sessions        map[string]bool
+	logins, logouts int
+	// files are the uploaded files by their id
+	files map[string][]byte
+}
+
+// newTestMattermost starts the test mattermost server, posts are recorded
+func newTestMattermost(t *testing.T) *testMattermost {
+	mm := &testMattermost{sessions: make(map[string]bool), files: make(map[string][]byte), failing: make(map[string]bool)}
+	mm.Server = httptest.NewServer(http.HandlerFunc(mm.handle))
+	return mm
+}
+
+// expireSessions lets all sessions expire
+func (mm *testMattermost) expireSessions() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.sessions = make(map[string]bool)
+}
+
+func (mm *testMattermost) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v4")
+	mm.mu.Lock()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "BEARER ")
+	authorized := token == "mytoken" || mm.sessions[token]
+	mm.mu.Unlock()
+	if !authorized && path != "/users/login" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "api.context.session_expired.app_error", "message": "invalid or expired session", "status_code": 401})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && path == "/users/login":
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["login_id"] != "username" || login["password"] != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "api.user.login.invalid_credentials", "message": "invalid credentials", "status_code": 401})
+			return
+		}
+		mm.mu.Lock()
+		mm.logins++
+		token := fmt.Sprintf("session-%d", mm.logins)
+		mm.sessions[token] = true
+		mm.mu.Unlock()
+		w.Header().Set("Token", token)
+		json.NewEncoder(w).Encode(map[string]string{"id": "me", "username": "mail2most", "email": "mail2most@example.com"})
+	case r.Method == http.MethodPost && path == "/users/logout":
+		mm.mu.Lock()
+		mm.logouts++
+		delete(mm.sessions, token)
+		mm.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+	case r.Method == http.MethodGet && path == "/users/me":
+		json.NewEncoder(w).Encode(map[string]string{"id": "me", "username": "mail2most", "email": "mail2most@example.com"})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/users/username/"):
+		name := path[strings.LastIndex(path, "/")+1:]
+		json.NewEncoder(w).Encode(map[string]string{"id": "user-" + name, "username": name})
+	case r.Method == http.MethodPost && path == "/channels/direct":
+		var ids []string
+		json.NewDecoder(r.Body).Decode(&ids)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": "direct-" + strings.Join(ids, "-")})
+	case r.Method == http.MethodPost && path == "/files":
+		f, h, err := r.FormFile("files")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		mm.mu.Lock()
+		id := "file-" + h.Filename
+		mm.files[id] = b
+		mm.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"file_infos": []map[string]string{{"id": id, "name": h.Filename}}})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/teams/name/"):
+		name := path[strings.LastIndex(path, "/")+1:]
+		json.NewEncoder(w).Encode(map[string]string{"id": "channel-" + name, "name": name})
+	case r.Method == http.MethodPost && path == "/posts":
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+		var post map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&post)
+		if channel, _ := post["channel_id"].(string); mm.fail || mm.failing[channel] {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "app.post.save.app_error", "message": "unable to save the post", "status_code": 500})
+			return
+		}
+		if root, _ := post["root_id"].(string); root != "" && !mm.posted(root) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "api.post.create_post.root_id.app_error", "message": "invalid RootId parameter", "status_code": 400})
+			return
+		}
+		post["id"] = fmt.Sprintf("post-%d", len(mm.posts)+1)
+		mm.posts = append(mm.posts, post)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(post)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "api.context.404.app_error", "message": "not found", "status_code": 404})
+	}
+}
+
+// posted reports whether a post exists, the caller holds mm.mu
+func (mm *testMattermost) posted(id string) bool {
+	for _, post := range mm.posts {
+		if post["id"] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// messages returns the messages of all posts
+func (mm *testMattermost) messages() []string {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	var msgs []string
+	for _, post := range mm.posts {
+		msg, _ := post["message"].(string)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// testMattermostProfile lets profile 0 post to the test mattermost server
+func testMattermostProfile(m2m *Mail2Most, mm *testMattermost) {
+	m2m.Config.Profiles[0].Mattermost.URL = mm.URL
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#some-channel"}
+	m2m.Config.Profiles[0].Mattermost.Users = nil
+}
@@ -1,11 +1,14 @@
 package mail2most
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"net/textproto"
+	"os"
 	"reflect"
 	"strings"
 	"time"
@@ -15,6 +18,7 @@ import (
 	_ "image/jpeg"
 	_ "image/png"
 
+	imap "github.com/emersion/go-imap"
 	gomessage "github.com/emersion/go-message"
 	"github.com/emersion/go-message/charset"
 	gomail "github.com/emersion/go-message/mail"
@@ -57,11 +61,27 @@ func New(confPath string) (Mail2Most, error) {
 					}
 				}
 			}
+			prof.Name = p.Name
 			conf.Profiles[k] = prof
 		}
 	}
 
-	m := Mail2Most{Config: conf}
+	err = setProfileNames(conf.Profiles)
+	if err != nil {
+		return Mail2Most{}, err
+	}
+
+	err = checkTemplates(conf.Profiles)
+	if err != nil {
+		return Mail2Most{}, err
+	}
+
+	err = checkColorRules(conf.Profiles)
+	if err != nil {
+		return Mail2Most{}, err
+	}
+
+	m := Mail2Most{Config: conf, pool: newIMAPPool(), tokens: newTokenCache(), health: newHealthTracker(), mattermost: newMattermostPool()}
 	err = m.initLogger()
 	if err != nil {
 		return Mail2Most{}, err
@@ -70,6 +90,68 @@ func New(confPath string) (Mail2Most, error) {
 	return m, nil
 }
 
+// profileName returns the name of a profile without Name, it is derived from its mail account
+// so it does not change if profiles are reordered
+func profileName(p profile) string {
+	switch p.Mail.Source {
+	case SOURCEPOP3:
+		return fmt.Sprintf("%s@%s", p.Mail.Username, p.Mail.Pop3Server)
+	case SOURCEJMAP:
+		return fmt.Sprintf("%s@%s", p.Mail.Username, p.Mail.JmapURL)
+	case SOURCEMAILDIR, SOURCEMBOX:
+		return fmt.Sprintf("%s:%s", p.Mail.Source, p.Mail.Path)
+	case SOURCERECEIVER:
+		return fmt.Sprintf("%s:%s", p.Mail.Source, strings.Join(p.Mail.Recipients, ","))
+	default:
+		return fmt.Sprintf("%s@%s", p.Mail.Username, p.Mail.ImapServer)
+	}
+}
+
+// profileHash returns a short hash of the filters and destinations of a profile
+func profileHash(p profile) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v\x00%s\x00%s\x00%q\x00%q",
+		p.Filter, p.Mattermost.URL, p.Mattermost.Team, p.Mattermost.Channels, p.Mattermost.Users)))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// setProfileNames makes sure every profile has a unique name
+// profiles without a name are named after their mail account, profiles sharing an account are told apart
+// by a hash of their filters and destinations, so the names do not depend on the order of the profiles
+func setProfileNames(profiles []profile) error {
+	names := make(map[string]bool)
+	for _, p := range profiles {
+		if p.Name != "" {
+			if names[p.Name] {
+				return fmt.Errorf("duplicate profile name: %s", p.Name)
+			}
+			names[p.Name] = true
+		}
+	}
+	accounts := make(map[string]int)
+	for _, p := range profiles {
+		if p.Name == "" {
+			accounts[profileName(p)]++
+		}
+	}
+	for k, p := range profiles {
+		if p.Name != "" {
+			continue
+		}
+		name := profileName(p)
+		if accounts[name] > 1 || names[name] {
+			name += "#" + profileHash(p)
+		}
+		// identical profiles only differ by their position
+		unique := name
+		for n := 2; names[unique]; n++ {
+			unique = fmt.Sprintf("%s#%d", name, n)
+		}
+		names[unique] = true
+		profiles[k].Name = unique
+	}
+	return nil
+}
+
 func (m Mail2Most) containsFrom(profile int, mail Mail) bool {
 	if len(m.Config.Profiles[profile].Filter.From) == 0 {
 		return true
@@ -143,16 +225,30 @@ func (m Mail2Most) checkFilters(profile int, mail Mail) (bool, error) {
 
 }
 
-func writeToFile(data [][]uint32, filename string) error {
+// writeToFile writes data as json to a temporary file and renames it afterwards
+// so a crash never leaves a half written file behind
+func writeToFile(data interface{}, filename string) error {
 	file, err := json.MarshalIndent(data, "", " ")
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename, file, 0644)
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = f.Write(file)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 // read returns a mail.Reader if the charset is correct or convertable
@@ -320,3 +416,87 @@ func (m Mail2Most) processReader(mr *gomail.Reader, profile int) (string, []Atta
 	}
 	return body, attachments, nil
 }
+
+// parseMail reads a raw message of sources without an IMAP envelope (e.g. POP3)
+// the envelope is taken from the header fields, ok is false if the mail can not be read or is empty
+func (m Mail2Most) parseMail(r io.Reader, profile int) (Mail, bool, error) {
+	mr, err := m.read(r)
+	if err != nil || mr == nil {
+		return Mail{}, false, err
+	}
+
+	var mail Mail
+	mail.Subject, _ = mr.Header.Subject()
+	mail.Date, _ = mr.Header.Date()
+	mail.From = imapAddresses(mr.Header, "From")
+	mail.To = imapAddresses(mr.Header, "To")
+	mail.Cc = imapAddresses(mr.Header, "Cc")
+	mail.Header = headerFields(mr.Header)
+	setThreadHeaders(&mail, mr.Header)
+
+	body, attachments, err := m.processReader(mr, profile)
+	if err != nil {
+		m.Error("Read Processing Error", map[string]interface{}{"Error": err})
+		return Mail{}, false, err
+	}
+	mail.Body = strings.TrimSuffix(body, "\n")
+	mail.Attachments = attachments
+	return mail, m.postable(mail), nil
+}
+
+// postable reports whether a mail has content and a sender, mail server error notifications are skipped
+func (m Mail2Most) postable(mail Mail) bool {
+	// Skip empty messages.
+	if len(strings.TrimSpace(mail.Body)) < 1 && len(mail.Attachments) < 1 {
+		m.Info("blank message", map[string]interface{}{"subject": mail.Subject})
+		return false
+	}
+
+	// Skip mailserver error notifications.
+	if strings.HasPrefix(mail.Subject, "Delivery Status Notification") {
+		m.Info("skipping mailserver error", map[string]interface{}{"subject": mail.Subject})
+		return false
+	}
+
+	if len(mail.From) == 0 {
+		m.Info("mail without sender", map[string]interface{}{"subject": mail.Subject})
+		return false
+	}
+	return true
+}
+
+// imapAddresses converts an address header field into the address type of the IMAP envelope
+func imapAddresses(h gomail.Header, key string) []*imap.Address {
+	list, err := h.AddressList(key)
+	if err != nil {
+		return nil
+	}
+	addresses := make([]*imap.Address, 0, len(list))
+	for _, a := range list {
+		addresses = append(addresses, imapAddress(a.Name, a.Address))
+	}
+	return addresses
+}
+
+// headerFields returns the decoded header fields of a mail by their canonical key
+func headerFields(h gomail.Header) map[string][]string {
+	fields := make(map[string][]string, h.Len())
+	for f := h.Fields(); f.Next(); {
+		v, err := f.Text()
+		if err != nil {
+			v = f.Value()
+		}
+		key := textproto.CanonicalMIMEHeaderKey(f.Key())
+		fields[key] = append(fields[key], v)
+	}
+	return fields
+}
+
+// imapAddress splits an address into the mailbox and host name of the IMAP envelope
+func imapAddress(name, address string) *imap.Address {
+	a := &imap.Address{PersonalName: name, MailboxName: address}
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		a.MailboxName, a.HostName = address[:i], address[i+1:]
+	}
+	return a
+}
@@ -146,7 +146,7 @@ func TestWriteToFile(t *testing.T) {
 	err = writeToFile(data, "/tmp/doesnotexists/delete.me")
 	assert.NotNil(t, err)
 	if err != nil {
-		assert.Equal(t, err.Error(), "open /tmp/doesnotexists/delete.me: no such file or directory")
+		assert.Equal(t, err.Error(), "open /tmp/doesnotexists/delete.me.tmp: no such file or directory")
 	}
 }
 
@@ -0,0 +1,784 @@
+package mail2most
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	jmapCoreCapability = "urn:ietf:params:jmap:core"
+	jmapMailCapability = "urn:ietf:params:jmap:mail"
+	// jmapGetChunk is the number of mails requested by a single Email/get, servers have to support at least 500
+	jmapGetChunk = 100
+)
+
+// jmapEmailProperties are requested for every mail
+var jmapEmailProperties = []string{
+	"id", "mailboxIds", "keywords", "receivedAt", "subject", "from", "to", "cc",
+	"headers", "textBody", "htmlBody", "bodyValues", "attachments", "messageId", "inReplyTo", "references",
+}
+
+// jmapClient is a minimal JMAP client (RFC 8620) for the mail capability (RFC 8621)
+type jmapClient struct {
+	ctx     context.Context
+	http    *http.Client
+	auth    func(req *http.Request)
+	session jmapSession
+	account string
+}
+
+// jmapSession is the session resource of the server
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+// jmapCall is a method call of a request, it is encoded as [name, arguments, call id]
+type jmapCall struct {
+	name string
+	args map[string]interface{}
+}
+
+// jmapResponse is a method response
+type jmapResponse struct {
+	name string
+	args json.RawMessage
+}
+
+// jmapError is a method level error (RFC 8620 section 3.6.2)
+type jmapError struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (e jmapError) Error() string {
+	if e.Description != "" {
+		return "jmap: " + e.Type + ": " + e.Description
+	}
+	return "jmap: " + e.Type
+}
+
+type jmapMailbox struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	Role     string `json:"role"`
+}
+
+type jmapAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type jmapBodyPart struct {
+	PartID string `json:"partId"`
+	BlobID string `json:"blobId"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+}
+
+type jmapEmail struct {
+	ID         string          `json:"id"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+	Subject    string          `json:"subject"`
+	From       []jmapAddress   `json:"from"`
+	To         []jmapAddress   `json:"to"`
+	Cc         []jmapAddress   `json:"cc"`
+	Headers    []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"headers"`
+	TextBody   []jmapBodyPart `json:"textBody"`
+	HTMLBody   []jmapBodyPart `json:"htmlBody"`
+	BodyValues map[string]struct {
+		Value string `json:"value"`
+	} `json:"bodyValues"`
+	Attachments []jmapBodyPart `json:"attachments"`
+	MessageID   []string       `json:"messageId"`
+	InReplyTo   []string       `json:"inReplyTo"`
+	References  []string       `json:"references"`
+}
+
+// decode decodes the arguments of a response, error responses are returned as jmapError
+func (r jmapResponse) decode(v interface{}) error {
+	if r.name == "error" {
+		var e jmapError
+		err := json.Unmarshal(r.args, &e)
+		if err != nil {
+			return err
+		}
+		return e
+	}
+	return json.Unmarshal(r.args, v)
+}
+
+// do sends a request authenticated by the profile credentials
+func (c *jmapClient) do(method, u string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.auth(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jmap: %s %s: %s", method, u, resp.Status)
+	}
+	return b, nil
+}
+
+// call sends method calls in a single request, the arguments of every call get the accountId
+func (c *jmapClient) call(calls ...jmapCall) ([]jmapResponse, error) {
+	methodCalls := make([][]interface{}, 0, len(calls))
+	for i, call := range calls {
+		call.args["accountId"] = c.account
+		methodCalls = append(methodCalls, []interface{}{call.name, call.args, fmt.Sprint(i)})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"using":       []string{jmapCoreCapability, jmapMailCapability},
+		"methodCalls": methodCalls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.do(http.MethodPost, c.session.APIURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.MethodResponses) != len(calls) {
+		return nil, fmt.Errorf("jmap: expected %d method responses, got %d", len(calls), len(result.MethodResponses))
+	}
+	responses := make([]jmapResponse, 0, len(calls))
+	for _, r := range result.MethodResponses {
+		if len(r) != 3 {
+			return nil, fmt.Errorf("jmap: invalid method response")
+		}
+		var name string
+		err = json.Unmarshal(r[0], &name)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, jmapResponse{name: name, args: r[1]})
+	}
+	return responses, nil
+}
+
+// download returns the content of a blob
+func (c *jmapClient) download(blobID, contentType, name string) ([]byte, error) {
+	u := strings.NewReplacer(
+		"{accountId}", url.PathEscape(c.account),
+		"{blobId}", url.PathEscape(blobID),
+		"{type}", url.QueryEscape(contentType),
+		"{name}", url.PathEscape(name),
+	).Replace(c.session.DownloadURL)
+	return c.do(http.MethodGet, u, nil)
+}
+
+// mailboxes returns the mailboxes of the account by their full name, the inbox is named INBOX
+// names of child mailboxes contain the names of their parents separated by /
+func (c *jmapClient) mailboxes() (map[string]string, error) {
+	responses, err := c.call(jmapCall{"Mailbox/get", map[string]interface{}{
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		List []jmapMailbox `json:"list"`
+	}
+	err = responses[0].decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]jmapMailbox, len(result.List))
+	for _, mbox := range result.List {
+		byID[mbox.ID] = mbox
+	}
+	names := make(map[string]string, len(result.List))
+	for _, mbox := range result.List {
+		name := mbox.Name
+		if mbox.Role == "inbox" {
+			name = "INBOX"
+		}
+		// the depth is limited in case of a broken hierarchy
+		for parent, depth := byID[mbox.ParentID], 0; parent.ID != "" && depth < len(byID); parent, depth = byID[parent.ParentID], depth+1 {
+			name = parent.Name + "/" + name
+		}
+		names[name] = mbox.ID
+	}
+	return names, nil
+}
+
+// emails returns the mails with the given ids, mails deleted in the meantime are missing
+func (c *jmapClient) emails(ids []string) (map[string]jmapEmail, error) {
+	emails := make(map[string]jmapEmail, len(ids))
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > jmapGetChunk {
+			chunk = chunk[:jmapGetChunk]
+		}
+		ids = ids[len(chunk):]
+
+		responses, err := c.call(jmapCall{"Email/get", map[string]interface{}{
+			"ids":                 chunk,
+			"properties":          jmapEmailProperties,
+			"fetchTextBodyValues": true,
+			"fetchHTMLBodyValues": true,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			List []jmapEmail `json:"list"`
+		}
+		err = responses[0].decode(&result)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range result.List {
+			emails[e.ID] = e
+		}
+	}
+	return emails, nil
+}
+
+// query returns the ids of the mails of a mailbox matching the filters of a profile, the newest mails first
+// the returned state is the Email state before the query, so no later change is missed
+func (c *jmapClient) query(filter interface{}, limit int) ([]string, string, error) {
+	var (
+		ids   []string
+		state string
+	)
+	for {
+		calls := []jmapCall{{"Email/query", map[string]interface{}{
+			"filter":         filter,
+			"sort":           []map[string]interface{}{{"property": "receivedAt", "isAscending": false}},
+			"position":       len(ids),
+			"calculateTotal": true,
+		}}}
+		if limit > 0 {
+			calls[0].args["limit"] = limit - len(ids)
+		}
+		if state == "" {
+			calls = append([]jmapCall{{"Email/get", map[string]interface{}{"ids": []string{}}}}, calls...)
+		}
+		responses, err := c.call(calls...)
+		if err != nil {
+			return nil, "", err
+		}
+		if state == "" {
+			var result struct {
+				State string `json:"state"`
+			}
+			err = responses[0].decode(&result)
+			if err != nil {
+				return nil, "", err
+			}
+			state = result.State
+			responses = responses[1:]
+		}
+		var result struct {
+			IDs   []string `json:"ids"`
+			Total int      `json:"total"`
+		}
+		err = responses[0].decode(&result)
+		if err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, result.IDs...)
+		if len(result.IDs) == 0 || len(ids) >= result.Total || (limit > 0 && len(ids) >= limit) {
+			return ids, state, nil
+		}
+	}
+}
+
+// changes returns the ids of all mails created or updated since a state and the current state
+func (c *jmapClient) changes(since string) ([]string, string, error) {
+	var ids []string
+	for {
+		responses, err := c.call(jmapCall{"Email/changes", map[string]interface{}{
+			"sinceState": since,
+		}})
+		if err != nil {
+			return nil, "", err
+		}
+		var result struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+		}
+		err = responses[0].decode(&result)
+		if err != nil {
+			return nil, "", err
+		}
+		ids = append(append(ids, result.Created...), result.Updated...)
+		since = result.NewState
+		if !result.HasMoreChanges {
+			return ids, since, nil
+		}
+	}
+}
+
+// connectJMAP fetches the session resource of a profile
+// profiles using xoauth2 or oauthbearer authenticate using the bearer token, the others using basic authentication
+func (m Mail2Most) connectJMAP(ctx context.Context, profile int) (*jmapClient, error) {
+	mail := m.Config.Profiles[profile].Mail
+	u, err := url.Parse(mail.JmapURL)
+	if err != nil {
+		return nil, err
+	}
+	server := u.Host
+	if u.Port() == "" {
+		server = net.JoinHostPort(u.Hostname(), "443")
+	}
+	tlsconf, err := m.tlsConfig(profile, server)
+	if err != nil {
+		return nil, err
+	}
+	c := &jmapClient{
+		ctx:  ctx,
+		http: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsconf}},
+	}
+
+	oauth := mail.Auth == AUTHXOAUTH2 || mail.Auth == AUTHOAUTHBEARER
+	if oauth {
+		token, err := m.oauth2AccessToken(ctx, profile)
+		if err != nil {
+			return nil, err
+		}
+		c.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	} else {
+		c.auth = func(req *http.Request) { req.SetBasicAuth(mail.Username, mail.Password) }
+	}
+
+	b, err := c.do(http.MethodGet, mail.JmapURL, nil)
+	if err != nil {
+		if oauth {
+			// the token may have been revoked, the next check requests a new one
+			m.invalidateToken(profile)
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, &c.session)
+	if err != nil {
+		return nil, err
+	}
+	c.account = c.session.PrimaryAccounts[jmapMailCapability]
+	if c.account == "" {
+		return nil, fmt.Errorf("jmap: no mail account found")
+	}
+	return c, nil
+}
+
+// jmapFolders returns the mailboxes checked by a profile by their name
+func (m Mail2Most) jmapFolders(profile int, mailboxes map[string]string) ([]string, error) {
+	names := make([]string, 0, len(mailboxes))
+	for name := range mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var folders []string
+	seen := make(map[string]bool)
+	for _, pattern := range m.folders(profile) {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			ok, err := matchFolder(pattern, name, "/")
+			if err != nil {
+				return nil, err
+			}
+			for _, exclude := range m.Config.Profiles[profile].Filter.ExcludeFolders {
+				if !ok {
+					break
+				}
+				excluded, err := matchFolder(exclude, name, "/")
+				if err != nil {
+					return nil, err
+				}
+				ok = !excluded
+			}
+			if ok {
+				seen[name] = true
+				folders = append(folders, name)
+			}
+		}
+	}
+	return folders, nil
+}
+
+// jmapFilter translates the filters of a profile into the filter of Email/query
+// servers match substrings so the results are checked by checkFilters afterwards
+func (m Mail2Most) jmapFilter(profile int, mailbox string) (interface{}, error) {
+	f := m.Config.Profiles[profile].Filter
+	conditions := []interface{}{map[string]interface{}{"inMailbox": mailbox}}
+	for _, c := range []struct {
+		property string
+		values   []string
+	}{{"from", f.From}, {"to", f.To}, {"subject", f.Subject}} {
+		var or []interface{}
+		for _, v := range c.values {
+			or = append(or, map[string]interface{}{c.property: v})
+		}
+		switch len(or) {
+		case 0:
+		case 1:
+			conditions = append(conditions, or[0])
+		default:
+			conditions = append(conditions, map[string]interface{}{"operator": "OR", "conditions": or})
+		}
+	}
+	if f.TimeRange != "" {
+		d, err := time.ParseDuration(f.TimeRange)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, map[string]interface{}{"after": time.Now().Add(-d).UTC().Format(time.RFC3339)})
+	}
+	if f.Unseen {
+		conditions = append(conditions, map[string]interface{}{"notKeyword": "$seen"})
+	}
+	return map[string]interface{}{"operator": "AND", "conditions": conditions}, nil
+}
+
+// getJMAPMail returns the mails of a profile not examined yet
+// folders checked before only examine the mails changed since the state of the last check (Email/changes),
+// new folders and folders whose state is too old are queried using the filters of the profile (Email/query)
+func (m Mail2Most) getJMAPMail(ctx context.Context, profile int, state StateStore) ([]Mail, []folderSync, error) {
+	c, err := m.connectJMAP(ctx, profile)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	folders, err := m.jmapFolders(profile, mailboxes)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+
+	var (
+		syncs      []folderSync
+		candidates = make([][]string, len(folders))
+		// folders sharing the same state only fetch the changes once
+		changes = make(map[string][]string)
+		states  = make(map[string]string)
+		ids     []string
+	)
+	for i, folder := range folders {
+		s := folderSync{key: StateKey{Profile: m.Config.Profiles[profile].Name, Folder: folder}}
+		if state != nil {
+			s.sync, err = state.Sync(s.key)
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+		}
+		if s.sync.State != "" {
+			if _, ok := changes[s.sync.State]; !ok {
+				changed, newState, err := c.changes(s.sync.State)
+				if e, ok := err.(jmapError); ok && e.Type == "cannotCalculateChanges" {
+					m.Info("jmap state expired", map[string]interface{}{
+						"profile": s.key.Profile,
+						"status":  "querying all mails",
+					})
+					changed, newState = nil, ""
+				} else if err != nil {
+					return []Mail{}, nil, err
+				}
+				changes[s.sync.State], states[s.sync.State] = changed, newState
+			}
+			candidates[i] = changes[s.sync.State]
+			s.sync.State = states[s.sync.State]
+		}
+		if s.sync.State == "" {
+			filter, err := m.jmapFilter(profile, mailboxes[folder])
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+			candidates[i], s.sync.State, err = c.query(filter, int(m.Config.Profiles[profile].Mail.Limit))
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+		}
+		ids = append(ids, candidates[i]...)
+		syncs = append(syncs, s)
+	}
+
+	emails, err := c.emails(uniqueStrings(ids))
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+
+	var mails []Mail
+	for i, folder := range folders {
+		var found []jmapEmail
+		for _, id := range uniqueStrings(candidates[i]) {
+			e, ok := emails[id]
+			if !ok || !e.MailboxIDs[mailboxes[folder]] {
+				continue
+			}
+			if state != nil {
+				sent, err := state.SentID(syncs[i].key, e.ID)
+				if err != nil {
+					return []Mail{}, nil, err
+				}
+				if sent {
+					continue
+				}
+			}
+			if m.Config.Profiles[profile].Filter.Unseen && e.Keywords["$seen"] {
+				continue
+			}
+			found = append(found, e)
+		}
+		// the oldest mails are posted first, the newest are kept if there are too many
+		sort.SliceStable(found, func(a, b int) bool { return found[a].ReceivedAt.Before(found[b].ReceivedAt) })
+		if limit := int(m.Config.Profiles[profile].Mail.Limit); limit > 0 && len(found) > limit {
+			found = found[len(found)-limit:]
+		}
+		m.Info("processing mails", map[string]interface{}{
+			"folder": folder,
+			"new":    len(found),
+		})
+
+		for _, e := range found {
+			mail, err := m.jmapMail(c, profile, folder, e)
+			if err != nil {
+				return []Mail{}, nil, err
+			}
+			ok := m.postable(mail)
+			if ok {
+				ok, err = m.checkFilters(profile, mail)
+				if err != nil {
+					return []Mail{}, nil, err
+				}
+			}
+			if !ok {
+				m.Debug("message not passing the filter", map[string]interface{}{"subject": mail.Subject, "id": e.ID})
+				syncs[i].examined = append(syncs[i].examined, e.ID)
+				continue
+			}
+			m.Info("found mail", map[string]interface{}{
+				"subject": mail.Subject, "id": e.ID,
+			})
+			mails = append(mails, mail)
+		}
+	}
+	return mails, syncs, nil
+}
+
+// jmapMail converts a JMAP mail, html bodies are preferred like for IMAP mails
+// attachments are only downloaded if they are posted
+func (m Mail2Most) jmapMail(c *jmapClient, profile int, folder string, e jmapEmail) (Mail, error) {
+	mail := Mail{
+		Folder:     folder,
+		Subject:    e.Subject,
+		Date:       e.ReceivedAt,
+		SourceID:   e.ID,
+		InReplyTo:  e.InReplyTo,
+		References: e.References,
+	}
+	if len(e.MessageID) > 0 {
+		mail.MessageID = e.MessageID[0]
+	}
+	for _, a := range e.From {
+		mail.From = append(mail.From, imapAddress(a.Name, a.Email))
+	}
+	for _, a := range e.To {
+		mail.To = append(mail.To, imapAddress(a.Name, a.Email))
+	}
+	for _, a := range e.Cc {
+		mail.Cc = append(mail.Cc, imapAddress(a.Name, a.Email))
+	}
+	if len(e.Headers) > 0 {
+		// header values are raw, like in the mail
+		var dec mime.WordDecoder
+		mail.Header = make(map[string][]string, len(e.Headers))
+		for _, h := range e.Headers {
+			v, err := dec.DecodeHeader(strings.TrimSpace(h.Value))
+			if err != nil {
+				v = strings.TrimSpace(h.Value)
+			}
+			key := textproto.CanonicalMIMEHeaderKey(h.Name)
+			mail.Header[key] = append(mail.Header[key], v)
+		}
+	}
+
+	var html, text string
+	for _, part := range e.HTMLBody {
+		if strings.HasPrefix(part.Type, "text/html") {
+			b, err := m.parseHtml([]byte(e.BodyValues[part.PartID].Value))
+			if err != nil {
+				m.Debug("parseHtml returned an error", map[string]interface{}{"error": err})
+				continue
+			}
+			html += string(b)
+		}
+	}
+	for _, part := range e.TextBody {
+		if html == "" && strings.HasPrefix(part.Type, "text/plain") {
+			b, _ := m.parseText([]byte(e.BodyValues[part.PartID].Value))
+			text += string(b)
+		}
+	}
+	mail.Body = html
+	if mail.Body == "" {
+		mail.Body = text
+	}
+	mail.Body = strings.TrimSuffix(mail.Body, "\n")
+
+	if !m.Config.Profiles[profile].Mattermost.MailAttachments {
+		return mail, nil
+	}
+	for _, part := range e.Attachments {
+		b, err := c.download(part.BlobID, part.Type, part.Name)
+		if err != nil {
+			return Mail{}, err
+		}
+		header := fmt.Sprintf("%s; name=%q", part.Type, part.Name)
+		if part.Name == "" {
+			header = part.Type
+		}
+		attachment, err := m.parseAttachment(b, header)
+		if err == nil {
+			mail.Attachments = append(mail.Attachments, attachment)
+		}
+	}
+	return mail, nil
+}
+
+// runJMAPActions applies an action to mails using Email/set, Move takes precedence over Delete
+func (m Mail2Most) runJMAPActions(ctx context.Context, profile int, mails []Mail, action mailAction) error {
+	c, err := m.connectJMAP(ctx, profile)
+	if err != nil {
+		return err
+	}
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return err
+	}
+	mailbox := func(name string) (string, error) {
+		id, ok := mailboxes[name]
+		if !ok {
+			return "", fmt.Errorf("jmap: mailbox not found: %s", name)
+		}
+		return id, nil
+	}
+
+	args := map[string]interface{}{}
+	if action.Delete && action.Move == "" {
+		var ids []string
+		for _, mail := range mails {
+			ids = append(ids, mail.SourceID)
+		}
+		args["destroy"] = ids
+	} else {
+		patch := map[string]interface{}{}
+		if action.Seen {
+			patch["keywords/$seen"] = true
+		}
+		if action.Flagged {
+			patch["keywords/$flagged"] = true
+		}
+		if action.Keyword != "" {
+			patch["keywords/"+action.Keyword] = true
+		}
+		for _, name := range []string{action.Copy, action.Move} {
+			if name == "" {
+				continue
+			}
+			id, err := mailbox(name)
+			if err != nil {
+				return err
+			}
+			patch["mailboxIds/"+id] = true
+		}
+		update := map[string]interface{}{}
+		for _, mail := range mails {
+			p := patch
+			if action.Move != "" {
+				from, err := mailbox(mail.Folder)
+				if err != nil {
+					return err
+				}
+				p = make(map[string]interface{}, len(patch)+1)
+				for k, v := range patch {
+					p[k] = v
+				}
+				p["mailboxIds/"+from] = nil
+			}
+			update[mail.SourceID] = p
+		}
+		args["update"] = update
+	}
+
+	responses, err := c.call(jmapCall{"Email/set", args})
+	if err != nil {
+		return err
+	}
+	var result struct {
+		NotUpdated   map[string]jmapError `json:"notUpdated"`
+		NotDestroyed map[string]jmapError `json:"notDestroyed"`
+	}
+	err = responses[0].decode(&result)
+	if err != nil {
+		return err
+	}
+	for id, e := range result.NotUpdated {
+		return fmt.Errorf("jmap: mail %s not updated: %s", id, e.Error())
+	}
+	for id, e := range result.NotDestroyed {
+		return fmt.Errorf("jmap: mail %s not destroyed: %s", id, e.Error())
+	}
+	return nil
+}
+
+// uniqueStrings removes duplicates keeping the order
+func uniqueStrings(s []string) []string {
+	seen := make(map[string]bool, len(s))
+	unique := make([]string, 0, len(s))
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
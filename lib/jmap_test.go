@@ -0,0 +1,363 @@
+package mail2most
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+// testJMAPServer serves the account "a1" to the user "username" with the password "password"
+// the Email state is increased by every change, changes before expired are not available anymore
+type testJMAPServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	state     int
+	expired   int
+	mailboxes []map[string]interface{}
+	emails    map[string]*testJMAPEmail
+	blobs     map[string][]byte
+	queries   int
+	downloads int
+}
+
+type testJMAPEmail struct {
+	data             map[string]interface{}
+	created, updated int
+}
+
+func newTestJMAPServer(t *testing.T) *testJMAPServer {
+	s := &testJMAPServer{
+		mailboxes: []map[string]interface{}{
+			{"id": "m1", "name": "Inbox", "role": "inbox"},
+			{"id": "m2", "name": "Archive", "role": "archive"},
+			{"id": "m3", "name": "Alerts", "parentId": "m2"},
+		},
+		emails: make(map[string]*testJMAPEmail),
+		blobs:  make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// add creates a mail in a mailbox
+func (s *testJMAPServer) add(mailbox, from, subject string, attachment []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state++
+	id := fmt.Sprintf("e%d", len(s.emails)+1)
+	data := map[string]interface{}{
+		"id":         id,
+		"mailboxIds": map[string]interface{}{mailbox: true},
+		"keywords":   map[string]interface{}{},
+		"receivedAt": time.Date(2020, 1, 1, 0, 0, s.state, 0, time.UTC).Format(time.RFC3339),
+		"subject":    subject,
+		"from":       []map[string]string{{"name": "Alice", "email": from}},
+		"to":         []map[string]string{{"email": "bob@example.com"}},
+		"textBody":   []map[string]string{{"partId": "1", "type": "text/plain"}},
+		"htmlBody":   []map[string]string{{"partId": "1", "type": "text/plain"}},
+		"bodyValues": map[string]interface{}{"1": map[string]string{"value": "body of " + subject + "\n"}},
+	}
+	if attachment != nil {
+		s.blobs["b"+id] = attachment
+		data["attachments"] = []map[string]string{{"blobId": "b" + id, "type": "application/octet-stream", "name": "report.txt"}}
+	}
+	s.emails[id] = &testJMAPEmail{data: data, created: s.state}
+	return id
+}
+
+func (s *testJMAPServer) handle(w http.ResponseWriter, r *http.Request) {
+	user, password, _ := r.BasicAuth()
+	if (user != "username" || password != "password") && r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/jmap/session":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"apiUrl":          s.URL + "/jmap/api",
+			"downloadUrl":     s.URL + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+			"primaryAccounts": map[string]string{jmapMailCapability: "a1"},
+		})
+	case strings.HasPrefix(r.URL.Path, "/jmap/download/a1/"):
+		s.downloads++
+		blob, ok := s.blobs[strings.Split(strings.TrimPrefix(r.URL.Path, "/jmap/download/a1/"), "/")[0]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	case r.URL.Path == "/jmap/api":
+		var req struct {
+			MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var responses [][]interface{}
+		for _, call := range req.MethodCalls {
+			var (
+				name, id string
+				args     map[string]interface{}
+			)
+			json.Unmarshal(call[0], &name)
+			json.Unmarshal(call[1], &args)
+			json.Unmarshal(call[2], &id)
+			result := s.method(name, args)
+			if _, ok := result["type"]; ok {
+				name = "error"
+			}
+			responses = append(responses, []interface{}{name, result, id})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"methodResponses": responses})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *testJMAPServer) method(name string, args map[string]interface{}) map[string]interface{} {
+	state := strconv.Itoa(s.state)
+	switch name {
+	case "Mailbox/get":
+		return map[string]interface{}{"list": s.mailboxes}
+	case "Email/get":
+		var list []interface{}
+		for _, id := range args["ids"].([]interface{}) {
+			if e, ok := s.emails[id.(string)]; ok {
+				list = append(list, e.data)
+			}
+		}
+		return map[string]interface{}{"state": state, "list": list}
+	case "Email/query":
+		s.queries++
+		var ids []string
+		for id, e := range s.emails {
+			if s.matches(e, args["filter"].(map[string]interface{})) {
+				ids = append(ids, id)
+			}
+		}
+		total := len(ids)
+		sort.Slice(ids, func(i, j int) bool { return s.emails[ids[i]].created > s.emails[ids[j]].created })
+		if pos := int(args["position"].(float64)); pos < len(ids) {
+			ids = ids[pos:]
+		} else {
+			ids = nil
+		}
+		if limit, ok := args["limit"].(float64); ok && int(limit) < len(ids) {
+			ids = ids[:int(limit)]
+		}
+		return map[string]interface{}{"ids": ids, "total": total}
+	case "Email/changes":
+		since, err := strconv.Atoi(args["sinceState"].(string))
+		if err != nil || since < s.expired {
+			return map[string]interface{}{"type": "cannotCalculateChanges"}
+		}
+		created, updated := []string{}, []string{}
+		for id, e := range s.emails {
+			if e.created > since {
+				created = append(created, id)
+			} else if e.updated > since {
+				updated = append(updated, id)
+			}
+		}
+		return map[string]interface{}{"newState": state, "created": created, "updated": updated}
+	case "Email/set":
+		s.state++
+		notUpdated := map[string]interface{}{}
+		if update, ok := args["update"].(map[string]interface{}); ok {
+			for id, patch := range update {
+				e, ok := s.emails[id]
+				if !ok {
+					notUpdated[id] = map[string]string{"type": "notFound"}
+					continue
+				}
+				e.updated = s.state
+				for path, v := range patch.(map[string]interface{}) {
+					parts := strings.SplitN(path, "/", 2)
+					m := e.data[parts[0]].(map[string]interface{})
+					if v == nil {
+						delete(m, parts[1])
+					} else {
+						m[parts[1]] = v
+					}
+				}
+			}
+		}
+		if destroy, ok := args["destroy"].([]interface{}); ok {
+			for _, id := range destroy {
+				delete(s.emails, id.(string))
+			}
+		}
+		return map[string]interface{}{"notUpdated": notUpdated}
+	}
+	return map[string]interface{}{"type": "unknownMethod"}
+}
+
+// matches supports the filter conditions created by jmapFilter
+func (s *testJMAPServer) matches(e *testJMAPEmail, filter map[string]interface{}) bool {
+	if conditions, ok := filter["conditions"].([]interface{}); ok {
+		for _, c := range conditions {
+			ok := s.matches(e, c.(map[string]interface{}))
+			if filter["operator"] == "OR" && ok {
+				return true
+			}
+			if filter["operator"] == "AND" && !ok {
+				return false
+			}
+		}
+		return filter["operator"] == "AND"
+	}
+	for k, v := range filter {
+		switch k {
+		case "inMailbox":
+			if _, ok := e.data["mailboxIds"].(map[string]interface{})[v.(string)]; !ok {
+				return false
+			}
+		case "notKeyword":
+			if _, ok := e.data["keywords"].(map[string]interface{})[v.(string)]; ok {
+				return false
+			}
+		case "subject":
+			if !strings.Contains(e.data["subject"].(string), v.(string)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// testJMAPProfile points profile 0 to the test jmap server
+func testJMAPProfile(m2m *Mail2Most, s *testJMAPServer) {
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEJMAP, JmapURL: s.URL + "/jmap/session", Username: "username", Password: "password"}
+	m2m.Config.Profiles[0].Filter = filter{}
+	m2m.Config.Profiles[0].Mattermost.URL = "http://127.0.0.1:1"
+}
+
+func TestJMAP(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	s := newTestJMAPServer(t)
+	defer s.Close()
+	s.add("m1", "alice@example.com", "hello", []byte("report"))
+	s.add("m1", "carol@example.com", "other", nil)
+	s.add("m3", "alice@example.com", "hello alerts", nil)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testJMAPProfile(&m2m, s)
+	m2m.Config.Outbox.Path = filepath.Join(dir, "outbox")
+	m2m.Config.Profiles[0].Filter.Folders = []string{"INBOX", "Archive/*"}
+	m2m.Config.Profiles[0].Filter.Subject = []string{"hello"}
+	m2m.Config.Profiles[0].Mattermost.MailAttachments = true
+	assert.Nil(t, m2m.checkSource(0))
+	assert.Equal(t, s.URL+"/jmap/session", m2m.mailServer(0))
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "e1", mails[0].SourceID)
+		assert.Equal(t, "INBOX", mails[0].Folder)
+		assert.Equal(t, "body of hello", mails[0].Body)
+		assert.Equal(t, "Alice", mails[0].From[0].PersonalName)
+		assert.Equal(t, "alice", mails[0].From[0].MailboxName)
+		assert.Equal(t, "example.com", mails[0].From[0].HostName)
+		assert.Equal(t, "bob", mails[0].To[0].MailboxName)
+		if assert.Len(t, mails[0].Attachments, 1) {
+			assert.Equal(t, "report.txt", mails[0].Attachments[0].Filename)
+			assert.Equal(t, []byte("report"), mails[0].Attachments[0].Content)
+		}
+		assert.Equal(t, "e3", mails[1].SourceID)
+		assert.Equal(t, "Archive/Alerts", mails[1].Folder)
+	}
+	m2m.Config.Profiles[0].Mattermost.MailAttachments = false
+
+	state, err := m2m.openJSONStateStore(filepath.Join(dir, "data.json"))
+	assert.Nil(t, err)
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+	m2m.Config.Profiles[0].Mail.OnFailure = mailAction{Seen: true}
+	err = m2m.processProfile(context.Background(), nil, 0, state, o)
+	assert.Nil(t, err)
+	pending, err := o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, true, s.emails["e1"].data["keywords"].(map[string]interface{})["$seen"])
+
+	// only the changes are examined, the mails marked as seen are known already
+	queries := s.queries
+	s.add("m1", "alice@example.com", "hello again", nil)
+	mails, syncs, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Equal(t, queries, s.queries)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "e4", mails[0].SourceID)
+	}
+	assert.Len(t, syncs, 2)
+
+	// an expired state queries the mailboxes again
+	s.expired = s.state
+	mails, _, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, queries+2, s.queries)
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Move: "Archive", Keyword: "posted"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"m2": true}, s.emails["e4"].data["mailboxIds"])
+	assert.Equal(t, true, s.emails["e4"].data["keywords"].(map[string]interface{})["posted"])
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Delete: true})
+	assert.Nil(t, err)
+	assert.Nil(t, s.emails["e4"])
+
+	err = m2m.runActions(context.Background(), 0, []Mail{{SourceID: "e1", Folder: "INBOX"}}, mailAction{Move: "doesnotexist"})
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Mail.Password = "wrong"
+	_, err = m2m.GetMail(0)
+	assert.NotNil(t, err)
+}
+
+func TestJMAPUnseen(t *testing.T) {
+	s := newTestJMAPServer(t)
+	defer s.Close()
+	s.add("m1", "alice@example.com", "hello", nil)
+	seen := s.add("m1", "alice@example.com", "hello seen", nil)
+	s.emails[seen].data["keywords"] = map[string]interface{}{"$seen": true}
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testJMAPProfile(&m2m, s)
+	m2m.Config.Profiles[0].Filter.Unseen = true
+	m2m.Config.Profiles[0].Mail.Auth = AUTHOAUTHBEARER
+	m2m.Config.Profiles[0].Mail.OAuth2.AccessToken = "token"
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "hello", mails[0].Subject)
+	}
+
+	m2m.Config.Profiles[0].Mail.Limit = 1
+	m2m.Config.Profiles[0].Filter.Unseen = false
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "hello seen", mails[0].Subject)
+	}
+
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEJMAP}
+	assert.NotNil(t, m2m.checkSource(0))
+}
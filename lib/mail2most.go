@@ -1,117 +1,249 @@
 package mail2most
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"os"
+	"context"
 	"time"
 )
 
 // Run starts mail2most
 func (m Mail2Most) Run() error {
-	alreadySend := make([][]uint32, len(m.Config.Profiles))
-	alreadySendFile := make([][]uint32, len(m.Config.Profiles))
-	if _, err := os.Stat(m.Config.General.File); err == nil {
-		jsonFile, err := os.Open(m.Config.General.File)
-		if err != nil {
-			return err
-		}
+	return m.RunContext(context.Background())
+}
+
+// RunContext starts mail2most and stops after ctx is cancelled
+// running checks finish the mail they are posting and store their state,
+// requests still running after General.ShutdownTimeout are aborted
+func (m Mail2Most) RunContext(ctx context.Context) error {
+	timeout, err := m.shutdownTimeout()
+	if err != nil {
+		return err
+	}
+	// the outbox backoff is needed once mattermost fails, a typo must not stop the daemon then
+	_, err = m.backoff(1)
+	if err != nil {
+		return err
+	}
+	// the same goes for the backoff of failing profiles
+	_, _, _, err = m.healthDurations()
+	if err != nil {
+		return err
+	}
+
+	state, err := m.openStateStore()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	outbox, err := m.openOutbox()
+	if err != nil {
+		return err
+	}
+
+	if m.pool != nil {
+		defer m.pool.close()
+	}
+	if m.mattermost != nil {
+		defer m.mattermost.close()
+	}
+
+	// set a 10 seconds sleep default if no TimeInterval is defined
+	if m.Config.General.TimeInterval == 0 {
+		m.Info("no check time interval set", map[string]interface{}{
+			"fallback":     10,
+			"unit-of-time": "second",
+		})
+		m.Config.General.TimeInterval = 10
+	}
 
-		bv, err := ioutil.ReadAll(jsonFile)
+	for p := range m.Config.Profiles {
+		err = m.checkSource(p)
 		if err != nil {
 			return err
 		}
+		m.checkKeywords(p)
+	}
 
-		err = json.Unmarshal(bv, &alreadySendFile)
+	// profiles are checked concurrently, so their schedules are validated upfront
+	schedules := make([]profileSchedule, len(m.Config.Profiles))
+	for p := range m.Config.Profiles {
+		schedules[p], err = m.schedule(p)
 		if err != nil {
 			return err
 		}
 	}
 
-	// write cache to memory cache
-	// this is nessasary if new profiles are added
-	// and the caching file does not contain any caching
-	// for this profile
-	l := len(alreadySend)
-	for k, v := range alreadySendFile {
-		if k < l {
-			alreadySend[k] = v
+	// work is used for all requests, it outlives ctx by the shutdown timeout
+	work, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-work.Done():
+			return
 		}
-		if k >= l {
-			m.Error("data.json error", map[string]interface{}{
-				"error":    "data.json contains more profile information than defined in the config",
-				"cause":    "this happens if profiles are deleted from the config file and can create inconsistencies",
-				"solution": "delete the data.json file",
-				"note":     "by deleting the data.json file all mails are parsed and send again",
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			m.Error("shutdown timeout exceeded", map[string]interface{}{
+				"timeout": timeout.String(),
+				"status":  "aborting running requests",
 			})
+			cancel()
+		case <-work.Done():
 		}
+	}()
+
+	var idle *idleWatchers
+	if !m.Config.General.NoLoop {
+		// the mail server delivers mails to the receiver as long as the profiles are checked
+		if m.Config.Receiver.Listen != "" {
+			r, err := m.startReceiver(work, state)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+		}
+		idle = m.startIdle(ctx)
 	}
 
-	// set a 10 seconds sleep default if no TimeInterval is defined
-	if m.Config.General.TimeInterval == 0 {
-		m.Info("no check time interval set", map[string]interface{}{
-			"fallback":     10,
-			"unit-of-time": "second",
+	return m.newScheduler(work, state, outbox, idle, schedules).run(ctx)
+}
+
+func (m Mail2Most) shutdownTimeout() (time.Duration, error) {
+	if m.Config.General.ShutdownTimeout == "" {
+		return 10 * time.Second, nil
+	}
+	return time.ParseDuration(m.Config.General.ShutdownTimeout)
+}
+
+// stopped reports whether a shutdown was requested
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// processProfile fetches the mails of a profile and posts all mails not sent yet
+// profiles whose mail server could not be reached are backing off and skipped until they are due again,
+// the returned error is only set if the state or the outbox failed
+// ctx aborts all requests, once stop is closed no further mails are posted
+func (m Mail2Most) processProfile(ctx context.Context, stop <-chan struct{}, p int, state StateStore, outbox *outbox) error {
+	if !m.profileDue(p) {
+		m.Debug("profile backing off", map[string]interface{}{
+			"profile": m.Config.Profiles[p].Name,
 		})
-		m.Config.General.TimeInterval = 10
+		return nil
 	}
 
-	for {
-		for p := range m.Config.Profiles {
-			mails, err := m.GetMail(p)
-			if err != nil {
-				m.Error("Error reaching mailserver", map[string]interface{}{
-					"Error":  err,
-					"Server": m.Config.Profiles[p].Mail.ImapServer,
-				})
-				break
-			}
+	mails, syncs, err := m.getMail(ctx, p, state)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		ferr := m.profileFailed(p, err)
+		if ferr != nil {
+			return ferr
+		}
+		h := m.Health()[p]
+		m.Error("Error reaching mailserver", map[string]interface{}{
+			"Error":        err,
+			"Server":       m.mailServer(p),
+			"profile":      h.Profile,
+			"failures":     h.ConsecutiveFailures,
+			"last-success": h.LastSuccess,
+			"next-attempt": h.NextAttempt,
+			"circuit-open": h.CircuitOpen,
+		})
+		return nil
+	}
+	m.profileSucceeded(p)
 
-			for _, mail := range mails {
-				send := true
-				for _, id := range alreadySend[p] {
-					if mail.ID == id {
-						m.Debug("mail", map[string]interface{}{
-							"subject":    mail.Subject,
-							"status":     "already send",
-							"message-id": mail.ID,
-						})
-						send = false
-					}
-				}
-				if send {
-					err := m.PostMattermost(p, mail)
-					if err != nil {
-						m.Error("Mattermost Error", map[string]interface{}{
-							"Error": err,
-						})
-					} else {
-						alreadySend[p] = append(alreadySend[p], mail.ID)
-					}
-					err = writeToFile(alreadySend, m.Config.General.File)
-					if err != nil {
-						return err
-					}
-
-				}
-			}
+	for _, s := range syncs {
+		reset, err := state.Folder(s.key)
+		if err != nil {
+			return err
 		}
+		if reset {
+			m.Info("uidvalidity changed", map[string]interface{}{
+				"profile":     s.key.Profile,
+				"folder":      s.key.Folder,
+				"uidvalidity": s.key.UIDValidity,
+				"status":      "dropping known uids of this folder",
+			})
+		}
+	}
 
-		// The user wishes this to be a run-once cycle (for use in serverless platforms)
-                if m.Config.General.NoLoop {
-			m.Debug("done", map[string]interface{}{
-				"noloop": true,
+	var (
+		delivered, failed []Mail
+		interrupted       bool
+	)
+	for _, mail := range mails {
+		if stopped(stop) {
+			m.Info("shutting down", map[string]interface{}{
+				"profile": m.Config.Profiles[p].Name,
+				"status":  "remaining mails are posted after the restart",
 			})
+			interrupted = true
 			break
 		}
-
-		//time.Sleep(time.Duration(m.Config.General.TimeInterval) * 10 * time.Second)
-		m.Debug("sleeping", map[string]interface{}{
-			"intervaltime": m.Config.General.TimeInterval,
-			"unit-of-time": "second",
-		})
-		time.Sleep(time.Duration(m.Config.General.TimeInterval) * time.Second)
+		key := StateKey{Profile: m.Config.Profiles[p].Name, Folder: mail.Folder, UIDValidity: mail.UIDValidity}
+		sent, err := isSent(state, key, mail)
+		if err != nil {
+			return err
+		}
+		if sent {
+			m.Debug("mail", map[string]interface{}{
+				"subject":    mail.Subject,
+				"status":     "already send",
+				"message-id": mail.ID,
+			})
+			continue
+		}
+		var done Destinations
+		perr := m.postMattermost(ctx, p, mail, state, &done)
+		if perr != nil {
+			m.Error("Mattermost Error", map[string]interface{}{
+				"Error": perr,
+			})
+			// the outbox takes care of the mail from now on, it only posts to the failed channels and users
+			err = m.enqueue(outbox, p, key, mail, done, perr)
+			if err != nil {
+				return err
+			}
+			failed = append(failed, mail)
+		} else {
+			delivered = append(delivered, mail)
+		}
+		err = markSent(state, key, mail)
+		if err != nil {
+			return err
+		}
 	}
 
+	m.mailActions(ctx, p, delivered, m.Config.Profiles[p].Mail.OnSuccess)
+	m.mailActions(ctx, p, failed, m.Config.Profiles[p].Mail.OnFailure)
+
+	// the next check only examines mails arrived after this one
+	// if the check was interrupted, the remaining mails are fetched again
+	if interrupted {
+		return nil
+	}
+	for _, s := range syncs {
+		err = state.SetSync(s.key, s.sync)
+		if err != nil {
+			return err
+		}
+		for _, id := range s.examined {
+			err = state.MarkSentID(s.key, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
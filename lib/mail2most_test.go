@@ -1,9 +1,14 @@
 package mail2most
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	filet "github.com/Flaque/filet"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,3 +36,106 @@ func TestRun(t *testing.T) {
 	err = os.Remove("/tmp/data.json")
 	assert.Nil(t, err)
 }
+
+func TestRunContext(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	// mattermost never answers
+	requests := make(chan struct{}, 10)
+	release := make(chan struct{})
+	mm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer mm.Close()
+	defer close(release)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.ShutdownTimeout = "100ms"
+	m2m.Config.Outbox.Path = dir + "/outbox"
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles = m2m.Config.Profiles[:1]
+	m2m.Config.Profiles[0].Mattermost.URL = mm.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- m2m.RunContext(ctx)
+	}()
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mail was not posted")
+	}
+	cancel()
+
+	// the post is aborted after the shutdown timeout and kept in the outbox
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not stop")
+	}
+	entries, err := m2m.openOutbox()
+	if assert.Nil(t, err) {
+		pending, err := entries.list(false)
+		assert.Nil(t, err)
+		assert.Len(t, pending, 1)
+	}
+
+	m2m.Config.General.ShutdownTimeout = "foo"
+	assert.NotNil(t, m2m.RunContext(context.Background()))
+	m2m.Config.General.ShutdownTimeout = ""
+
+	for _, backoff := range []*string{&m2m.Config.Outbox.Backoff, &m2m.Config.Outbox.MaxBackoff,
+		&m2m.Config.Health.Backoff, &m2m.Config.Health.MaxBackoff, &m2m.Config.Health.Cooldown} {
+		*backoff = "foo"
+		assert.NotNil(t, m2m.RunContext(context.Background()))
+		*backoff = ""
+	}
+}
+
+func TestProcessProfileStopped(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.Outbox.Path = dir + "/outbox"
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[0].Mattermost.URL = "http://127.0.0.1:1"
+	defer m2m.pool.close()
+
+	state, err := m2m.openStateStore()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer state.Close()
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+
+	// after a shutdown was requested no mail is posted and the folder is not marked as synced
+	shutdown := make(chan struct{})
+	close(shutdown)
+	err = m2m.processProfile(context.Background(), shutdown, 0, state, o)
+	assert.Nil(t, err)
+	pending, err := o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, pending, 0)
+
+	mails, _, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+}
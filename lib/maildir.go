@@ -0,0 +1,119 @@
+package mail2most
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maildirInfo separates the unique name of a mail file from its flags
+const maildirInfo = ":2,"
+
+// maildirMessage is a mail file in the new or cur directory of a Maildir
+type maildirMessage struct {
+	path string
+	// name is the unique name of the mail, it does not change when the mail is moved into cur
+	name    string
+	flags   string
+	modTime time.Time
+}
+
+// listMaildir returns the mails of a Maildir in the order of their arrival
+func listMaildir(dir string) ([]maildirMessage, error) {
+	var msgs []maildirMessage
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			msg := maildirMessage{path: filepath.Join(dir, sub, f.Name()), name: f.Name(), modTime: f.ModTime()}
+			if i := strings.Index(f.Name(), maildirInfo); i >= 0 {
+				msg.name, msg.flags = f.Name()[:i], f.Name()[i+len(maildirInfo):]
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if !msgs[i].modTime.Equal(msgs[j].modTime) {
+			return msgs[i].modTime.Before(msgs[j].modTime)
+		}
+		return msgs[i].name < msgs[j].name
+	})
+	return msgs, nil
+}
+
+// maildirFlags adds the flags of an action to the flags of a mail, maildir flags are sorted
+func maildirFlags(flags string, action mailAction) string {
+	if action.Seen && !strings.ContainsRune(flags, 'S') {
+		flags += "S"
+	}
+	if action.Flagged && !strings.ContainsRune(flags, 'F') {
+		flags += "F"
+	}
+	b := []byte(flags)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return string(b)
+}
+
+// getMaildirMail returns the mails of a Maildir not examined yet, mails are identified by their unique name
+func (m Mail2Most) getMaildirMail(profile int, state StateStore) ([]Mail, []folderSync, error) {
+	files, err := listMaildir(m.Config.Profiles[profile].Mail.Path)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	var msgs []sourceMessage
+	for _, f := range files {
+		if m.Config.Profiles[profile].Filter.Unseen && strings.ContainsRune(f.flags, 'S') {
+			continue
+		}
+		path := f.path
+		msgs = append(msgs, sourceMessage{id: f.name, read: func() (io.Reader, error) {
+			raw, err := ioutil.ReadFile(path)
+			return bytes.NewReader(raw), err
+		}})
+	}
+	mails, sync, err := m.fetchSourceMails(profile, state, msgs)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	return mails, []folderSync{sync}, nil
+}
+
+// runMaildirActions moves the mails into cur adding the flags of the action, or deletes them
+// mails moved or deleted by another program in the meantime are skipped
+func (m Mail2Most) runMaildirActions(profile int, mails []Mail, action mailAction) error {
+	dir := m.Config.Profiles[profile].Mail.Path
+	files, err := listMaildir(dir)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]maildirMessage, len(files))
+	for _, f := range files {
+		byName[f.name] = f
+	}
+	for _, mail := range mails {
+		f, ok := byName[mail.SourceID]
+		if !ok {
+			m.Debug("mail not found in maildir", map[string]interface{}{"subject": mail.Subject, "id": mail.SourceID})
+			continue
+		}
+		if action.Delete {
+			err = os.Remove(f.path)
+		} else {
+			err = os.Rename(f.path, filepath.Join(dir, "cur", f.name+maildirInfo+maildirFlags(f.flags, action)))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
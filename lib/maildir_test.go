@@ -0,0 +1,114 @@
+package mail2most
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMaildir creates a Maildir for profile 0
+func testMaildir(t *testing.T, m2m *Mail2Most) string {
+	dir := filet.TmpDir(t, "")
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		assert.Nil(t, os.Mkdir(filepath.Join(dir, sub), 0700))
+	}
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEMAILDIR, Path: dir}
+	m2m.Config.Profiles[0].Filter = filter{}
+	m2m.Config.Profiles[0].Mattermost.URL = "http://127.0.0.1:1"
+	return dir
+}
+
+func testMaildirMail(t *testing.T, dir, file string, arrival time.Time, from, subject string) {
+	path := filepath.Join(dir, file)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testPOP3Mail(from, subject)), 0600))
+	assert.Nil(t, os.Chtimes(path, arrival, arrival))
+}
+
+func TestMaildirFlags(t *testing.T) {
+	assert.Equal(t, "", maildirFlags("", mailAction{}))
+	assert.Equal(t, "S", maildirFlags("", mailAction{Seen: true}))
+	assert.Equal(t, "FRS", maildirFlags("R", mailAction{Seen: true, Flagged: true}))
+	assert.Equal(t, "S", maildirFlags("S", mailAction{Seen: true}))
+}
+
+func TestMaildir(t *testing.T) {
+	defer filet.CleanUp(t)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	dir := testMaildir(t, &m2m)
+	m2m.Config.Outbox.Path = filet.TmpDir(t, "")
+	m2m.Config.Profiles[0].Filter.Subject = []string{"hello"}
+	m2m.Config.Profiles[0].Mail.OnFailure = mailAction{Seen: true}
+	assert.Nil(t, m2m.checkSource(0))
+
+	now := time.Now()
+	testMaildirMail(t, dir, "cur/1.M1.host:2,S", now.Add(-3*time.Minute), "alice@example.com", "hello seen")
+	testMaildirMail(t, dir, "new/2.M2.host", now.Add(-2*time.Minute), "Alice <alice@example.com>", "hello")
+	testMaildirMail(t, dir, "new/3.M3.host", now.Add(-time.Minute), "carol@example.com", "other")
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.Equal(t, "1.M1.host", mails[0].SourceID)
+		assert.Equal(t, "2.M2.host", mails[1].SourceID)
+		assert.Equal(t, "Alice", mails[1].From[0].PersonalName)
+	}
+
+	m2m.Config.Profiles[0].Filter.Unseen = true
+	mails, err = m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "2.M2.host", mails[0].SourceID)
+	}
+
+	state, err := m2m.openJSONStateStore(filepath.Join(filet.TmpDir(t, ""), "data.json"))
+	assert.Nil(t, err)
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+
+	// posting fails, the mail is moved into cur and marked as seen
+	err = m2m.processProfile(context.Background(), nil, 0, state, o)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "cur/2.M2.host:2,S"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "new/3.M3.host"))
+	assert.Nil(t, err)
+
+	// the moved mail and the filtered mail are known
+	m2m.Config.Profiles[0].Filter.Unseen = false
+	mails, _, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "1.M1.host", mails[0].SourceID)
+	}
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Flagged: true})
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "cur/1.M1.host:2,FS"))
+	assert.Nil(t, err)
+
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Delete: true})
+	assert.Nil(t, err)
+	files, err := listMaildir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	// mails removed in the meantime are skipped
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Seen: true})
+	assert.Nil(t, err)
+
+	m2m.Config.Profiles[0].Mail.OnSuccess = mailAction{Move: "Archive"}
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEMAILDIR}
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.Path = filepath.Join(dir, "doesnotexist")
+	_, err = m2m.GetMail(0)
+	assert.NotNil(t, err)
+}
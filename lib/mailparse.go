@@ -10,11 +10,9 @@ package mail2most
 //
 
 import (
-	"os"
-	"fmt"
-	"bufio"
 	"errors"
 	"regexp"
+	"sync"
 	"crypto/sha256"
 
 	// image extensions
@@ -30,6 +28,9 @@ import (
 //
 var seenAttachments map[[32]byte]string
 
+// seenAttachmentsMu guards seenAttachments, profiles are processed concurrently
+var seenAttachmentsMu sync.Mutex
+
 // parseHtml attempts to strip everything out of the message body except for the latest reply. This is
 // not perfect, but it's better than nothing. Different mail clients encode their message and replies
 // in their own unique ways, and it's impossible to account for all of the potential variations.
@@ -38,25 +39,6 @@ var seenAttachments map[[32]byte]string
 //
 func (m Mail2Most) parseHtml( b []byte ) ([]byte, error) {
 
-	// DEBUG CODE. Capture input message for analysis.
-	sum := sha256.Sum256(b)
-	var f *os.File
-	var e error
-	if _, err := os.Stat(fmt.Sprintf("outputs/%x.in",sum)); os.IsNotExist(err) {
-		if f, e = os.Create(fmt.Sprintf("outputs/%x.in",sum)); e == nil {
-			writer := bufio.NewWriter(f)
-			_, e = writer.Write(b)
-			if e != nil {
-				fmt.Println( " >>> debug thing went boom ", e);
-			}
-			writer.Flush()
-			f.Close()
-		} else {
-			fmt.Println( " >>> debug thing went boom ", e);
-		}
-	}
-	// END DEBUG CODE
-
 	// Is this an error message?  Nuke it.
 	NI := regexp.MustCompile(`An error occurred while trying to deliver the mail to the following recipients:`)
 	if NI.Match(b) {
@@ -179,22 +161,6 @@ func (m Mail2Most) parseHtml( b []byte ) ([]byte, error) {
 	sf := regexp.MustCompile(`(Sent [Ff]rom|Sent via).*`)
 	b = sf.ReplaceAll(b,[]byte(""))
 
-	// DEBUG CODE. Capture resulting output for analysis.
-	if _, err := os.Stat(fmt.Sprintf("outputs/%x.out",sum)); os.IsNotExist(err) {
-		if f, e = os.Create(fmt.Sprintf("outputs/%x.out",sum)); e == nil {
-			writer := bufio.NewWriter(f)
-			_, e = writer.Write(b)
-			if e != nil {
-				fmt.Println( " >>> debug thing went boom ", e);
-			}
-			writer.Flush()
-			f.Close()
-		} else {
-			fmt.Println( " >>> debug thing went boom ", e);
-		}
-	}
-	// END DEBUG CODE.
-
 	return b, nil
 }
 
@@ -239,6 +205,8 @@ func (m Mail2Most) parseAttachment( body []byte, header string ) (Attachment, er
 	}
 
 	sum := sha256.Sum256(body)
+	seenAttachmentsMu.Lock()
+	defer seenAttachmentsMu.Unlock()
 	if _, ok := seenAttachments[sum]; ok {
 		return Attachment{}, errors.New("seenseenseen")
 	}
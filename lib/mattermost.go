@@ -2,6 +2,7 @@ package mail2most
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"encoding/base64"
 	"fmt"
@@ -12,30 +13,6 @@ import (
 	"github.com/mattermost/mattermost-server/model"
 )
 
-func (m Mail2Most) mlogin(profile int) (*model.Client4, error) {
-	c := model.NewAPIv4Client(m.Config.Profiles[profile].Mattermost.URL)
-
-	if m.Config.Profiles[profile].Mattermost.Username != "" && m.Config.Profiles[profile].Mattermost.Password != "" {
-		_, resp := c.Login(m.Config.Profiles[profile].Mattermost.Username, m.Config.Profiles[profile].Mattermost.Password)
-		if resp.Error != nil {
-			return nil, resp.Error
-		}
-	} else if m.Config.Profiles[profile].Mattermost.AccessToken != "" {
-		c.AuthToken = m.Config.Profiles[profile].Mattermost.AccessToken
-		c.AuthType = "BEARER"
-		r, err := c.DoApiGet("/users/me", "")
-		if err != nil {
-			return nil, err
-		}
-		u := model.UserFromJson(r.Body)
-		m.Config.Profiles[profile].Mattermost.Username = u.Email
-	} else {
-		return nil, fmt.Errorf("no username, password or token is set")
-	}
-
-	return c, nil
-}
-
 func (m Mail2Most) getFromLine( profile int, userName string, email string ) string {
 	// Abandon all hope if we got garbage in.
 	//
@@ -57,11 +34,27 @@ func (m Mail2Most) getFromLine( profile int, userName string, email string ) str
 
 // PostMattermost posts a msg to mattermost
 func (m Mail2Most) PostMattermost(profile int, mail Mail) error {
-	c, err := m.mlogin(profile)
+	return m.PostMattermostContext(context.Background(), profile, mail)
+}
+
+// PostMattermostContext posts a msg to mattermost, all requests are aborted if ctx is cancelled
+func (m Mail2Most) PostMattermostContext(ctx context.Context, profile int, mail Mail) error {
+	return m.postMattermost(ctx, profile, mail, nil, nil)
+}
+
+// postMattermost posts a msg to mattermost, replies are posted into their threads stored in state if it is not nil
+// channels and users found in done are skipped, the ones the mail is posted to are added to done if it is not nil
+func (m Mail2Most) postMattermost(ctx context.Context, profile int, mail Mail, state StateStore, done *Destinations) error {
+	if done == nil {
+		done = &Destinations{}
+	}
+	// the subject is formatted below, threads are found by the original one
+	thread := mail
+	c, userID, release, err := m.acquireMattermost(ctx, profile)
 	if err != nil {
 		return err
 	}
-	defer c.Logout()
+	defer release()
 
 	// check if body is base64 encoded
 	var body string
@@ -87,16 +80,12 @@ func (m Mail2Most) PostMattermost(profile int, mail Mail) error {
 		mail.From[0].HostName = html2text.HTML2Text(mail.From[0].HostName)
 	}
 
-fmt.Println("BODY:")
-fmt.Println(body)
-fmt.Println("--")
 	if len(strings.TrimSpace(body)) < 1 {
 		m.Debug("resulted in null body", map[string]interface{}{})
 		return nil
 	}
 
-	msg := ":email: "
-
+	data := postData{Mail: mail, Body: body, Profile: m.Config.Profiles[profile].Name, Options: m.Config.Profiles[profile].Mattermost}
 	if !m.Config.Profiles[profile].Mattermost.HideFrom {
 		if len(mail.From[0].PersonalName) < 1 && len(mail.From[0].MailboxName) < 1 && len(mail.From[0].HostName) < 1 {
 			// Got to skip this message, it didn't come from anywhere!
@@ -106,45 +95,11 @@ fmt.Println("--")
 		user, resp := c.GetUserByEmail(email, "")
 		if resp.Error != nil {
 			m.Debug("user not found in system", map[string]interface{}{"error": resp.Error})
-			msg += m.getFromLine( profile, mail.From[0].PersonalName, email )
-		} else {
-			msg += m.getFromLine( profile, "@"+user.Username, email )
-		}
-	}
-	
-	if m.Config.Profiles[profile].Mattermost.SubjectOnly && !m.Config.Profiles[profile].Mattermost.HideSubject {
-		msg += fmt.Sprintf(
-			"\n>_%s_\n\n",
-			mail.Subject,
-		)
-	} else {
-		if m.Config.Profiles[profile].Mattermost.HideSubject {
-			mail.Subject = "\n\n\n\n\n"
-		} else {
-			mail.Subject = fmt.Sprintf("\n>_%s_\n\n", mail.Subject)
-		}
-		if m.Config.Profiles[profile].Mattermost.ConvertToMarkdown {
-			msg += fmt.Sprintf(
-				"%s\n%s\n",
-				mail.Subject,
-				body,
-			)
+			data.Sender = mail.From[0].PersonalName
 		} else {
-			msg += fmt.Sprintf(
-				"%s```\n%s```\n",
-				mail.Subject,
-				body,
-			)
+			data.Sender = "@" + user.Username
 		}
-	}
-
-	for _, b := range m.Config.Profiles[profile].Mattermost.Broadcast {
-		msg = b + " " + msg
-	}
-	// max message length is about 16383
-	// https://docs.mattermost.com/administration/important-upgrade-notes.html
-	if len(msg) > 16383 {
-		msg = msg[0:16382]
+		data.From = m.getFromLine(profile, data.Sender, email)
 	}
 
 	fallback := fmt.Sprintf(
@@ -153,19 +108,16 @@ fmt.Println("--")
 		mail.Subject,
 	)
 
-	if len(m.Config.Profiles[profile].Mattermost.Channels) == 0 {
-		m.Debug("no channels configured to send to", nil)
-	}
-
-	for _, channel := range m.Config.Profiles[profile].Mattermost.Channels {
-
-		channelName := strings.ReplaceAll(channel, "#", "")
-		channelName = strings.ReplaceAll(channelName, "@", "")
-
-		ch, resp := c.GetChannelByNameForTeamName(channelName, m.Config.Profiles[profile].Mattermost.Team, "")
-		if resp.Error != nil {
-			m.Error("something blew up", map[string]interface{}{"error": resp.Error})
-			return resp.Error
+	// post posts the mail into a channel, name is the channel or user it is rendered for
+	post := func(ch *model.Channel, name string) error {
+		parts, file, err := m.postMessage(profile, name, data)
+		if err != nil {
+			return err
+		}
+		root := m.threadRoot(state, profile, ch.Id, thread)
+		post, err := m.newPost(profile, ch.Id, root, parts[0], fallback, data)
+		if err != nil {
+			return err
 		}
 
 		var fileIDs []string
@@ -186,102 +138,106 @@ fmt.Println("--")
 				m.Error("It seems some files did not upload", map[string]interface{}{})
 			}
 		}
+		if file != nil {
+			id, err := m.uploadFile(c, ch.Id, *file)
+			if err != nil {
+				return err
+			}
+			fileIDs = append(fileIDs, id)
+		}
 
-		post := &model.Post{ChannelId: ch.Id, Message: msg}
 		if len(fileIDs) > 0 {
 			post.FileIds = fileIDs
 		}
-		m.Debug("mattermost post", map[string]interface{}{"channel": ch.Id, "zsubject": mail.Subject, "zbytes": len(msg)})
-		_, resp = c.CreatePost(post)
+		m.Debug("mattermost post", map[string]interface{}{"channel": ch.Id, "zsubject": mail.Subject, "zbytes": len(parts[0]), "root": root})
+		rest := parts[1:]
+		created, resp := m.createPost(c, post)
 		if resp.Error != nil {
 			m.Error("Mattermost Post Error", map[string]interface{}{"error": resp.Error, "status": "fallback send only subject"})
-			post := &model.Post{ChannelId: ch.Id, Message: fallback}
-			_, resp = c.CreatePost(post)
+			post := &model.Post{ChannelId: ch.Id, Message: fallback, RootId: root}
+			created, resp = m.createPost(c, post)
 			if resp.Error != nil {
 				m.Error("Mattermost Post Error", map[string]interface{}{"error": resp.Error, "status": "fallback not working"})
 				return resp.Error
 			}
+			rest = nil
 		}
+		m.rememberThread(state, profile, ch.Id, thread, threadRootID(created))
+		return m.postContinuations(c, created, rest)
 	}
 
-	if len(m.Config.Profiles[profile].Mattermost.Users) > 0 {
+	// a failing channel or user does not keep the mail from the others, the first error is returned
+	var failed error
+	fail := func(name string, err error) {
+		m.Error("Mattermost Error", map[string]interface{}{"error": err, "destination": name, "status": "mail not posted"})
+		if failed == nil {
+			failed = err
+		}
+	}
 
-		var (
-			me   *model.User
-			resp *model.Response
-		)
+	if len(m.Config.Profiles[profile].Mattermost.Channels) == 0 {
+		m.Debug("no channels configured to send to", nil)
+	}
 
-		// who am i
-		// user is defined by its email address
-		if strings.Contains(m.Config.Profiles[profile].Mattermost.Username, "@") {
-			me, resp = c.GetUserByEmail(m.Config.Profiles[profile].Mattermost.Username, "")
-			if resp.Error != nil {
-				return resp.Error
-			}
-		} else {
-			me, resp = c.GetUserByEmail(m.Config.Profiles[profile].Mattermost.Username, "")
-			if resp.Error != nil {
-				return resp.Error
-			}
+	for _, channel := range m.Config.Profiles[profile].Mattermost.Channels {
+		if contains(done.Channels, channel) {
+			continue
+		}
+
+		channelName := strings.ReplaceAll(channel, "#", "")
+		channelName = strings.ReplaceAll(channelName, "@", "")
+
+		ch, resp := c.GetChannelByNameForTeamName(channelName, m.Config.Profiles[profile].Mattermost.Team, "")
+		if resp.Error != nil {
+			fail(channel, resp.Error)
+			continue
+		}
+		err = post(ch, channel)
+		if err != nil {
+			fail(channel, err)
+			continue
 		}
-		myid := me.Id
+		done.Channels = append(done.Channels, channel)
+	}
+
+	if len(m.Config.Profiles[profile].Mattermost.Users) > 0 {
+
+		var resp *model.Response
+		myid := userID
 
 		for _, user := range m.Config.Profiles[profile].Mattermost.Users {
+			if contains(done.Users, user) {
+				continue
+			}
 			var (
 				u *model.User
 			)
 			// user is defined by its email address
 			if strings.Contains(user, "@") {
 				u, resp = c.GetUserByEmail(user, "")
-				if resp.Error != nil {
-					return resp.Error
-				}
 			} else {
 				u, resp = c.GetUserByUsername(user, "")
-				if resp.Error != nil {
-					return resp.Error
-				}
 			}
-
-			ch, resp := c.CreateDirectChannel(myid, u.Id)
 			if resp.Error != nil {
-				return resp.Error
-			}
-
-			var fileIDs []string
-			if m.Config.Profiles[profile].Mattermost.MailAttachments {
-				for _, a := range mail.Attachments {
-					fileResp, resp := c.UploadFile(a.Content, ch.Id, a.Filename)
-					if resp.Error != nil {
-						m.Error("Mattermost Upload File Error", map[string]interface{}{"error": resp.Error})
-					} else {
-						if len(fileResp.FileInfos) != 1 {
-							m.Error("Mattermost Upload File Error", map[string]interface{}{"error": resp.Error, "fileinfos": fileResp.FileInfos})
-						} else {
-							fileIDs = append(fileIDs, fileResp.FileInfos[0].Id)
-						}
-					}
-				}
+				fail(user, resp.Error)
+				continue
 			}
 
-			post := &model.Post{ChannelId: ch.Id, Message: msg}
-			if len(fileIDs) > 0 {
-				post.FileIds = fileIDs
-			}
-			_, resp = c.CreatePost(post)
+			ch, resp := c.CreateDirectChannel(myid, u.Id)
 			if resp.Error != nil {
-				m.Error("Mattermost Post Error", map[string]interface{}{"Error": err, "status": "fallback send only subject"})
-				post := &model.Post{ChannelId: ch.Id, Message: fallback}
-				_, resp = c.CreatePost(post)
-				if resp.Error != nil {
-					m.Error("Mattermost Post Error", map[string]interface{}{"Error": err, "status": "fallback not working"})
-					return resp.Error
-				}
+				fail(user, resp.Error)
+				continue
+			}
+			err = post(ch, user)
+			if err != nil {
+				fail(user, err)
+				continue
 			}
+			done.Users = append(done.Users, user)
 		}
 	} else {
 		m.Debug("no users configured to send to", nil)
 	}
 
-	return nil
+	return failed
 }
@@ -1,6 +1,7 @@
 package mail2most
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,7 +11,7 @@ func TestMattermost(t *testing.T) {
 	m2m, err := New("../conf/mail2most.conf")
 	assert.Nil(t, err)
 
-	_, err = m2m.mlogin(0)
+	_, _, _, err = m2m.acquireMattermost(context.Background(), 0)
 	assert.NotNil(t, err)
 
 	err = m2m.PostMattermost(0, Mail{})
@@ -0,0 +1,211 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// mattermostPool keeps one logged in mattermost session per account
+// profiles using the same server and credentials share a client
+type mattermostPool struct {
+	mu      sync.Mutex
+	clients map[string]*mattermostClient
+}
+
+// mattermostClient is the pooled session of an account, it is shared by all profiles using the account
+// every user gets its own *model.Client4 sending the requests with its context,
+// expired sessions are renewed by logging in again
+type mattermostClient struct {
+	conf mattermost
+	// loginMu serializes logging in, mu guards the session
+	loginMu  sync.Mutex
+	mu       sync.Mutex
+	token    string
+	authType string
+	// userID is the id of the user mail2most posts as
+	userID string
+}
+
+func newMattermostPool() *mattermostPool {
+	return &mattermostPool{clients: make(map[string]*mattermostClient)}
+}
+
+// mattermostAccount returns the key of the client used by a profile
+func (m Mail2Most) mattermostAccount(profile int) string {
+	conf := m.Config.Profiles[profile].Mattermost
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s", conf.URL, conf.Username, conf.Password, conf.AccessToken)
+}
+
+// newMattermostClient returns a client for a profile which is not logged in yet
+func (m Mail2Most) newMattermostClient(profile int) *mattermostClient {
+	return &mattermostClient{conf: m.Config.Profiles[profile].Mattermost}
+}
+
+// session returns the token and the user id of the current session
+func (mc *mattermostClient) session() (token, authType, userID string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.token, mc.authType, mc.userID
+}
+
+func (mc *mattermostClient) setSession(token, authType, userID string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.token, mc.authType, mc.userID = token, authType, userID
+}
+
+// client returns a client sending its requests with ctx using the current session
+func (mc *mattermostClient) client(ctx context.Context) *model.Client4 {
+	c := model.NewAPIv4Client(mc.conf.URL)
+	c.HttpClient = &http.Client{Transport: &mattermostTransport{mc: mc, ctx: ctx}}
+	c.AuthToken, c.AuthType, _ = mc.session()
+	return c
+}
+
+// login authenticates the client using the password or the access token and looks up the user id
+// the caller holds mc.loginMu
+func (mc *mattermostClient) login(ctx context.Context) error {
+	var (
+		u    *model.User
+		resp *model.Response
+	)
+	c := model.NewAPIv4Client(mc.conf.URL)
+	c.HttpClient = &http.Client{Transport: &mattermostTransport{ctx: ctx}}
+	if mc.passwordLogin() {
+		u, resp = c.Login(mc.conf.Username, mc.conf.Password)
+	} else if mc.conf.AccessToken != "" {
+		c.AuthToken = mc.conf.AccessToken
+		c.AuthType = model.HEADER_BEARER
+		u, resp = c.GetMe("")
+	} else {
+		return fmt.Errorf("no username, password or token is set")
+	}
+	if resp.Error != nil {
+		mc.setSession("", "", "")
+		return resp.Error
+	}
+	mc.setSession(c.AuthToken, c.AuthType, u.Id)
+	return nil
+}
+
+// renew logs in again after the session used by a request expired
+// only the first user of an expired session logs in, the others use the new session
+func (mc *mattermostClient) renew(ctx context.Context, expired string) error {
+	mc.loginMu.Lock()
+	defer mc.loginMu.Unlock()
+	if token, authType, _ := mc.session(); token != "" && authType+" "+token != expired {
+		return nil
+	}
+	return mc.login(ctx)
+}
+
+// passwordLogin reports whether the client logs in using the password instead of the access token
+func (mc *mattermostClient) passwordLogin() bool {
+	return mc.conf.Username != "" && mc.conf.Password != ""
+}
+
+// logout ends the session of a password login, access tokens stay valid
+func (mc *mattermostClient) logout(ctx context.Context) {
+	if mc.passwordLogin() {
+		mc.client(ctx).Logout()
+	}
+}
+
+// mattermostTransport sends the requests of a client using the context of its user and the current session
+// a request answered with 401 is sent again after logging in, unless the access token itself is rejected
+type mattermostTransport struct {
+	// mc is nil while logging in
+	mc  *mattermostClient
+	ctx context.Context
+}
+
+func (t *mattermostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(t.ctx)
+	if t.mc != nil {
+		if token, authType, _ := t.mc.session(); token != "" {
+			req.Header.Set(model.HEADER_AUTH, authType+" "+token)
+		}
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if t.mc == nil || err != nil || resp.StatusCode != http.StatusUnauthorized || !t.mc.passwordLogin() ||
+		strings.HasSuffix(req.URL.Path, "/users/login") || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	// the session expired
+	err = t.mc.renew(t.ctx, req.Header.Get(model.HEADER_AUTH))
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(t.ctx)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	token, authType, _ := t.mc.session()
+	retry.Header.Set(model.HEADER_AUTH, authType+" "+token)
+	return http.DefaultTransport.RoundTrip(retry)
+}
+
+// acquireMattermost returns a logged in client for a profile and the id of the user it posts as
+// pooled sessions are used by many profiles at the same time, only logging in is serialized
+// release has to be called after using the client
+func (m Mail2Most) acquireMattermost(ctx context.Context, profile int) (*model.Client4, string, func(), error) {
+	if m.mattermost == nil {
+		mc := m.newMattermostClient(profile)
+		err := mc.login(ctx)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return mc.client(ctx), mc.userID, func() { mc.logout(ctx) }, nil
+	}
+
+	key := m.mattermostAccount(profile)
+	m.mattermost.mu.Lock()
+	mc, ok := m.mattermost.clients[key]
+	if !ok {
+		mc = m.newMattermostClient(profile)
+		m.mattermost.clients[key] = mc
+	}
+	m.mattermost.mu.Unlock()
+
+	mc.loginMu.Lock()
+	_, _, userID := mc.session()
+	if userID == "" {
+		err := mc.login(ctx)
+		if err != nil {
+			mc.loginMu.Unlock()
+			return nil, "", nil, err
+		}
+		_, _, userID = mc.session()
+		m.Debug("mattermost", map[string]interface{}{
+			"status": "logged in",
+			"server": mc.conf.URL,
+		})
+	}
+	mc.loginMu.Unlock()
+	return mc.client(ctx), userID, func() {}, nil
+}
+
+// close logs out all pooled clients
+func (p *mattermostPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, mc := range p.clients {
+		mc.loginMu.Lock()
+		if _, _, userID := mc.session(); userID != "" {
+			mc.logout(context.Background())
+			mc.setSession("", "", "")
+		}
+		mc.loginMu.Unlock()
+		delete(p.clients, key)
+	}
+}
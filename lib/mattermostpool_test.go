@@ -0,0 +1,103 @@
+package mail2most
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMattermostPool(t *testing.T) {
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Mattermost.Users = []string{"bob"}
+	m2m.Config.Profiles[1].Mattermost = m2m.Config.Profiles[0].Mattermost
+	mail := Mail{Subject: "hello", Body: "body", From: []*imap.Address{imapAddress("Alice", "alice@example.com")}}
+
+	// a burst of mails uses a single session
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, m2m.PostMattermost(0, mail))
+	}
+	assert.Nil(t, m2m.PostMattermost(1, mail))
+	assert.Equal(t, 1, mm.logins)
+	assert.Len(t, mm.messages(), 8)
+	assert.Equal(t, "direct-me-user-bob", mm.posts[1]["channel_id"])
+
+	// expired sessions are renewed
+	mm.expireSessions()
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	assert.Equal(t, 2, mm.logins)
+	assert.Len(t, mm.messages(), 10)
+
+	m2m.mattermost.close()
+	assert.Equal(t, 1, mm.logouts)
+	assert.Len(t, m2m.mattermost.clients, 0)
+
+	// access tokens are not logged out
+	m2m.Config.Profiles[0].Mattermost.Username = ""
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	m2m.mattermost.close()
+	assert.Equal(t, 2, mm.logins)
+	assert.Equal(t, 1, mm.logouts)
+
+	// rejected access tokens are not retried
+	m2m.Config.Profiles[0].Mattermost.AccessToken = "expired"
+	assert.NotNil(t, m2m.PostMattermost(0, mail))
+
+	// clients are not pooled without a pool
+	m2m.mattermost = nil
+	m2m.Config.Profiles[0].Mattermost = m2m.Config.Profiles[1].Mattermost
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	assert.Equal(t, 3, mm.logins)
+	assert.Equal(t, 2, mm.logouts)
+	m2m.Config.Profiles[0].Mattermost.Password = "wrong"
+	assert.NotNil(t, m2m.PostMattermost(0, mail))
+}
+
+func TestMattermostPoolConcurrent(t *testing.T) {
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[1].Mattermost = m2m.Config.Profiles[0].Mattermost
+	mail := Mail{Subject: "hello", Body: "body", From: []*imap.Address{imapAddress("Alice", "alice@example.com")}}
+
+	// profiles sharing an account post while the client is in use
+	_, _, release, err := m2m.acquireMattermost(context.Background(), 0)
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- m2m.PostMattermost(1, mail)
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("post waited for the other profile")
+	}
+	release()
+
+	// an expired session is renewed once
+	mm.expireSessions()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			assert.Nil(t, m2m.PostMattermost(p, mail))
+		}(i % 2)
+	}
+	wg.Wait()
+	assert.Equal(t, 2, mm.logins)
+	assert.Len(t, mm.messages(), 5)
+	m2m.mattermost.close()
+}
@@ -0,0 +1,79 @@
+package mail2most
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+)
+
+// mboxQuoted matches body lines starting with From which are quoted by additional >
+var mboxQuoted = regexp.MustCompile(`^>+From `)
+
+// readMbox splits an mbox file into its mails, the quoting of From lines is removed (mboxrd)
+func readMbox(r io.Reader) ([][]byte, error) {
+	var (
+		mails [][]byte
+		mail  *bytes.Buffer
+		blank = true
+	)
+	end := func() {
+		if mail != nil {
+			// the blank line in front of the next From line belongs to the separator
+			mails = append(mails, bytes.TrimSuffix(mail.Bytes(), []byte("\n")))
+		}
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case blank && bytes.HasPrefix(line, []byte("From ")):
+				end()
+				mail = new(bytes.Buffer)
+			case mail == nil:
+				// garbage in front of the first mail
+			case mboxQuoted.Match(line):
+				mail.Write(line[1:])
+			default:
+				mail.Write(line)
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+		if err == io.EOF {
+			end()
+			return mails, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getMboxMail returns the mails of an mbox file not examined yet
+func (m Mail2Most) getMboxMail(profile int, state StateStore) ([]Mail, []folderSync, error) {
+	f, err := os.Open(m.Config.Profiles[profile].Mail.Path)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	raws, err := readMbox(f)
+	f.Close()
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+
+	msgs := make([]sourceMessage, 0, len(raws))
+	for _, raw := range raws {
+		raw := raw
+		msgs = append(msgs, sourceMessage{id: messageID(raw), read: func() (io.Reader, error) {
+			return bytes.NewReader(raw), nil
+		}})
+	}
+	mails, sync, err := m.fetchSourceMails(profile, state, msgs)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	return mails, []folderSync{sync}, nil
+}
@@ -0,0 +1,77 @@
+package mail2most
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+const testMbox = `From alice@example.com Sat Jun 18 12:00:00 2016
+From: alice@example.com
+To: bob@example.com
+Subject: hello
+Message-Id: <1@example.com>
+Content-Type: text/plain
+
+>From the start
+>>From quoted twice
+
+From carol@example.com Sat Jun 18 13:00:00 2016
+From: carol@example.com
+To: bob@example.com
+Subject: no message id
+Content-Type: text/plain
+
+hello
+From is not a separator here
+
+`
+
+func TestReadMbox(t *testing.T) {
+	mails, err := readMbox(strings.NewReader(testMbox))
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 2) {
+		assert.True(t, strings.HasSuffix(string(mails[0]), "\n\nFrom the start\n>From quoted twice\n"))
+		assert.True(t, strings.HasSuffix(string(mails[1]), "\nhello\nFrom is not a separator here\n"))
+		assert.Equal(t, "<1@example.com>", messageID(mails[0]))
+		assert.True(t, strings.HasPrefix(messageID(mails[1]), "sha256:"))
+	}
+
+	mails, err = readMbox(strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Len(t, mails, 0)
+}
+
+func TestMbox(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	path := filepath.Join(dir, "bob")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testMbox), 0600))
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEMBOX, Path: path}
+	m2m.Config.Profiles[0].Filter = filter{From: []string{"alice@example.com"}}
+	assert.Nil(t, m2m.checkSource(0))
+	assert.Equal(t, path, m2m.mailServer(0))
+
+	state, err := m2m.openJSONStateStore(filepath.Join(dir, "data.json"))
+	assert.Nil(t, err)
+	mails, syncs, err := m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "hello", mails[0].Subject)
+		assert.Equal(t, "<1@example.com>", mails[0].SourceID)
+	}
+	if assert.Len(t, syncs, 1) {
+		assert.Len(t, syncs[0].examined, 1)
+	}
+
+	m2m.Config.Profiles[0].Mail.OnSuccess = mailAction{Delete: true}
+	assert.NotNil(t, m2m.checkSource(0))
+}
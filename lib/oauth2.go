@@ -0,0 +1,254 @@
+package mail2most
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+// oauth2Token is a cached access token
+type oauth2Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// valid reports whether the token can still be used, tokens expiring within a minute are refreshed
+func (t oauth2Token) valid() bool {
+	return t.AccessToken != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > time.Minute)
+}
+
+// tokenCache keeps access tokens between checks, tokens are cached per token endpoint and refresh token
+// mu only guards the map and the tokens, refreshes of a token are serialized by the lock of its entry
+// so a slow token endpoint does not block the profiles of other accounts
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*tokenEntry
+}
+
+type tokenEntry struct {
+	// lock is held while the token is refreshed, it is a channel so waiting for it can be cancelled
+	lock  chan struct{}
+	token oauth2Token
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*tokenEntry)}
+}
+
+// entry returns the entry of a cache key
+func (c *tokenCache) entry(key string) *tokenEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.tokens[key]
+	if !ok {
+		e = &tokenEntry{lock: make(chan struct{}, 1)}
+		c.tokens[key] = e
+	}
+	return e
+}
+
+// token returns the cached token of an entry
+func (c *tokenCache) token(e *tokenEntry) oauth2Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.token
+}
+
+// setToken replaces the cached token of an entry
+func (c *tokenCache) setToken(e *tokenEntry, t oauth2Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.token = t
+}
+
+func oauth2CacheKey(conf oauth2Config) string {
+	return conf.TokenURL + "\x00" + conf.ClientID + "\x00" + conf.RefreshToken
+}
+
+// authenticate logs in using the authentication mechanism of the profile
+func (m Mail2Most) authenticate(ctx context.Context, c *client.Client, profile int) error {
+	mail := m.Config.Profiles[profile].Mail
+	switch mail.Auth {
+	case "", AUTHLOGIN:
+		return c.Login(mail.Username, mail.Password)
+	case AUTHXOAUTH2, AUTHOAUTHBEARER:
+		auth, err := m.oauth2Client(ctx, profile)
+		if err != nil {
+			return err
+		}
+		err = c.Authenticate(auth)
+		if err != nil {
+			// the token might have been revoked, fetch a new one on the next try
+			m.invalidateToken(profile)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown auth mechanism: %s", mail.Auth)
+	}
+}
+
+// oauth2Client returns the sasl client of the oauth2 mechanism of a profile
+func (m Mail2Most) oauth2Client(ctx context.Context, profile int) (sasl.Client, error) {
+	mail := m.Config.Profiles[profile].Mail
+	token, err := m.oauth2AccessToken(ctx, profile)
+	if err != nil {
+		return nil, err
+	}
+	if mail.Auth == AUTHXOAUTH2 {
+		return newXOAuth2Client(mail.Username, token), nil
+	}
+	return newOAuthBearerClient(mail.Username, token), nil
+}
+
+// oauth2AccessToken returns a valid access token for a profile
+// static tokens are used as they are, otherwise the refresh token is exchanged at the token endpoint
+// only one refresh per token runs at a time, waiting for it is aborted if ctx is cancelled
+func (m Mail2Most) oauth2AccessToken(ctx context.Context, profile int) (string, error) {
+	conf := m.Config.Profiles[profile].Mail.OAuth2
+	if conf.AccessToken != "" {
+		return conf.AccessToken, nil
+	}
+	if conf.TokenURL == "" || conf.RefreshToken == "" {
+		return "", fmt.Errorf("no oauth2 access token or refresh token and token url is set")
+	}
+
+	var e *tokenEntry
+	if m.tokens != nil {
+		e = m.tokens.entry(oauth2CacheKey(conf))
+		if t := m.tokens.token(e); t.valid() {
+			return t.AccessToken, nil
+		}
+		select {
+		case e.lock <- struct{}{}:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		defer func() { <-e.lock }()
+		// the token might have been refreshed while waiting
+		t := m.tokens.token(e)
+		if t.valid() {
+			return t.AccessToken, nil
+		}
+		if t.RefreshToken != "" {
+			// some providers rotate refresh tokens
+			conf.RefreshToken = t.RefreshToken
+		}
+	}
+
+	t, err := refreshOAuth2Token(ctx, conf)
+	if err != nil {
+		return "", err
+	}
+	m.Debug("oauth2", map[string]interface{}{
+		"status": "access token refreshed",
+		"expiry": t.Expiry,
+	})
+	if e != nil {
+		m.tokens.setToken(e, t)
+	}
+	return t.AccessToken, nil
+}
+
+func (m Mail2Most) invalidateToken(profile int) {
+	if m.tokens == nil {
+		return
+	}
+	e := m.tokens.entry(oauth2CacheKey(m.Config.Profiles[profile].Mail.OAuth2))
+	m.tokens.mu.Lock()
+	defer m.tokens.mu.Unlock()
+	e.token.AccessToken = ""
+}
+
+// refreshOAuth2Token exchanges a refresh token for an access token (RFC 6749 section 6)
+// the request is aborted if ctx is cancelled
+func refreshOAuth2Token(ctx context.Context, conf oauth2Config) (oauth2Token, error) {
+	params := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {conf.RefreshToken},
+		"client_id":     {conf.ClientID},
+	}
+	if conf.ClientSecret != "" {
+		params.Set("client_secret", conf.ClientSecret)
+	}
+	if len(conf.Scopes) > 0 {
+		params.Set("scope", strings.Join(conf.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("oauth2 token endpoint returned %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("oauth2 token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	t := oauth2Token{AccessToken: body.AccessToken, RefreshToken: body.RefreshToken}
+	if t.RefreshToken == "" {
+		t.RefreshToken = conf.RefreshToken
+	}
+	if body.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return t, nil
+}
+
+// xoauth2Client implements the XOAUTH2 sasl mechanism used by Google and Microsoft
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Client struct {
+	username, token string
+}
+
+func newXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (a *xoauth2Client) Start() (string, []byte, error) {
+	return AUTHXOAUTH2NAME, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the error challenge with an empty response so the server finishes the exchange
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// oauthBearerClient wraps the OAUTHBEARER client of go-sasl
+// on errors the server expects a dummy response instead of a cancelled exchange (RFC 7628 section 3.2.3)
+type oauthBearerClient struct {
+	sasl.Client
+}
+
+func newOAuthBearerClient(username, token string) sasl.Client {
+	return &oauthBearerClient{sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{Username: username, Token: token})}
+}
+
+func (a *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	return []byte{0x01}, nil
+}
@@ -0,0 +1,198 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTokenEndpoint returns a fake oauth2 token endpoint issuing numbered access tokens
+func newTestTokenEndpoint(t *testing.T, expiresIn int) (*httptest.Server, *int) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		if r.PostForm.Get("refresh_token") != fmt.Sprintf("refresh-%d", requests) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant","error_description":"unknown refresh token"}`)
+			return
+		}
+		requests++
+		// the refresh token is rotated on every request
+		fmt.Fprintf(w, `{"access_token":"token-%d","refresh_token":"refresh-%d","expires_in":%d,"token_type":"Bearer"}`, requests, requests, expiresIn)
+	}))
+	return ts, &requests
+}
+
+func TestOAuth2AccessToken(t *testing.T) {
+	ts, requests := newTestTokenEndpoint(t, 3600)
+	defer ts.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{AccessToken: "static"}
+	token, err := m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "static", token)
+
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{}
+	_, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{TokenURL: ts.URL, ClientID: "client", RefreshToken: "refresh-0"}
+	token, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// the token is cached
+	token, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, 1, *requests)
+
+	// invalidated tokens are refreshed using the rotated refresh token
+	m2m.invalidateToken(0)
+	token, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-2", token)
+
+	m2m.Config.Profiles[0].Mail.OAuth2.ClientID = "unknown"
+	_, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "oauth2 token endpoint returned 400 Bad Request: invalid_request ", err.Error())
+	}
+}
+
+func TestOAuth2Expiry(t *testing.T) {
+	ts, requests := newTestTokenEndpoint(t, 30)
+	defer ts.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{TokenURL: ts.URL, ClientID: "client", RefreshToken: "refresh-0"}
+
+	// tokens expiring within a minute are refreshed
+	token, err := m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+	token, err = m2m.oauth2AccessToken(context.Background(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-2", token)
+	assert.Equal(t, 2, *requests)
+}
+
+func TestOAuth2SlowEndpoint(t *testing.T) {
+	ts, _ := newTestTokenEndpoint(t, 3600)
+	defer ts.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{TokenURL: slow.URL, ClientID: "client", RefreshToken: "refresh-0"}
+	m2m.Config.Profiles[1].Mail.OAuth2 = oauth2Config{TokenURL: ts.URL, ClientID: "client", RefreshToken: "refresh-0"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 2)
+	go func() {
+		_, err := m2m.oauth2AccessToken(ctx, 0)
+		done <- err
+	}()
+	// a second check of the same account waits for the running refresh
+	go func() {
+		_, err := m2m.oauth2AccessToken(ctx, 0)
+		done <- err
+	}()
+
+	// other accounts are not blocked by the slow token endpoint
+	token, err := m2m.oauth2AccessToken(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", token)
+
+	// cancelling aborts the request and the waiting
+	cancel()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			assert.NotNil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("token request was not cancelled")
+		}
+	}
+}
+
+func TestXOAuth2Client(t *testing.T) {
+	mech, ir, err := newXOAuth2Client("user@example.com", "token").Start()
+	assert.Nil(t, err)
+	assert.Equal(t, "XOAUTH2", mech)
+	assert.Equal(t, "user=user@example.com\x01auth=Bearer token\x01\x01", string(ir))
+}
+
+func TestOAuthBearerLogin(t *testing.T) {
+	ts, _ := newTestTokenEndpoint(t, 3600)
+	defer ts.Close()
+
+	be := memory.New()
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if opts.Username != "username" || opts.Token != "token-1" {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			u, err := be.Login(nil, "username", "password")
+			if err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_request"}
+			}
+			conn.Context().User = u
+			conn.Context().State = imap.AuthenticatedState
+			return nil
+		})
+	})
+	addr, stop := serveTestIMAP(t, s)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[0].Mail.Password = ""
+	m2m.Config.Profiles[0].Mail.Auth = AUTHOAUTHBEARER
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{TokenURL: ts.URL, ClientID: "client", RefreshToken: "refresh-0"}
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+
+	m2m.Config.Profiles[0].Mail.OAuth2 = oauth2Config{AccessToken: "revoked"}
+	_, err = m2m.connect(context.Background(), 0)
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Mail.Auth = "foo"
+	_, err = m2m.connect(context.Background(), 0)
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "unknown auth mechanism: foo", err.Error())
+	}
+}
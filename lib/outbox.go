@@ -0,0 +1,370 @@
+package mail2most
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboxEntry is a mail that could not be posted to mattermost
+type OutboxEntry struct {
+	ID          string
+	Profile     string
+	Key         StateKey
+	Mail        Mail
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+	// Delivered are the channels and users the mail was posted to already, retries skip them
+	Delivered Destinations
+}
+
+// Destinations are the channels and users of a profile, written like in its config
+type Destinations struct {
+	Channels, Users []string
+}
+
+// contains reports whether name is part of list
+func contains(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// outbox stores failed deliveries as json files, one file per mail
+// entries that failed too often are moved into the dead subdirectory
+type outbox struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (m Mail2Most) openOutbox() (*outbox, error) {
+	dir := m.Config.Outbox.Path
+	if dir == "" {
+		dir = "outbox"
+	}
+	err := os.MkdirAll(filepath.Join(dir, "dead"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &outbox{dir: dir}, nil
+}
+
+// outboxID returns a stable id so a mail is never queued twice
+func outboxID(key StateKey, mail Mail) string {
+	id := fmt.Sprintf("%s\x00%s\x00%d\x00%d", key.Profile, key.Folder, key.UIDValidity, mail.ID)
+	if mail.SourceID != "" {
+		id += "\x00" + mail.SourceID
+	}
+	sum := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+func (o *outbox) path(id string, dead bool) string {
+	if dead {
+		return filepath.Join(o.dir, "dead", id+".json")
+	}
+	return filepath.Join(o.dir, id+".json")
+}
+
+func (o *outbox) write(e *OutboxEntry, dead bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return writeToFile(e, o.path(e.ID, dead))
+}
+
+func (o *outbox) remove(id string, dead bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return os.Remove(o.path(id, dead))
+}
+
+func (o *outbox) read(id string, dead bool) (*OutboxEntry, error) {
+	bv, err := ioutil.ReadFile(o.path(id, dead))
+	if err != nil {
+		return nil, err
+	}
+	var e OutboxEntry
+	err = json.Unmarshal(bv, &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// list returns all entries of the outbox or the dead letters ordered by creation time
+func (o *outbox) list(dead bool) ([]*OutboxEntry, error) {
+	dir := o.dir
+	if dead {
+		dir = filepath.Join(o.dir, "dead")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*OutboxEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		e, err := o.read(strings.TrimSuffix(f.Name(), ".json"), dead)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// bury moves an entry into the dead letters
+func (o *outbox) bury(e *OutboxEntry) error {
+	err := o.write(e, true)
+	if err != nil {
+		return err
+	}
+	return o.remove(e.ID, false)
+}
+
+// backoff returns the time to wait before the next delivery attempt
+// the wait time doubles with every attempt and is capped by Outbox.MaxBackoff
+func (m Mail2Most) backoff(attempts int) (time.Duration, error) {
+	base, max := 30*time.Second, time.Hour
+	var err error
+	if m.Config.Outbox.Backoff != "" {
+		base, err = time.ParseDuration(m.Config.Outbox.Backoff)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if m.Config.Outbox.MaxBackoff != "" {
+		max, err = time.ParseDuration(m.Config.Outbox.MaxBackoff)
+		if err != nil {
+			return 0, err
+		}
+	}
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d, nil
+}
+
+func (m Mail2Most) maxAttempts() int {
+	if m.Config.Outbox.MaxAttempts > 0 {
+		return m.Config.Outbox.MaxAttempts
+	}
+	return 10
+}
+
+// enqueue stores a failed delivery in the outbox
+// delivered are the channels and users the mail was posted to
+func (m Mail2Most) enqueue(o *outbox, profile int, key StateKey, mail Mail, delivered Destinations, cause error) error {
+	d, err := m.backoff(1)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e := &OutboxEntry{
+		ID:          outboxID(key, mail),
+		Profile:     m.Config.Profiles[profile].Name,
+		Key:         key,
+		Mail:        mail,
+		Attempts:    1,
+		Created:     now,
+		NextAttempt: now.Add(d),
+		LastError:   cause.Error(),
+		Delivered:   delivered,
+	}
+	m.Info("mail queued in outbox", map[string]interface{}{
+		"id":           e.ID,
+		"subject":      mail.Subject,
+		"next-attempt": e.NextAttempt,
+	})
+	if m.maxAttempts() <= 1 {
+		return o.bury(e)
+	}
+	return o.write(e, false)
+}
+
+// profileByName returns the index of the profile with the given name or -1
+func (m Mail2Most) profileByName(name string) int {
+	for p := range m.Config.Profiles {
+		if m.Config.Profiles[p].Name == name {
+			return p
+		}
+	}
+	return -1
+}
+
+// processOutbox retries all due deliveries of the outbox
+// ctx aborts all requests, once stop is closed no further mails are posted
+// replies are posted into the threads stored in state
+func (m Mail2Most) processOutbox(ctx context.Context, stop <-chan struct{}, o *outbox, state StateStore) error {
+	entries, err := o.list(false)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if stopped(stop) {
+			return nil
+		}
+		if e.NextAttempt.After(now) {
+			continue
+		}
+		p := m.profileByName(e.Profile)
+		if p < 0 {
+			e.LastError = "profile not found in the config"
+			m.Error("outbox error", map[string]interface{}{
+				"id":      e.ID,
+				"profile": e.Profile,
+				"error":   e.LastError,
+				"status":  "moved to dead letters",
+			})
+			err = o.bury(e)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if m.quiet(p, now) {
+			// the mail is posted together with the held back mails once the quiet hours end
+			continue
+		}
+
+		perr := m.postMattermost(ctx, p, e.Mail, state, &e.Delivered)
+		if perr == nil {
+			m.Info("outbox mail delivered", map[string]interface{}{
+				"id":       e.ID,
+				"subject":  e.Mail.Subject,
+				"attempts": e.Attempts + 1,
+			})
+			err = o.remove(e.ID, false)
+			if err != nil {
+				return err
+			}
+			m.mailActions(ctx, p, []Mail{e.Mail}, m.Config.Profiles[p].Mail.OnSuccess)
+			continue
+		}
+
+		e.Attempts++
+		e.LastError = perr.Error()
+		if e.Attempts >= m.maxAttempts() {
+			m.Error("outbox delivery failed", map[string]interface{}{
+				"id":       e.ID,
+				"subject":  e.Mail.Subject,
+				"attempts": e.Attempts,
+				"error":    perr,
+				"status":   "moved to dead letters",
+			})
+			err = o.bury(e)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		d, err := m.backoff(e.Attempts)
+		if err != nil {
+			return err
+		}
+		e.NextAttempt = now.Add(d)
+		m.Info("outbox delivery failed", map[string]interface{}{
+			"id":           e.ID,
+			"subject":      e.Mail.Subject,
+			"attempts":     e.Attempts,
+			"error":        perr,
+			"next-attempt": e.NextAttempt,
+		})
+		err = o.write(e, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeadLetters lists all mails that could not be delivered after Outbox.MaxAttempts
+func (m Mail2Most) DeadLetters() ([]*OutboxEntry, error) {
+	o, err := m.openOutbox()
+	if err != nil {
+		return nil, err
+	}
+	return o.list(true)
+}
+
+// RetryDeadLetter moves a dead letter back into the outbox, it is delivered on the next check
+// the id "all" retries all dead letters
+func (m Mail2Most) RetryDeadLetter(id string) error {
+	o, err := m.openOutbox()
+	if err != nil {
+		return err
+	}
+	entries, err := m.deadLetters(o, id)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.Attempts = 0
+		e.NextAttempt = time.Now()
+		err = o.write(e, false)
+		if err != nil {
+			return err
+		}
+		err = o.remove(e.ID, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DropDeadLetter deletes a dead letter, the id "all" deletes all dead letters
+func (m Mail2Most) DropDeadLetter(id string) error {
+	o, err := m.openOutbox()
+	if err != nil {
+		return err
+	}
+	entries, err := m.deadLetters(o, id)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = o.remove(e.ID, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Mail2Most) deadLetters(o *outbox, id string) ([]*OutboxEntry, error) {
+	if id == "all" {
+		return o.list(true)
+	}
+	e, err := o.read(id, true)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("dead letter not found: %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*OutboxEntry{e}, nil
+}
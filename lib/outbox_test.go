@@ -0,0 +1,157 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	var m2m Mail2Most
+
+	d, err := m2m.backoff(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, d)
+
+	d, err = m2m.backoff(3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Minute, d)
+
+	d, err = m2m.backoff(100)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, d)
+
+	m2m.Config.Outbox.Backoff = "foo"
+	_, err = m2m.backoff(1)
+	assert.NotNil(t, err)
+}
+
+func TestOutbox(t *testing.T) {
+	defer filet.CleanUp(t)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.Outbox.Path = filet.TmpDir(t, "")
+	m2m.Config.Outbox.MaxAttempts = 2
+	m2m.Config.Outbox.Backoff = "1ns"
+
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+
+	key := StateKey{Profile: m2m.Config.Profiles[0].Name, Folder: "INBOX", UIDValidity: 1}
+	mail := Mail{
+		ID:      42,
+		Subject: "i am an example subject",
+		From:    []*imap.Address{&imap.Address{MailboxName: "test", HostName: "example.com"}},
+	}
+	err = m2m.enqueue(o, 0, key, mail, Destinations{}, fmt.Errorf("mattermost is down"))
+	assert.Nil(t, err)
+
+	entries, err := o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, outboxID(key, mail), entries[0].ID)
+	assert.Equal(t, "mattermost is down", entries[0].LastError)
+	assert.Equal(t, mail.Subject, entries[0].Mail.Subject)
+
+	// mattermost.example.com can not be reached, the second attempt moves the mail to the dead letters
+	time.Sleep(time.Millisecond)
+	err = m2m.processOutbox(context.Background(), nil, o, nil)
+	assert.Nil(t, err)
+
+	entries, err = o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+
+	dead, err := m2m.DeadLetters()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, 2, dead[0].Attempts)
+
+	err = m2m.RetryDeadLetter("doesnotexist")
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "dead letter not found: doesnotexist", err.Error())
+	}
+
+	err = m2m.RetryDeadLetter(dead[0].ID)
+	assert.Nil(t, err)
+	entries, err = o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 0, entries[0].Attempts)
+
+	// deleted profiles can not be delivered anymore
+	m2m.Config.Profiles[0].Name = "deleted"
+	err = m2m.processOutbox(context.Background(), nil, o, nil)
+	assert.Nil(t, err)
+
+	dead, err = m2m.DeadLetters()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "profile not found in the config", dead[0].LastError)
+
+	err = m2m.DropDeadLetter("all")
+	assert.Nil(t, err)
+	dead, err = m2m.DeadLetters()
+	assert.Nil(t, err)
+	assert.Len(t, dead, 0)
+}
+
+func TestOutboxDestinations(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#broken-channel", "#some-channel"}
+	m2m.Config.Profiles[0].Mattermost.Users = []string{"bob"}
+	m2m.Config.Outbox.Path = filet.TmpDir(t, "")
+	m2m.Config.Outbox.Backoff = "1ns"
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+
+	// a failing channel does not keep the mail from the other channels and users
+	mm.mu.Lock()
+	mm.failing["channel-broken-channel"] = true
+	mm.mu.Unlock()
+	mail := Mail{ID: 42, Subject: "hello", Body: "hello world", From: []*imap.Address{imapAddress("Alice", "alice@example.com")}}
+	var done Destinations
+	perr := m2m.postMattermost(context.Background(), 0, mail, nil, &done)
+	assert.NotNil(t, perr)
+	assert.Equal(t, Destinations{Channels: []string{"#some-channel"}, Users: []string{"bob"}}, done)
+	assert.Len(t, mm.messages(), 2)
+
+	key := StateKey{Profile: m2m.Config.Profiles[0].Name, Folder: "INBOX", UIDValidity: 1}
+	assert.Nil(t, m2m.enqueue(o, 0, key, mail, done, perr))
+
+	// retries only post to the failed channel
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, m2m.processOutbox(context.Background(), nil, o, nil))
+	assert.Len(t, mm.messages(), 2)
+	entries, err := o.list(false)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, done, entries[0].Delivered)
+	}
+
+	mm.mu.Lock()
+	mm.failing = make(map[string]bool)
+	mm.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, m2m.processOutbox(context.Background(), nil, o, nil))
+	mm.mu.Lock()
+	assert.Len(t, mm.posts, 3)
+	assert.Equal(t, "channel-broken-channel", mm.posts[2]["channel_id"])
+	mm.mu.Unlock()
+	entries, err = o.list(false)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
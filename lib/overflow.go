@@ -0,0 +1,156 @@
+package mail2most
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	// maxPostLength is the maximum message length of mattermost posts
+	// https://docs.mattermost.com/administration/important-upgrade-notes.html
+	maxPostLength = 16383
+	// summaryLength is the length of the summary posted for attached messages
+	summaryLength = 2000
+	// truncatedMarker is appended to truncated messages
+	truncatedMarker = "\n\n_… message truncated_"
+	// codeFence opens and closes code blocks
+	codeFence = "```"
+)
+
+// overflow returns the posts of a message and the file replacing the message if it is too long for a single post
+// body is the content of the file of the attach strategy
+func (m Mail2Most) overflow(profile int, msg, body string) ([]string, *Attachment, error) {
+	if len(msg) <= maxPostLength {
+		return []string{msg}, nil, nil
+	}
+	conf := m.Config.Profiles[profile].Mattermost
+	switch conf.Overflow {
+	case "", OVERFLOWTRUNCATE:
+		return []string{truncateMessage(msg, maxPostLength)}, nil, nil
+	case OVERFLOWSPLIT:
+		return splitMessage(msg, maxPostLength), nil, nil
+	case OVERFLOWATTACH:
+		name := "mail.txt"
+		if conf.ConvertToMarkdown {
+			name = "mail.md"
+		}
+		summary := truncateMessage(msg, summaryLength) + fmt.Sprintf("\n_the full mail is attached as %s_", name)
+		return []string{summary}, &Attachment{Filename: name, Content: []byte(body)}, nil
+	default:
+		return nil, nil, configError{fmt.Errorf("unknown overflow strategy: %s", conf.Overflow)}
+	}
+}
+
+// uploadFile uploads a file to a channel and returns its id
+func (m Mail2Most) uploadFile(c *model.Client4, channelID string, file Attachment) (string, error) {
+	fileResp, resp := c.UploadFile(file.Content, channelID, file.Filename)
+	if resp.Error != nil {
+		m.Error("Mattermost Upload File Error", map[string]interface{}{"error": resp.Error, "file": file.Filename})
+		return "", resp.Error
+	}
+	if len(fileResp.FileInfos) != 1 {
+		return "", fmt.Errorf("upload of %s returned %d files", file.Filename, len(fileResp.FileInfos))
+	}
+	return fileResp.FileInfos[0].Id, nil
+}
+
+// postContinuations posts the remaining parts of a split message as replies to its first post
+func (m Mail2Most) postContinuations(c *model.Client4, first *model.Post, parts []string) error {
+	for _, part := range parts {
+		_, resp := c.CreatePost(&model.Post{ChannelId: first.ChannelId, Message: part, RootId: threadRootID(first)})
+		if resp.Error != nil {
+			m.Error("Mattermost Post Error", map[string]interface{}{"error": resp.Error, "status": "continuation not posted"})
+			return resp.Error
+		}
+	}
+	return nil
+}
+
+// truncateMessage cuts a message to at most max bytes at a rune boundary and appends the truncated marker
+// a code block open at the cut is closed
+func truncateMessage(msg string, max int) string {
+	if len(msg) <= max {
+		return msg
+	}
+	msg = strings.TrimRight(msg[:breakPoint(msg, max-len(truncatedMarker)-len("\n"+codeFence), 0)], "\n")
+	if openFence(msg) != "" {
+		msg += "\n" + codeFence
+	}
+	return msg + truncatedMarker
+}
+
+// splitMessage splits a message into parts of at most max bytes, breaking at paragraphs, lines, spaces or runes
+// code blocks open at the end of a part are closed and opened again in the next part
+func splitMessage(msg string, max int) []string {
+	var (
+		parts []string
+		open  string
+	)
+	for {
+		if open != "" {
+			msg = open + "\n" + msg
+		}
+		if len(msg) <= max {
+			return append(parts, msg)
+		}
+		cut := breakPoint(msg, max, len(open))
+		part := strings.TrimRight(msg[:cut], "\n")
+		open = openFence(part)
+		if open != "" && len(part)+len("\n"+codeFence) > max {
+			// make room for closing the code block
+			cut = breakPoint(msg, max-len("\n"+codeFence), len(open))
+			part = strings.TrimRight(msg[:cut], "\n")
+			open = openFence(part)
+		}
+		if open != "" {
+			part += "\n" + codeFence
+		}
+		parts = append(parts, part)
+		msg = strings.TrimLeft(msg[cut:], "\n")
+	}
+}
+
+// breakPoint returns the position to split s at, it is at most limit and after min
+// paragraphs are preferred over lines, spaces and runes in the second half of the limit
+func breakPoint(s string, limit, min int) int {
+	if limit/2 > min {
+		min = limit / 2
+	}
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(s[:limit], sep); i > min {
+			return i + len(sep)
+		}
+	}
+	return runeBoundary(s, limit)
+}
+
+// runeBoundary returns the last position up to i which does not split a rune
+func runeBoundary(s string, i int) int {
+	if i >= len(s) {
+		return len(s)
+	}
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return i
+}
+
+// openFence returns the opening line of the code block open at the end of s, it is empty if all code blocks are closed
+func openFence(s string) string {
+	var open string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, codeFence) {
+			continue
+		}
+		if open == "" {
+			open = line
+		} else {
+			open = ""
+		}
+	}
+	return open
+}
@@ -0,0 +1,105 @@
+package mail2most
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateMessage(t *testing.T) {
+	assert.Equal(t, "short", truncateMessage("short", 10))
+
+	msg := truncateMessage(strings.Repeat("ä", 100), 51)
+	assert.True(t, utf8.ValidString(msg))
+	assert.True(t, len(msg) <= 51)
+	assert.True(t, strings.HasSuffix(msg, truncatedMarker))
+
+	msg = truncateMessage("```\n"+strings.Repeat("line\n", 100), 100)
+	assert.True(t, len(msg) <= 100)
+	assert.Equal(t, "", openFence(msg))
+	assert.True(t, strings.HasSuffix(msg, "\n```"+truncatedMarker))
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitMessage("short", 10))
+
+	// paragraphs are kept together
+	parts := splitMessage("first paragraph\n\nsecond paragraph", 30)
+	assert.Equal(t, []string{"first paragraph", "second paragraph"}, parts)
+
+	// runes are not split
+	parts = splitMessage(strings.Repeat("ä", 100), 51)
+	assert.Len(t, parts, 4)
+	for _, part := range parts {
+		assert.True(t, utf8.ValidString(part))
+		assert.True(t, len(part) <= 51)
+	}
+	assert.Equal(t, strings.Repeat("ä", 100), strings.Join(parts, ""))
+
+	// code blocks are closed and opened again
+	msg := "intro\n```go\n" + strings.Repeat("some code\n", 30) + "```\noutro"
+	parts = splitMessage(msg, 100)
+	assert.True(t, len(parts) > 2)
+	for i, part := range parts {
+		assert.True(t, len(part) <= 100)
+		assert.Equal(t, "", openFence(part), part)
+		if i > 0 && i < len(parts)-1 {
+			assert.True(t, strings.HasPrefix(part, "```go\n"), part)
+		}
+	}
+	assert.True(t, strings.HasSuffix(parts[len(parts)-1], "```\noutro"))
+	assert.Equal(t, strings.Count(msg, "some code"), strings.Count(strings.Join(parts, ""), "some code"))
+}
+
+func TestOverflow(t *testing.T) {
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Mattermost.ConvertToMarkdown = false
+	m2m.Config.Profiles[0].Mattermost.StripHTML = false
+	m2m.Config.Profiles[0].Mattermost.MailAttachments = false
+	body := strings.Repeat("a long incident report line\n", 1500) + "the important tail"
+	mail := Mail{Subject: "incident", Body: body, From: []*imap.Address{imapAddress("Alice", "alice@example.com")}}
+
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	msgs := mm.messages()
+	if assert.Len(t, msgs, 1) {
+		assert.True(t, len(msgs[0]) <= maxPostLength)
+		assert.True(t, strings.HasSuffix(msgs[0], truncatedMarker))
+		assert.NotContains(t, msgs[0], "the important tail")
+	}
+
+	m2m.Config.Profiles[0].Mattermost.Overflow = OVERFLOWSPLIT
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	mm.mu.Lock()
+	posts := mm.posts[1:]
+	mm.mu.Unlock()
+	if assert.Len(t, posts, 3) {
+		assert.Equal(t, "", posts[0]["root_id"])
+		assert.Equal(t, posts[0]["id"], posts[1]["root_id"])
+		assert.Equal(t, posts[0]["id"], posts[2]["root_id"])
+		assert.Contains(t, posts[2]["message"], "the important tail")
+	}
+
+	m2m.Config.Profiles[0].Mattermost.Overflow = OVERFLOWATTACH
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	msgs = mm.messages()
+	if assert.Len(t, msgs, 5) {
+		assert.True(t, len(msgs[4]) < summaryLength+100)
+		assert.Contains(t, msgs[4], "mail.txt")
+		assert.Equal(t, body, string(mm.files["file-mail.txt"]))
+	}
+
+	m2m.Config.Profiles[0].Mattermost.Overflow = "foo"
+	assert.NotNil(t, m2m.PostMattermost(0, mail))
+	m2m.Config.Profiles[0].Mattermost.Overflow = OVERFLOWSPLIT
+	mail.Body = "short"
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	assert.Len(t, mm.messages(), 6)
+}
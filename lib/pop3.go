@@ -0,0 +1,394 @@
+package mail2most
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// pop3Client is a minimal POP3 client (RFC 1939) supporting CAPA (RFC 2449), STLS (RFC 2595) and SASL (RFC 5034)
+type pop3Client struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// pop3Message is a message of the maildrop identified by its UIDL
+type pop3Message struct {
+	Number int
+	UID    string
+}
+
+// pop3Error is an -ERR response of the server
+type pop3Error string
+
+func (e pop3Error) Error() string {
+	return "pop3: " + string(e)
+}
+
+// newPOP3Client reads the greeting of the server
+func newPOP3Client(conn net.Conn) (*pop3Client, error) {
+	c := &pop3Client{conn: conn, text: textproto.NewConn(conn)}
+	_, err := c.response()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// response reads a single line response and returns the text after +OK
+func (c *pop3Client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	return parsePOP3Response(line)
+}
+
+func parsePOP3Response(line string) (string, error) {
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", pop3Error(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	return "", fmt.Errorf("pop3: unexpected response: %s", line)
+}
+
+// cmd sends a command and reads its single line response
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	err := c.text.PrintfLine(format, args...)
+	if err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+// lines sends a command and reads its multi line response
+func (c *pop3Client) lines(format string, args ...interface{}) ([]string, error) {
+	_, err := c.cmd(format, args...)
+	if err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotLines()
+}
+
+// capabilities returns the capabilities of the server, servers without CAPA have none
+func (c *pop3Client) capabilities() (map[string]bool, error) {
+	lines, err := c.lines("CAPA")
+	if _, ok := err.(pop3Error); ok {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		caps[strings.ToUpper(fields[0])] = true
+		// SASL mechanisms are announced as "SASL PLAIN XOAUTH2"
+		for _, f := range fields[1:] {
+			caps[strings.ToUpper(fields[0]+" "+f)] = true
+		}
+	}
+	return caps, nil
+}
+
+// startTLS upgrades the connection using STLS
+func (c *pop3Client) startTLS(conf *tls.Config) error {
+	caps, err := c.capabilities()
+	if err != nil {
+		return err
+	}
+	if !caps["STLS"] {
+		return fmt.Errorf("server does not support STLS")
+	}
+	_, err = c.cmd("STLS")
+	if err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, conf)
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	return nil
+}
+
+func (c *pop3Client) login(username, password string) error {
+	_, err := c.cmd("USER %s", username)
+	if err != nil {
+		return err
+	}
+	_, err = c.cmd("PASS %s", password)
+	return err
+}
+
+// authenticate runs a SASL exchange using AUTH
+func (c *pop3Client) authenticate(auth sasl.Client) error {
+	mech, ir, err := auth.Start()
+	if err != nil {
+		return err
+	}
+	resp := "="
+	if len(ir) > 0 {
+		resp = base64.StdEncoding.EncodeToString(ir)
+	}
+	err = c.text.PrintfLine("AUTH %s %s", mech, resp)
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != "+" && !strings.HasPrefix(line, "+ ") {
+			_, err = parsePOP3Response(line)
+			return err
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return err
+		}
+		answer, err := auth.Next(challenge)
+		if err != nil {
+			// cancel the exchange
+			c.cmd("*")
+			return err
+		}
+		err = c.text.PrintfLine("%s", base64.StdEncoding.EncodeToString(answer))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// uidl lists all messages of the maildrop
+func (c *pop3Client) uidl() ([]pop3Message, error) {
+	lines, err := c.lines("UIDL")
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]pop3Message, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("pop3: invalid UIDL response: %s", line)
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("pop3: invalid UIDL response: %s", line)
+		}
+		msgs = append(msgs, pop3Message{Number: n, UID: fields[1]})
+	}
+	return msgs, nil
+}
+
+// retr returns the raw message
+func (c *pop3Client) retr(n int) ([]byte, error) {
+	_, err := c.cmd("RETR %d", n)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(c.text.DotReader())
+}
+
+// dele marks a message as deleted, it is removed once the session ends using quit
+func (c *pop3Client) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+// quit ends the session and closes the connection
+func (c *pop3Client) quit() error {
+	_, err := c.cmd("QUIT")
+	c.conn.Close()
+	return err
+}
+
+// watchConn closes the connection once ctx is cancelled, which aborts the running command
+// stop has to be called after the connection is not used anymore
+func watchConn(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// connectPOP3 returns an authenticated POP3 session of a profile
+func (m Mail2Most) connectPOP3(ctx context.Context, profile int) (*pop3Client, error) {
+	server := m.Config.Profiles[profile].Mail.Pop3Server
+	mode := m.tlsMode(profile)
+
+	var tlsconf *tls.Config
+	switch mode {
+	case TLSIMPLICIT, TLSSTARTTLS:
+		var err error
+		tlsconf, err = m.tlsConfig(profile, server)
+		if err != nil {
+			return nil, err
+		}
+	case TLSNONE:
+	default:
+		return nil, fmt.Errorf("unknown tls mode: %s", mode)
+	}
+
+	conn, err := contextDialer{ctx: ctx}.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	if mode == TLSIMPLICIT {
+		conn = tls.Client(conn, tlsconf)
+	}
+
+	stop := watchConn(ctx, conn)
+	c, err := newPOP3Client(conn)
+	if err == nil && mode == TLSSTARTTLS {
+		err = c.startTLS(tlsconf)
+	}
+	if err == nil {
+		err = m.authenticatePOP3(ctx, c, profile)
+	}
+	stop()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m.Debug("mailserver", map[string]interface{}{
+		"status": "connected",
+		"server": server,
+	})
+	return c, nil
+}
+
+// authenticatePOP3 logs in using the authentication mechanism of the profile
+func (m Mail2Most) authenticatePOP3(ctx context.Context, c *pop3Client, profile int) error {
+	mail := m.Config.Profiles[profile].Mail
+	switch mail.Auth {
+	case "", AUTHLOGIN:
+		return c.login(mail.Username, mail.Password)
+	case AUTHXOAUTH2, AUTHOAUTHBEARER:
+		auth, err := m.oauth2Client(ctx, profile)
+		if err != nil {
+			return err
+		}
+		err = c.authenticate(auth)
+		if err != nil {
+			m.invalidateToken(profile)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown auth mechanism: %s", mail.Auth)
+	}
+}
+
+// getPOP3Mail returns the mails of the maildrop of a profile not examined yet according to the state
+// mails are identified by their UIDL, mails not passing the filters are returned in the folder sync
+// so they are not downloaded again
+func (m Mail2Most) getPOP3Mail(ctx context.Context, profile int, state StateStore) ([]Mail, []folderSync, error) {
+	c, err := m.connectPOP3(ctx, profile)
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	stop := watchConn(ctx, c.conn)
+	defer stop()
+
+	mails, sync, err := m.fetchPOP3Mails(c, profile, state)
+	if err != nil {
+		c.conn.Close()
+	} else {
+		// no message was deleted so QUIT does not change the maildrop
+		err = c.quit()
+	}
+	if ctx.Err() != nil {
+		return []Mail{}, nil, ctx.Err()
+	}
+	if err != nil {
+		return []Mail{}, nil, err
+	}
+	return mails, []folderSync{sync}, nil
+}
+
+func (m Mail2Most) fetchPOP3Mails(c *pop3Client, profile int, state StateStore) ([]Mail, folderSync, error) {
+	uidl, err := c.uidl()
+	if err != nil {
+		return nil, folderSync{}, err
+	}
+	msgs := make([]sourceMessage, 0, len(uidl))
+	for _, msg := range uidl {
+		n := msg.Number
+		msgs = append(msgs, sourceMessage{id: msg.UID, read: func() (io.Reader, error) {
+			raw, err := c.retr(n)
+			return bytes.NewReader(raw), err
+		}})
+	}
+	return m.fetchSourceMails(profile, state, msgs)
+}
+
+// runPOP3Actions deletes the mails of a POP3 profile if the action deletes mails, other actions are not supported by POP3
+func (m Mail2Most) runPOP3Actions(ctx context.Context, profile int, mails []Mail, action mailAction) error {
+	if !action.Delete || len(mails) == 0 {
+		return nil
+	}
+	c, err := m.connectPOP3(ctx, profile)
+	if err != nil {
+		return err
+	}
+	stop := watchConn(ctx, c.conn)
+	defer stop()
+
+	err = m.deletePOP3Mails(c, mails)
+	if err != nil {
+		// the deletions are dropped by the server if the session does not end with QUIT
+		c.conn.Close()
+		return err
+	}
+	return c.quit()
+}
+
+func (m Mail2Most) deletePOP3Mails(c *pop3Client, mails []Mail) error {
+	msgs, err := c.uidl()
+	if err != nil {
+		return err
+	}
+	numbers := make(map[string]int, len(msgs))
+	for _, msg := range msgs {
+		numbers[msg.UID] = msg.Number
+	}
+	for _, mail := range mails {
+		// the mail might have been deleted by another client in the meantime
+		n, ok := numbers[mail.SourceID]
+		if !ok {
+			continue
+		}
+		err = c.dele(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
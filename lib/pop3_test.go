@@ -0,0 +1,372 @@
+package mail2most
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPOP3Server serves a single maildrop to the user "username" with the password "password"
+type testPOP3Server struct {
+	mu    sync.Mutex
+	uids  []string
+	mails map[string]string
+	retrs int
+	// starttls offers STLS if set
+	starttls *tls.Config
+	// token is the accepted XOAUTH2 access token
+	token string
+}
+
+func (s *testPOP3Server) add(uid, mail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mails == nil {
+		s.mails = make(map[string]string)
+	}
+	s.uids = append(s.uids, uid)
+	s.mails[uid] = mail
+}
+
+// newTestPOP3Server starts the server, connections use implicit tls if tlsconf is set
+func newTestPOP3Server(t *testing.T, s *testPOP3Server, tlsconf *tls.Config) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsconf != nil {
+		l = tls.NewListener(l, tlsconf)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func (s *testPOP3Server) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("+OK ready")
+
+	var (
+		user    string
+		uids    []string
+		deleted = make(map[int]bool)
+	)
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			text.PrintfLine("-ERR empty command")
+			continue
+		}
+		arg := func(i int) string {
+			if len(fields) > i {
+				return fields[i]
+			}
+			return ""
+		}
+		// message numbers are fixed once the maildrop was opened
+		message := func() (string, int) {
+			n, err := strconv.Atoi(arg(1))
+			if err != nil || n < 1 || n > len(uids) || deleted[n] {
+				return "", 0
+			}
+			return uids[n-1], n
+		}
+		login := func() {
+			s.mu.Lock()
+			uids = append([]string(nil), s.uids...)
+			s.mu.Unlock()
+			text.PrintfLine("+OK maildrop locked")
+		}
+
+		switch cmd := strings.ToUpper(fields[0]); {
+		case cmd == "CAPA":
+			text.PrintfLine("+OK")
+			caps := []string{"USER", "UIDL", "SASL XOAUTH2"}
+			if s.starttls != nil {
+				caps = append(caps, "STLS")
+			}
+			for _, c := range caps {
+				text.PrintfLine(c)
+			}
+			text.PrintfLine(".")
+		case cmd == "STLS" && s.starttls != nil:
+			text.PrintfLine("+OK begin tls")
+			tlsConn := tls.Server(conn, s.starttls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+		case cmd == "USER":
+			user = arg(1)
+			text.PrintfLine("+OK")
+		case cmd == "PASS":
+			if user != "username" || arg(1) != "password" {
+				text.PrintfLine("-ERR invalid login")
+				continue
+			}
+			login()
+		case cmd == "AUTH" && arg(1) == AUTHXOAUTH2NAME:
+			ir, _ := base64.StdEncoding.DecodeString(arg(2))
+			if s.token == "" || !strings.Contains(string(ir), "auth=Bearer "+s.token+"\x01") {
+				text.PrintfLine("+ %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401"}`)))
+				text.ReadLine()
+				text.PrintfLine("-ERR invalid token")
+				continue
+			}
+			login()
+		case uids == nil:
+			text.PrintfLine("-ERR not authenticated")
+		case cmd == "UIDL":
+			text.PrintfLine("+OK")
+			for i, uid := range uids {
+				if !deleted[i+1] {
+					text.PrintfLine("%d %s", i+1, uid)
+				}
+			}
+			text.PrintfLine(".")
+		case cmd == "RETR":
+			uid, _ := message()
+			if uid == "" {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+			s.mu.Lock()
+			s.retrs++
+			mail := s.mails[uid]
+			s.mu.Unlock()
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			fmt.Fprint(w, mail)
+			w.Close()
+		case cmd == "DELE":
+			_, n := message()
+			if n == 0 {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+			deleted[n] = true
+			text.PrintfLine("+OK")
+		case cmd == "QUIT":
+			s.mu.Lock()
+			for n := range deleted {
+				delete(s.mails, uids[n-1])
+			}
+			s.uids = s.uids[:0]
+			for _, uid := range uids {
+				if _, ok := s.mails[uid]; ok {
+					s.uids = append(s.uids, uid)
+				}
+			}
+			s.mu.Unlock()
+			text.PrintfLine("+OK bye")
+			return
+		default:
+			text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+// testPOP3Profile points profile 0 to the test pop3 server
+func testPOP3Profile(m2m *Mail2Most, addr string) {
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEPOP3, Pop3Server: addr, Username: "username", Password: "password"}
+	m2m.Config.Profiles[0].Filter = filter{}
+	m2m.Config.Profiles[0].Mattermost.URL = "http://127.0.0.1:1"
+}
+
+func testPOP3Mail(from, subject string) string {
+	return "From: " + from + "\r\nTo: bob@example.com\r\nSubject: " + subject +
+		"\r\nDate: Sat, 18 Jun 2016 12:00:00 +0900\r\nContent-Type: text/plain\r\n\r\n" +
+		".line starting with a dot\r\n" + subject + "\r\n"
+}
+
+func TestPOP3(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+
+	s := &testPOP3Server{}
+	s.add("uidl-1", testPOP3Mail("Alice <alice@example.com>", "hello"))
+	s.add("uidl-2", testPOP3Mail("carol@example.com", "other"))
+	addr, stop := newTestPOP3Server(t, s, nil)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.Outbox.Path = dir + "/outbox"
+	testPOP3Profile(&m2m, addr)
+	m2m.Config.Profiles[0].Filter.Subject = []string{"hello"}
+	assert.Nil(t, m2m.checkSource(0))
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "uidl-1", mails[0].SourceID)
+		assert.Equal(t, "hello", mails[0].Subject)
+		assert.Equal(t, ".line starting with a dot\nhello", mails[0].Body)
+		assert.Equal(t, "Alice", mails[0].From[0].PersonalName)
+		assert.Equal(t, "alice", mails[0].From[0].MailboxName)
+		assert.Equal(t, "example.com", mails[0].From[0].HostName)
+	}
+
+	state, err := m2m.openJSONStateStore(dir + "/data.json")
+	assert.Nil(t, err)
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+
+	// the mail is queued in the outbox, the other mail does not pass the filter
+	err = m2m.processProfile(context.Background(), nil, 0, state, o)
+	assert.Nil(t, err)
+	pending, err := o.list(false)
+	assert.Nil(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, "uidl-1", pending[0].Mail.SourceID)
+	}
+
+	// known mails are not downloaded again
+	s.retrs = 0
+	mails, _, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 0)
+	assert.Equal(t, 0, s.retrs)
+
+	s.add("uidl-3", testPOP3Mail("alice@example.com", "hello again"))
+	mails, _, err = m2m.getMail(context.Background(), 0, state)
+	assert.Nil(t, err)
+	if assert.Len(t, mails, 1) {
+		assert.Equal(t, "uidl-3", mails[0].SourceID)
+	}
+	assert.Equal(t, 1, s.retrs)
+
+	// delete after post
+	err = m2m.runActions(context.Background(), 0, mails, mailAction{Delete: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"uidl-1", "uidl-2"}, s.uids)
+
+	m2m.Config.Profiles[0].Mail.Password = "wrong"
+	_, err = m2m.GetMail(0)
+	assert.NotNil(t, err)
+}
+
+func TestPOP3Auth(t *testing.T) {
+	s := &testPOP3Server{token: "token"}
+	s.add("uidl-1", testPOP3Mail("alice@example.com", "hello"))
+	addr, stop := newTestPOP3Server(t, s, nil)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testPOP3Profile(&m2m, addr)
+	m2m.Config.Profiles[0].Mail.Auth = AUTHXOAUTH2
+	m2m.Config.Profiles[0].Mail.OAuth2.AccessToken = "token"
+
+	mails, err := m2m.GetMail(0)
+	assert.Nil(t, err)
+	assert.Len(t, mails, 1)
+
+	m2m.Config.Profiles[0].Mail.OAuth2.AccessToken = "revoked"
+	_, err = m2m.GetMail(0)
+	assert.NotNil(t, err)
+}
+
+func TestPOP3TLS(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	ca, caKey := testCertificate(t, dir, "ca", nil, nil)
+	testCertificate(t, dir, "server", ca, caKey)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+	tlsconf := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	for _, mode := range []string{TLSSTARTTLS, TLSIMPLICIT} {
+		s := &testPOP3Server{}
+		s.add("uidl-1", testPOP3Mail("alice@example.com", "hello"))
+		var addr string
+		var stop func()
+		if mode == TLSSTARTTLS {
+			// STLS is only offered if the server has a certificate
+			addr, stop = newTestPOP3Server(t, s, nil)
+			testPOP3Profile(&m2m, addr)
+			m2m.Config.Profiles[0].Mail.TLSMode = mode
+			_, err = m2m.GetMail(0)
+			assert.NotNil(t, err)
+			stop()
+
+			s.starttls = tlsconf
+			addr, stop = newTestPOP3Server(t, s, nil)
+		} else {
+			addr, stop = newTestPOP3Server(t, s, tlsconf)
+		}
+		testPOP3Profile(&m2m, addr)
+		m2m.Config.Profiles[0].Mail.TLSMode = mode
+		m2m.Config.Profiles[0].Mail.VerifyTLS = true
+		m2m.Config.Profiles[0].Mail.CAFile = filepath.Join(dir, "ca.crt")
+
+		mails, err := m2m.GetMail(0)
+		assert.Nil(t, err, mode)
+		assert.Len(t, mails, 1, mode)
+		stop()
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	assert.Nil(t, m2m.checkSource(0))
+
+	testPOP3Profile(&m2m, "127.0.0.1:110")
+	m2m.Config.Profiles[0].Mail.OnSuccess = mailAction{Delete: true}
+	assert.Nil(t, m2m.checkSource(0))
+	assert.Equal(t, "127.0.0.1:110", m2m.mailServer(0))
+
+	// pruning the state of mails kept in the source would post them again
+	m2m.Config.General.StateRetention = "24h"
+	assert.Nil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.ReadOnly = true
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.ReadOnly = false
+	m2m.Config.Profiles[0].Mail.OnSuccess = mailAction{}
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.Source = SOURCEMBOX
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCERECEIVER}
+	assert.Nil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.Source = SOURCEIMAP
+	assert.Nil(t, m2m.checkSource(0))
+	m2m.Config.General.StateRetention = ""
+	testPOP3Profile(&m2m, "127.0.0.1:110")
+
+	m2m.Config.Profiles[0].Mail.OnFailure = mailAction{Move: "Archive"}
+	assert.NotNil(t, m2m.checkSource(0))
+
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCEPOP3}
+	assert.NotNil(t, m2m.checkSource(0))
+
+	m2m.Config.Profiles[0].Mail = maildata{Source: "foo"}
+	assert.NotNil(t, m2m.checkSource(0))
+}
@@ -0,0 +1,386 @@
+package mail2most
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errDeliveryFailed asks the mail server to queue the mail and retry later
+var errDeliveryFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "mattermost delivery failed, try again later",
+}
+
+// errInvalidMessage rejects mails which can not be parsed
+var errInvalidMessage = &smtp.SMTPError{
+	Code:         554,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+	Message:      "invalid message",
+}
+
+// errLocalError asks the mail server to retry after the state could not be read
+var errLocalError = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "local error, try again later",
+}
+
+// errQuietHours asks the mail server to hold the mail until the quiet hours of the profile ended
+var errQuietHours = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "quiet hours, try again later",
+}
+
+// errUnknownRecipient rejects recipients not configured for any profile
+var errUnknownRecipient = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "unknown recipient",
+}
+
+// receiver is the smtp or lmtp server mails are delivered to by the mail server
+type receiver struct {
+	m      Mail2Most
+	ctx    context.Context
+	state  StateStore
+	server *smtp.Server
+	addr   net.Addr
+}
+
+// receiverSession is a single smtp transaction
+type receiverSession struct {
+	r        *receiver
+	rcpts    []string
+	profiles []int
+}
+
+// receiverLog forwards the errors of the smtp server to the logger
+type receiverLog struct {
+	m Mail2Most
+}
+
+func (l receiverLog) Printf(format string, v ...interface{}) {
+	l.m.Error("receiver error", map[string]interface{}{"error": fmt.Sprintf(format, v...)})
+}
+
+func (l receiverLog) Println(v ...interface{}) {
+	l.m.Error("receiver error", map[string]interface{}{"error": strings.TrimSuffix(fmt.Sprintln(v...), "\n")})
+}
+
+// recipientProfile returns the profile receiving mails for an address
+func (m Mail2Most) recipientProfile(address string) (int, bool) {
+	for p := range m.Config.Profiles {
+		if m.source(p) != SOURCERECEIVER {
+			continue
+		}
+		for _, rcpt := range m.Config.Profiles[p].Mail.Recipients {
+			if strings.EqualFold(rcpt, address) {
+				return p, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// listen opens the listener of the receiver, existing unix sockets are replaced
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// startReceiver accepts mails for the recipients of the receiver profiles until it is closed
+// the mails are posted using ctx
+func (m Mail2Most) startReceiver(ctx context.Context, state StateStore) (*receiver, error) {
+	conf := m.Config.Receiver
+	var recipients int
+	for p := range m.Config.Profiles {
+		if m.source(p) == SOURCERECEIVER {
+			recipients += len(m.Config.Profiles[p].Mail.Recipients)
+		}
+	}
+	if recipients == 0 {
+		return nil, fmt.Errorf("receiver: no profile with the receiver source defines Recipients")
+	}
+
+	r := &receiver{m: m, ctx: ctx, state: state}
+	r.server = smtp.NewServer(r)
+	r.server.Domain = conf.Domain
+	if r.server.Domain == "" {
+		r.server.Domain = "localhost"
+	}
+	r.server.MaxMessageBytes = conf.MaxMessageBytes
+	r.server.AuthDisabled = true
+	r.server.ErrorLog = receiverLog{m}
+	switch conf.Protocol {
+	case "", RECEIVERSMTP:
+	case RECEIVERLMTP:
+		r.server.LMTP = true
+	default:
+		return nil, fmt.Errorf("receiver: unknown protocol: %s", conf.Protocol)
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		r.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	l, err := listen(conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+	r.addr = l.Addr()
+	m.Info("receiver listening", map[string]interface{}{
+		"address":  r.addr.String(),
+		"protocol": conf.Protocol,
+	})
+	go r.server.Serve(l)
+	return r, nil
+}
+
+// Close stops accepting mails and closes all connections
+func (r *receiver) Close() error {
+	return r.server.Close()
+}
+
+// Login is not supported, the receiver is meant to be used by the local mail server
+func (r *receiver) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// AnonymousLogin starts a transaction
+func (r *receiver) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return &receiverSession{r: r}, nil
+}
+
+func (s *receiverSession) Reset() {
+	s.rcpts, s.profiles = nil, nil
+}
+
+func (s *receiverSession) Logout() error {
+	return nil
+}
+
+func (s *receiverSession) Mail(from string, opts smtp.MailOptions) error {
+	return nil
+}
+
+func (s *receiverSession) Rcpt(to string) error {
+	p, ok := s.r.m.recipientProfile(to)
+	if !ok {
+		return errUnknownRecipient
+	}
+	s.rcpts = append(s.rcpts, to)
+	s.profiles = append(s.profiles, p)
+	return nil
+}
+
+// Data delivers the mail to the profiles of all recipients, the mail is retried by the mail server if any delivery failed
+// profiles, channels and users which received the mail already are skipped on the retry
+func (s *receiverSession) Data(r io.Reader) error {
+	var failed error
+	err := s.deliver(r, func(p int, err error) {
+		if err != nil {
+			failed = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return failed
+}
+
+// LMTPData reports the delivery status of every recipient
+func (s *receiverSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	return s.deliver(r, func(p int, err error) {
+		for i, rcpt := range s.rcpts {
+			if s.profiles[i] == p {
+				status.SetStatus(rcpt, err)
+			}
+		}
+	})
+}
+
+// deliver posts the mail once per profile of the recipients and reports the result of every profile
+func (s *receiverSession) deliver(r io.Reader, result func(p int, err error)) error {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	done := make(map[int]bool)
+	for _, p := range s.profiles {
+		if done[p] {
+			continue
+		}
+		done[p] = true
+		err = s.r.m.deliver(s.r.ctx, p, raw, s.r.state)
+		if _, ok := err.(*smtp.SMTPError); err != nil && !ok {
+			s.r.m.Error("receiver error", map[string]interface{}{
+				"error":   err,
+				"profile": s.r.m.Config.Profiles[p].Name,
+			})
+			err = errLocalError
+		}
+		result(p, err)
+	}
+	return nil
+}
+
+// deliver posts a raw mail to the mattermost of a profile, mails delivered before are skipped using the Message-Id
+// mails not passing the filters are accepted without posting them, during quiet hours the mail server holds the mail
+// the channels and users a failed mail was posted to are stored, so the retry of the mail server skips them
+// the returned smtp errors tell whether the delivery should be retried
+func (m Mail2Most) deliver(ctx context.Context, profile int, raw []byte, state StateStore) error {
+	key := StateKey{Profile: m.Config.Profiles[profile].Name, Folder: sourceFolder}
+	id := messageID(raw)
+	if state != nil {
+		sent, err := state.SentID(key, id)
+		if err != nil {
+			return err
+		}
+		if sent {
+			m.Debug("mail", map[string]interface{}{
+				"status":     "already send",
+				"message-id": id,
+			})
+			return nil
+		}
+	}
+
+	mail, ok, err := m.parseMail(bytes.NewReader(raw), profile)
+	if err != nil {
+		return errInvalidMessage
+	}
+	mail.Folder = sourceFolder
+	mail.SourceID = id
+	if ok {
+		ok, err = m.checkFilters(profile, mail)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		m.Debug("message not passing the filter", map[string]interface{}{"subject": mail.Subject, "id": id})
+	} else {
+		if m.quiet(profile, time.Now()) {
+			m.Debug("quiet hours", map[string]interface{}{
+				"profile":    m.Config.Profiles[profile].Name,
+				"message-id": id,
+			})
+			return errQuietHours
+		}
+		done, err := m.deliveredDestinations(state, key, profile, id)
+		if err != nil {
+			return err
+		}
+		err = m.postMattermost(ctx, profile, mail, state, &done)
+		if err != nil {
+			m.Error("Mattermost Error", map[string]interface{}{
+				"Error":   err,
+				"profile": m.Config.Profiles[profile].Name,
+			})
+			serr := m.markDestinations(state, key, id, done)
+			if serr != nil {
+				m.Error("state error", map[string]interface{}{
+					"error":      serr,
+					"message-id": id,
+				})
+			}
+			// smtp sessions answer config errors with a local error as well
+			if isConfigError(err) {
+				return err
+			}
+			return errDeliveryFailed
+		}
+		m.Info("mail delivered", map[string]interface{}{
+			"subject": mail.Subject,
+			"profile": m.Config.Profiles[profile].Name,
+		})
+	}
+
+	if state == nil {
+		return nil
+	}
+	// the mail is posted already, a retry would post it twice
+	err = state.MarkSentID(key, id)
+	if err != nil {
+		m.Error("state error", map[string]interface{}{
+			"error":      err,
+			"message-id": id,
+		})
+	}
+	return nil
+}
+
+// destinationID is the state id of a channel or user a mail was posted to before its delivery failed
+func destinationID(id, kind, name string) string {
+	return id + " " + kind + ":" + name
+}
+
+// deliveredDestinations returns the channels and users of a profile an earlier delivery of the mail was posted to
+func (m Mail2Most) deliveredDestinations(state StateStore, key StateKey, profile int, id string) (Destinations, error) {
+	var done Destinations
+	if state == nil {
+		return done, nil
+	}
+	for _, channel := range m.Config.Profiles[profile].Mattermost.Channels {
+		sent, err := state.SentID(key, destinationID(id, "channel", channel))
+		if err != nil {
+			return done, err
+		}
+		if sent {
+			done.Channels = append(done.Channels, channel)
+		}
+	}
+	for _, user := range m.Config.Profiles[profile].Mattermost.Users {
+		sent, err := state.SentID(key, destinationID(id, "user", user))
+		if err != nil {
+			return done, err
+		}
+		if sent {
+			done.Users = append(done.Users, user)
+		}
+	}
+	return done, nil
+}
+
+// markDestinations stores the channels and users a mail was posted to, they are pruned like the mail itself
+func (m Mail2Most) markDestinations(state StateStore, key StateKey, id string, done Destinations) error {
+	if state == nil {
+		return nil
+	}
+	for _, d := range []struct {
+		kind  string
+		names []string
+	}{{"channel", done.Channels}, {"user", done.Users}} {
+		for _, name := range d.names {
+			err := state.MarkSentID(key, destinationID(id, d.kind, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package mail2most
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func testReceiverMail(id, subject string) string {
+	return "Message-Id: <" + id + "@example.com>\r\n" + testPOP3Mail("alice@example.com", subject)
+}
+
+// testReceiverProfiles lets profile 0 receive alerts@example.com and post them to mm,
+// mails for ops@example.com received by profile 1 can not be posted
+func testReceiverProfiles(t *testing.T, m2m *Mail2Most, mm *testMattermost) StateStore {
+	dir := filet.TmpDir(t, "")
+	m2m.Config.Profiles[0].Mail = maildata{Source: SOURCERECEIVER, Recipients: []string{"alerts@example.com"}}
+	m2m.Config.Profiles[0].Filter = filter{Subject: []string{"alert"}}
+	testMattermostProfile(m2m, mm)
+	m2m.Config.Profiles[1].Mail = maildata{Source: SOURCERECEIVER, Recipients: []string{"ops@example.com"}}
+	m2m.Config.Profiles[1].Filter = filter{}
+	m2m.Config.Profiles[1].Mattermost.URL = "http://127.0.0.1:1"
+
+	state, err := m2m.openJSONStateStore(filepath.Join(dir, "data.json"))
+	assert.Nil(t, err)
+	return state
+}
+
+func sendTestMail(c *smtp.Client, mail string, to ...string) error {
+	err := c.Mail("bob@example.com", nil)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		err = c.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, mail)
+	return w.Close()
+}
+
+func TestReceiver(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	state := testReceiverProfiles(t, &m2m, mm)
+	assert.Nil(t, m2m.checkSource(0))
+	assert.False(t, m2m.polling(nil, 0))
+
+	m2m.Config.Receiver.Listen = "127.0.0.1:0"
+	m2m.Config.Receiver.Protocol = "foo"
+	_, err = m2m.startReceiver(context.Background(), state)
+	assert.NotNil(t, err)
+	m2m.Config.Receiver.Protocol = ""
+	r, err := m2m.startReceiver(context.Background(), state)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer r.Close()
+
+	c, err := smtp.Dial(r.addr.String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	err = sendTestMail(c, testReceiverMail("1", "alert"), "Alerts@example.com")
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 1)
+
+	// retries of the mail server are not posted twice
+	err = sendTestMail(c, testReceiverMail("1", "alert"), "alerts@example.com")
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 1)
+
+	// mails not passing the filters are accepted
+	err = sendTestMail(c, testReceiverMail("2", "other"), "alerts@example.com")
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 1)
+
+	err = sendTestMail(c, testReceiverMail("3", "alert"), "unknown@example.com")
+	if assert.IsType(t, &smtp.SMTPError{}, err) {
+		assert.Equal(t, 550, err.(*smtp.SMTPError).Code)
+	}
+	assert.Nil(t, c.Reset())
+
+	// one failed delivery lets the mail server retry the mail
+	err = sendTestMail(c, testReceiverMail("4", "alert"), "alerts@example.com", "ops@example.com")
+	if assert.IsType(t, &smtp.SMTPError{}, err) {
+		assert.Equal(t, 451, err.(*smtp.SMTPError).Code)
+	}
+	assert.Len(t, mm.messages(), 2)
+
+	err = sendTestMail(c, "foo", "alerts@example.com")
+	if assert.IsType(t, &smtp.SMTPError{}, err) {
+		assert.Equal(t, 554, err.(*smtp.SMTPError).Code)
+	}
+	assert.Nil(t, c.Reset())
+
+	// the retry only posts to the channels which failed before
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#broken-channel", "#some-channel"}
+	mm.mu.Lock()
+	mm.failing["channel-broken-channel"] = true
+	mm.mu.Unlock()
+	err = sendTestMail(c, testReceiverMail("5", "alert"), "alerts@example.com")
+	if assert.IsType(t, &smtp.SMTPError{}, err) {
+		assert.Equal(t, 451, err.(*smtp.SMTPError).Code)
+	}
+	assert.Nil(t, c.Reset())
+	assert.Len(t, mm.messages(), 3)
+	mm.mu.Lock()
+	mm.failing["channel-broken-channel"] = false
+	mm.mu.Unlock()
+	err = sendTestMail(c, testReceiverMail("5", "alert"), "alerts@example.com")
+	assert.Nil(t, err)
+	assert.Len(t, mm.messages(), 4)
+	assert.Equal(t, "channel-broken-channel", mm.posts[3]["channel_id"])
+}
+
+func TestReceiverQuietHours(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	state := testReceiverProfiles(t, &m2m, mm)
+
+	// the mail server holds mails during quiet hours
+	now := time.Now().UTC()
+	quiet := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")
+	m2m.Config.Profiles[0].Schedule = schedule{TimeZone: "UTC", QuietHours: []string{quiet}}
+	raw := []byte(testReceiverMail("1", "alert"))
+	assert.Equal(t, errQuietHours, m2m.deliver(context.Background(), 0, raw, state))
+	assert.Len(t, mm.messages(), 0)
+
+	m2m.Config.Profiles[0].Schedule = schedule{}
+	assert.Nil(t, m2m.deliver(context.Background(), 0, raw, state))
+	assert.Len(t, mm.messages(), 1)
+}
+
+func TestReceiverLMTP(t *testing.T) {
+	defer filet.CleanUp(t)
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	state := testReceiverProfiles(t, &m2m, mm)
+	m2m.Config.Receiver.Listen = "unix:" + filepath.Join(filet.TmpDir(t, ""), "lmtp.sock")
+	m2m.Config.Receiver.Protocol = RECEIVERLMTP
+
+	r, err := m2m.startReceiver(context.Background(), state)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("unix", r.addr.String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	c, err := smtp.NewClientLMTP(conn, "localhost")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.Nil(t, c.Hello("localhost"))
+	assert.Nil(t, c.Mail("bob@example.com", nil))
+	assert.Nil(t, c.Rcpt("alerts@example.com"))
+	assert.Nil(t, c.Rcpt("ops@example.com"))
+	status := make(map[string]int)
+	w, err := c.LMTPData(func(rcpt string, err *smtp.SMTPError) {
+		status[rcpt] = 250
+		if err != nil {
+			status[rcpt] = err.Code
+		}
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	fmt.Fprint(w, testReceiverMail("1", "alert"))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, map[string]int{"alerts@example.com": 250, "ops@example.com": 451}, status)
+	assert.Len(t, mm.messages(), 1)
+
+	// the socket of a previous run is replaced
+	r.Close()
+	r, err = m2m.startReceiver(context.Background(), state)
+	assert.Nil(t, err)
+	r.Close()
+}
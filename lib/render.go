@@ -0,0 +1,133 @@
+package mail2most
+
+import (
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// defaultAttachmentTemplate renders the text of message attachments, the from line and subject are fields
+const defaultAttachmentTemplate = `{{if not .Options.SubjectOnly}}
+{{- if .Options.ConvertToMarkdown}}{{.Body}}{{else}}` + codeFence + `
+{{.Body}}` + codeFence + `{{end}}
+{{- end}}`
+
+// newPost returns the post of a rendered message, in the attachment render mode the message is the text
+// of a message attachment and fallback its plain text
+func (m Mail2Most) newPost(profile int, channelID, root, msg, fallback string, data postData) (*model.Post, error) {
+	conf := m.Config.Profiles[profile].Mattermost
+	switch conf.Render {
+	case "", RENDERTEXT:
+		return &model.Post{ChannelId: channelID, Message: msg, RootId: root}, nil
+	case RENDERATTACHMENT:
+		a, err := slackAttachment(conf, data, msg, fallback)
+		if err != nil {
+			return nil, err
+		}
+		var mentions string
+		for _, b := range conf.Broadcast {
+			if mentions != "" {
+				b += " "
+			}
+			mentions = b + mentions
+		}
+		post := &model.Post{ChannelId: channelID, Message: mentions, RootId: root}
+		post.AddProp("attachments", []*model.SlackAttachment{a})
+		return post, nil
+	default:
+		return nil, configError{fmt.Errorf("unknown render mode: %s", conf.Render)}
+	}
+}
+
+// slackAttachment returns the message attachment of a mail with the from, to, cc, date and subject fields
+func slackAttachment(conf mattermost, data postData, text, fallback string) (*model.SlackAttachment, error) {
+	color, err := attachmentColor(conf, data.Mail)
+	if err != nil {
+		return nil, err
+	}
+	a := &model.SlackAttachment{Fallback: fallback, Color: color, Text: text, Footer: data.Profile}
+	if !conf.HideFrom {
+		a.AuthorName = data.Sender
+		from := formatAddresses(data.Mail.From)
+		if conf.HideFromEmail {
+			from = data.Sender
+		}
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{Title: "From", Value: from, Short: true})
+	}
+	if len(data.Mail.To) > 0 {
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{Title: "To", Value: formatAddresses(data.Mail.To), Short: true})
+	}
+	if len(data.Mail.Cc) > 0 {
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{Title: "Cc", Value: formatAddresses(data.Mail.Cc), Short: true})
+	}
+	if !data.Mail.Date.IsZero() {
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{Title: "Date", Value: data.Mail.Date.Format(time.RFC1123Z), Short: true})
+		a.Timestamp = data.Mail.Date.Unix()
+	}
+	if !conf.HideSubject {
+		a.Fields = append(a.Fields, &model.SlackAttachmentField{Title: "Subject", Value: data.Mail.Subject})
+	}
+	return a, nil
+}
+
+// attachmentColor returns the color of the first color rule matching the mail or the AttachmentColor
+func attachmentColor(conf mattermost, mail Mail) (string, error) {
+	for _, r := range conf.ColorRules {
+		ok, err := r.matches(mail)
+		if err != nil {
+			return "", configError{err}
+		}
+		if ok {
+			return r.Color, nil
+		}
+	}
+	return conf.AttachmentColor, nil
+}
+
+// matches checks if the subject and header of a mail match the rule
+func (r colorRule) matches(mail Mail) (bool, error) {
+	if r.Subject != "" {
+		ok, err := regexp.MatchString(r.Subject, mail.Subject)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if r.Header != "" {
+		values, ok := mail.Header[textproto.CanonicalMIMEHeaderKey(r.Header)]
+		if !ok {
+			return false, nil
+		}
+		if r.Value == "" {
+			return true, nil
+		}
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkColorRules compiles the regular expressions of the color rules of all profiles
+func checkColorRules(profiles []profile) error {
+	for _, p := range profiles {
+		for _, r := range p.Mattermost.ColorRules {
+			for _, expr := range []string{r.Subject, r.Value} {
+				_, err := regexp.Compile(expr)
+				if err != nil {
+					return fmt.Errorf("profile %s: ColorRules: %v", p.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
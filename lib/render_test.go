@@ -0,0 +1,97 @@
+package mail2most
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColorRules(t *testing.T) {
+	conf := mattermost{
+		AttachmentColor: "#cccccc",
+		ColorRules: []colorRule{
+			{Header: "x-priority", Value: "^[12]", Color: "#ff0000"},
+			{Subject: "(?i)resolved", Color: "#00ff00"},
+			{Subject: "(?i)^alert", Header: "X-Alert", Color: "#ffff00"},
+		},
+	}
+	for _, c := range []struct {
+		mail  Mail
+		color string
+	}{
+		{Mail{Subject: "disk full", Header: map[string][]string{"X-Priority": {"1 (Highest)"}}}, "#ff0000"},
+		{Mail{Subject: "disk full", Header: map[string][]string{"X-Priority": {"3 (Normal)"}}}, "#cccccc"},
+		{Mail{Subject: "Disk full RESOLVED"}, "#00ff00"},
+		{Mail{Subject: "Alert: disk full", Header: map[string][]string{"X-Alert": {""}}}, "#ffff00"},
+		{Mail{Subject: "Alert: disk full"}, "#cccccc"},
+	} {
+		color, err := attachmentColor(conf, c.mail)
+		assert.Nil(t, err)
+		assert.Equal(t, c.color, color, c.mail.Subject)
+	}
+
+	assert.Nil(t, checkColorRules([]profile{{Mattermost: conf}}))
+	assert.NotNil(t, checkColorRules([]profile{{Mattermost: mattermost{ColorRules: []colorRule{{Subject: "("}}}}}))
+}
+
+func TestRenderAttachment(t *testing.T) {
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Name = "alerts"
+	m2m.Config.Profiles[0].Mattermost.ConvertToMarkdown = false
+	m2m.Config.Profiles[0].Mattermost.StripHTML = false
+	m2m.Config.Profiles[0].Mattermost.HideFromEmail = false
+	m2m.Config.Profiles[0].Mattermost.Render = RENDERATTACHMENT
+	m2m.Config.Profiles[0].Mattermost.Broadcast = []string{"@here"}
+	m2m.Config.Profiles[0].Mattermost.ColorRules = []colorRule{{Header: "X-Priority", Value: "^1", Color: "#ff0000"}}
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mail := Mail{
+		Subject: "disk full",
+		Body:    "hello world\n",
+		Date:    date,
+		From:    []*imap.Address{imapAddress("Alice", "alice@example.com")},
+		To:      []*imap.Address{imapAddress("", "ops@example.com")},
+		Header:  map[string][]string{"X-Priority": {"1"}},
+	}
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+
+	mm.mu.Lock()
+	b, err := json.Marshal(mm.posts[0])
+	mm.mu.Unlock()
+	assert.Nil(t, err)
+	var post model.Post
+	assert.Nil(t, json.Unmarshal(b, &post))
+	assert.Equal(t, "@here", post.Message)
+	attachments := post.Attachments()
+	if assert.Len(t, attachments, 1) {
+		a := attachments[0]
+		assert.Equal(t, "#ff0000", a.Color)
+		assert.Equal(t, "Alice", a.AuthorName)
+		assert.Equal(t, "alerts", a.Footer)
+		assert.Equal(t, "```\nhello world\n```", a.Text)
+		assert.Contains(t, a.Fallback, "disk full")
+		assert.EqualValues(t, date.Unix(), a.Timestamp)
+		var fields []string
+		for _, f := range a.Fields {
+			fields = append(fields, f.Title+": "+f.Value.(string))
+		}
+		assert.Equal(t, []string{
+			"From: Alice <alice@example.com>",
+			"To: ops@example.com",
+			"Date: " + date.Format(time.RFC1123Z),
+			"Subject: disk full",
+		}, fields)
+	}
+
+	m2m.Config.Profiles[0].Mattermost.Render = "foo"
+	assert.NotNil(t, m2m.PostMattermost(0, mail))
+	assert.Len(t, mm.messages(), 1)
+}
@@ -0,0 +1,162 @@
+package mail2most
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// profileSchedule is the parsed Schedule of a profile
+type profileSchedule struct {
+	interval time.Duration
+	cron     cron.Schedule
+	location *time.Location
+	quiet    []quietHours
+}
+
+// quietHours is a daily window given in minutes since midnight, end may be before start to span midnight
+type quietHours struct {
+	start, end int
+}
+
+// schedule parses the Schedule of a profile
+// Profile.Schedule.Interval or Profile.Schedule.Cron overwrite General.TimeInterval
+func (m Mail2Most) schedule(profile int) (profileSchedule, error) {
+	conf := m.Config.Profiles[profile].Schedule
+	s := profileSchedule{
+		interval: time.Duration(m.Config.General.TimeInterval) * time.Second,
+		location: time.Local,
+	}
+
+	var err error
+	if conf.TimeZone != "" {
+		s.location, err = time.LoadLocation(conf.TimeZone)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	switch {
+	case conf.Interval != "" && conf.Cron != "":
+		return s, fmt.Errorf("profile %s: Schedule.Interval and Schedule.Cron can not be used together", m.Config.Profiles[profile].Name)
+	case conf.Interval != "":
+		s.interval, err = time.ParseDuration(conf.Interval)
+		if err != nil {
+			return s, err
+		}
+		// a profile checked all the time would keep the scheduler busy
+		if s.interval <= 0 {
+			return s, fmt.Errorf("profile %s: Schedule.Interval has to be positive", m.Config.Profiles[profile].Name)
+		}
+	case conf.Cron != "":
+		s.cron, err = cron.ParseStandard(conf.Cron)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	for _, w := range conf.QuietHours {
+		q, err := parseQuietHours(w)
+		if err != nil {
+			return s, err
+		}
+		s.quiet = append(s.quiet, q)
+	}
+	return s, nil
+}
+
+// parseQuietHours parses a window like "22:00-07:00"
+func parseQuietHours(window string) (quietHours, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return quietHours{}, fmt.Errorf("invalid quiet hours %q, expected HH:MM-HH:MM", window)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return quietHours{}, fmt.Errorf("invalid quiet hours %q: %s", window, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return quietHours{}, fmt.Errorf("invalid quiet hours %q, start and end are equal", window)
+	}
+	return quietHours{start: minutes[0], end: minutes[1]}, nil
+}
+
+// contains reports whether the time of day of t is inside the window
+func (q quietHours) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// until returns the end of the window containing t
+func (q quietHours) until(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// quietUntil returns the end of the quiet hours if now is inside of them
+// adjoining windows are joined
+func (s profileSchedule) quietUntil(now time.Time) (time.Time, bool) {
+	t := now.In(s.location)
+	quiet := false
+	// every window can extend the quiet time at most once
+	for i := 0; i <= len(s.quiet); i++ {
+		extended := false
+		for _, q := range s.quiet {
+			if q.contains(t) {
+				t = q.until(t)
+				quiet, extended = true, true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	return t, quiet
+}
+
+// quiet reports whether a profile is inside its quiet hours
+func (m Mail2Most) quiet(profile int, now time.Time) bool {
+	s, err := m.schedule(profile)
+	if err != nil {
+		return false
+	}
+	_, quiet := s.quietUntil(now)
+	return quiet
+}
+
+// first returns the time of the first check after mail2most started
+// profiles using Cron wait for their first cron time, all others are checked immediately
+func (s profileSchedule) first(now time.Time) time.Time {
+	if s.cron != nil {
+		return s.next(now)
+	}
+	return s.outsideQuietHours(now)
+}
+
+// next returns the time of the check following a check at now
+func (s profileSchedule) next(now time.Time) time.Time {
+	if s.cron != nil {
+		return s.outsideQuietHours(s.cron.Next(now.In(s.location)))
+	}
+	return s.outsideQuietHours(now.Add(s.interval))
+}
+
+// outsideQuietHours moves t to the end of the quiet hours
+func (s profileSchedule) outsideQuietHours(t time.Time) time.Time {
+	if end, quiet := s.quietUntil(t); quiet {
+		return end
+	}
+	return t
+}
@@ -0,0 +1,69 @@
+package mail2most
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.TimeInterval = 10
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	m2m.Config.Profiles[0].Schedule = schedule{}
+	s, err := m2m.schedule(0)
+	assert.Nil(t, err)
+	assert.Equal(t, now, s.first(now))
+	assert.Equal(t, now.Add(10*time.Second), s.next(now))
+
+	m2m.Config.Profiles[0].Schedule = schedule{Interval: "5m"}
+	s, err = m2m.schedule(0)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(5*time.Minute), s.next(now))
+
+	// cron profiles wait for their first cron time
+	m2m.Config.Profiles[0].Schedule = schedule{Cron: "30 6 * * *", TimeZone: "Europe/Berlin"}
+	s, err = m2m.schedule(0)
+	assert.Nil(t, err)
+	assert.True(t, time.Date(2020, 6, 2, 4, 30, 0, 0, time.UTC).Equal(s.first(now)))
+
+	// checks during the quiet hours are moved to their end
+	m2m.Config.Profiles[0].Schedule = schedule{Interval: "1h", TimeZone: "UTC", QuietHours: []string{"12:30-13:00", "13:00-14:00"}}
+	s, err = m2m.schedule(0)
+	assert.Nil(t, err)
+	assert.Equal(t, now, s.first(now))
+	assert.True(t, time.Date(2020, 6, 1, 14, 0, 0, 0, time.UTC).Equal(s.next(now)))
+	assert.False(t, m2m.quiet(0, now))
+	assert.True(t, m2m.quiet(0, now.Add(time.Hour)))
+
+	m2m.Config.Profiles[0].Schedule = schedule{TimeZone: "UTC", QuietHours: []string{"22:00-07:00"}}
+	s, err = m2m.schedule(0)
+	assert.Nil(t, err)
+	end, quiet := s.quietUntil(time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC))
+	assert.True(t, quiet)
+	assert.True(t, time.Date(2020, 6, 2, 7, 0, 0, 0, time.UTC).Equal(end))
+	end, quiet = s.quietUntil(time.Date(2020, 6, 2, 6, 59, 0, 0, time.UTC))
+	assert.True(t, quiet)
+	assert.True(t, time.Date(2020, 6, 2, 7, 0, 0, 0, time.UTC).Equal(end))
+	_, quiet = s.quietUntil(time.Date(2020, 6, 2, 7, 0, 0, 0, time.UTC))
+	assert.False(t, quiet)
+
+	for _, invalid := range []schedule{
+		{Interval: "foo"},
+		{Interval: "0s"},
+		{Interval: "-5m"},
+		{Cron: "foo"},
+		{Interval: "5m", Cron: "@daily"},
+		{TimeZone: "Nowhere/Nothing"},
+		{QuietHours: []string{"22:00"}},
+		{QuietHours: []string{"25:00-07:00"}},
+		{QuietHours: []string{"07:00-07:00"}},
+	} {
+		m2m.Config.Profiles[0].Schedule = invalid
+		_, err = m2m.schedule(0)
+		assert.NotNil(t, err, "%+v", invalid)
+	}
+}
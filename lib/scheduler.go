@@ -0,0 +1,277 @@
+package mail2most
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduler checks every profile on its own schedule using at most General.Workers profiles at once
+// a profile is never checked twice at the same time
+type scheduler struct {
+	m Mail2Most
+	// ctx is used for all requests, stop is closed once a shutdown was requested
+	ctx    context.Context
+	stop   <-chan struct{}
+	state  StateStore
+	outbox *outbox
+	idle   *idleWatchers
+
+	jobs chan int
+	done chan profileResult
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// the outbox is processed on its own goroutine so slow deliveries do not hold back the profiles
+	outboxRunning bool
+	outboxDone    chan error
+
+	schedules []profileSchedule
+	next      []time.Time
+	running   []bool
+	// pending is set if an idle notification arrived while the profile was checked
+	pending []bool
+	// held is set if an idle notification arrived during the quiet hours of the profile
+	held []bool
+}
+
+type profileResult struct {
+	profile int
+	err     error
+}
+
+func (m Mail2Most) newScheduler(ctx context.Context, state StateStore, outbox *outbox, idle *idleWatchers, schedules []profileSchedule) *scheduler {
+	n := len(m.Config.Profiles)
+	s := &scheduler{
+		m:          m,
+		ctx:        ctx,
+		state:      state,
+		outbox:     outbox,
+		idle:       idle,
+		jobs:       make(chan int, n),
+		done:       make(chan profileResult, n),
+		quit:       make(chan struct{}),
+		outboxDone: make(chan error, 1),
+		schedules:  schedules,
+		next:       make([]time.Time, n),
+		running:    make([]bool, n),
+		pending:    make([]bool, n),
+		held:       make([]bool, n),
+	}
+	now := time.Now()
+	for p := range s.next {
+		s.next[p] = schedules[p].first(now)
+	}
+	for i := 0; i < m.workers(); i++ {
+		go s.work()
+	}
+	return s
+}
+
+func (m Mail2Most) workers() int {
+	if m.Config.General.Workers > 0 {
+		return m.Config.General.Workers
+	}
+	return 4
+}
+
+// work checks the queued profiles until the scheduler stops
+func (s *scheduler) work() {
+	for p := range s.jobs {
+		var err error
+		select {
+		case <-s.quit:
+			// queued checks are dropped after the scheduler stopped
+		default:
+			err = s.m.processProfile(s.ctx, s.stop, p, s.state, s.outbox)
+		}
+		s.done <- profileResult{profile: p, err: err}
+		s.wg.Done()
+	}
+}
+
+// start queues the check of a profile, profiles are checked in the order they were queued
+func (s *scheduler) start(p int) {
+	s.running[p] = true
+	s.held[p] = false
+	s.wg.Add(1)
+	s.jobs <- p
+}
+
+// finish schedules the next check of a profile
+func (s *scheduler) finish(r profileResult) error {
+	s.running[r.profile] = false
+	if r.err != nil {
+		return r.err
+	}
+	s.next[r.profile] = s.schedules[r.profile].next(time.Now())
+	if s.pending[r.profile] {
+		s.pending[r.profile] = false
+		s.start(r.profile)
+	}
+	return nil
+}
+
+// due reports whether a profile has to be checked now
+// profiles using IDLE are only checked by the scheduler if a notification was held back during their quiet hours
+func (s *scheduler) due(p int, now time.Time) bool {
+	if s.running[p] || now.Before(s.next[p]) {
+		return false
+	}
+	return s.m.polling(s.idle, p) || s.held[p]
+}
+
+// notify checks a profile after its mailbox changed, during quiet hours the check is held back until they end
+func (s *scheduler) notify(p int) {
+	if end, quiet := s.schedules[p].quietUntil(time.Now()); quiet {
+		s.m.Debug("quiet hours", map[string]interface{}{
+			"profile": s.m.Config.Profiles[p].Name,
+			"until":   end,
+		})
+		s.held[p] = true
+		s.next[p] = end
+		return
+	}
+	if s.running[p] {
+		s.pending[p] = true
+		return
+	}
+	s.start(p)
+}
+
+// processOutbox starts retrying the due deliveries of the outbox
+func (s *scheduler) processOutbox() {
+	s.outboxRunning = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.outboxDone <- s.m.processOutbox(s.ctx, s.stop, s.outbox, s.state)
+	}()
+}
+
+// shutdown waits for the running checks and stops the workers
+func (s *scheduler) shutdown() {
+	close(s.quit)
+	s.wg.Wait()
+	close(s.jobs)
+}
+
+// run checks all profiles until an error occurs or ctx is cancelled, with General.NoLoop every profile is checked once
+func (s *scheduler) run(ctx context.Context) error {
+	m := s.m
+	var lastPrune, nextOutbox time.Time
+	s.stop = ctx.Done()
+	defer s.shutdown()
+
+	for {
+		if ctx.Err() != nil {
+			m.Info("shutting down", map[string]interface{}{
+				"status": "waiting for running checks",
+			})
+			return nil
+		}
+
+		now := time.Now()
+		if now.Sub(lastPrune) > time.Hour {
+			err := m.pruneState(s.state)
+			if err != nil {
+				return err
+			}
+			lastPrune = now
+		}
+
+		if !s.outboxRunning && !now.Before(nextOutbox) {
+			s.processOutbox()
+		}
+
+		// The user wishes this to be a run-once cycle (for use in serverless platforms)
+		// the external trigger replaces the schedule, only the quiet hours are kept
+		if m.Config.General.NoLoop {
+			for p := range m.Config.Profiles {
+				if m.source(p) == SOURCERECEIVER {
+					continue
+				}
+				if end, quiet := s.schedules[p].quietUntil(now); quiet {
+					m.Info("quiet hours", map[string]interface{}{
+						"profile": m.Config.Profiles[p].Name,
+						"until":   end,
+					})
+					continue
+				}
+				s.start(p)
+			}
+		} else {
+			for p := range m.Config.Profiles {
+				if s.due(p, now) {
+					s.start(p)
+				}
+			}
+		}
+
+		if m.Config.General.NoLoop {
+			var (
+				err     error
+				started int
+			)
+			for p := range s.running {
+				if s.running[p] {
+					started++
+				}
+			}
+			for ; started > 0; started-- {
+				r := <-s.done
+				s.running[r.profile] = false
+				if err == nil {
+					err = r.err
+				}
+			}
+			if oerr := <-s.outboxDone; err == nil {
+				err = oerr
+			}
+			s.outboxRunning = false
+			m.Debug("done", map[string]interface{}{
+				"noloop": true,
+			})
+			return err
+		}
+
+		// the next run of the outbox is scheduled once the running one finished
+		wake := nextOutbox
+		if s.outboxRunning {
+			wake = now.Add(time.Hour)
+		}
+		for p := range m.Config.Profiles {
+			if !s.running[p] && (m.polling(s.idle, p) || s.held[p]) && s.next[p].Before(wake) {
+				wake = s.next[p]
+			}
+		}
+		m.Debug("sleeping", map[string]interface{}{
+			"until": wake,
+		})
+
+		// profiles using IDLE are checked as soon as their mailbox changes
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case r := <-s.done:
+			timer.Stop()
+			err := s.finish(r)
+			if err != nil {
+				return err
+			}
+		case err := <-s.outboxDone:
+			timer.Stop()
+			s.outboxRunning = false
+			if err != nil {
+				return err
+			}
+			nextOutbox = time.Now().Add(time.Duration(m.Config.General.TimeInterval) * time.Second)
+		case p := <-s.idle.notify:
+			s.idle.received(p)
+			timer.Stop()
+			s.notify(p)
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package mail2most
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSlowServer accepts connections and closes them after a delay without greeting
+func newSlowServer(t *testing.T, delay time.Duration) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(delay)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestSchedulerWorkers(t *testing.T) {
+	defer filet.CleanUp(t)
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+	slow, stopSlow := newSlowServer(t, 200*time.Millisecond)
+	defer stopSlow()
+
+	for _, workers := range []int{1, 2} {
+		dir := filet.TmpDir(t, "")
+		m2m, err := New("../conf/mail2most.conf")
+		assert.Nil(t, err)
+		m2m.Config.General.File = dir + "/data.json"
+		m2m.Config.General.NoLoop = true
+		m2m.Config.General.Workers = workers
+		m2m.Config.Outbox.Path = dir + "/outbox"
+
+		testIMAPProfile(&m2m, addr)
+		m2m.Config.Profiles[1].Mail = m2m.Config.Profiles[0].Mail
+		m2m.Config.Profiles[1].Filter = m2m.Config.Profiles[0].Filter
+		// the first profile blocks its worker
+		m2m.Config.Profiles[0].Mail.ImapServer = slow
+		for p := range m2m.Config.Profiles {
+			m2m.Config.Profiles[p].Mattermost.URL = "http://127.0.0.1:1"
+		}
+
+		err = m2m.Run()
+		assert.Nil(t, err)
+
+		health := m2m.Health()
+		assert.Equal(t, 1, health[0].ConsecutiveFailures)
+		assert.False(t, health[1].LastSuccess.IsZero())
+		if workers == 1 {
+			assert.True(t, health[1].LastSuccess.After(health[0].LastErrorTime), "profiles are checked one after another")
+		} else {
+			assert.True(t, health[1].LastSuccess.Before(health[0].LastErrorTime), "profiles are checked concurrently")
+		}
+	}
+}
+
+func TestSchedulerQuietHours(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.NoLoop = true
+	m2m.Config.Outbox.Path = dir + "/outbox"
+
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[1].Mail = m2m.Config.Profiles[0].Mail
+	m2m.Config.Profiles[1].Filter = m2m.Config.Profiles[0].Filter
+	for p := range m2m.Config.Profiles {
+		m2m.Config.Profiles[p].Mattermost.URL = "http://127.0.0.1:1"
+	}
+	// the first profile is inside its quiet hours
+	now := time.Now().UTC()
+	m2m.Config.Profiles[0].Schedule = schedule{
+		TimeZone:   "UTC",
+		QuietHours: []string{now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04")},
+	}
+
+	err = m2m.Run()
+	assert.Nil(t, err)
+
+	health := m2m.Health()
+	assert.True(t, health[0].LastSuccess.IsZero())
+	assert.False(t, health[1].LastSuccess.IsZero())
+}
+
+func TestSchedulerSlowOutbox(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+	var delivered time.Time
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		delivered = time.Now()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.NoLoop = true
+	m2m.Config.Outbox.Path = dir + "/outbox"
+	m2m.Config.Outbox.Backoff = "1ns"
+
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[1].Mail = m2m.Config.Profiles[0].Mail
+	m2m.Config.Profiles[1].Filter = m2m.Config.Profiles[0].Filter
+	m2m.Config.Profiles[1].Mattermost.URL = "http://127.0.0.1:1"
+	// the first profile finds no mails, its queued mail is delivered to a slow mattermost
+	m2m.Config.Profiles[0].Filter.From = []string{"nobody@example.com"}
+	m2m.Config.Profiles[0].Mattermost.URL = slow.URL
+	o, err := m2m.openOutbox()
+	assert.Nil(t, err)
+	mail := Mail{ID: 1, Subject: "queued", Body: "hello world", From: []*imap.Address{imapAddress("Alice", "alice@example.com")}}
+	assert.Nil(t, m2m.enqueue(o, 0, StateKey{Profile: m2m.Config.Profiles[0].Name}, mail, Destinations{}, errors.New("mattermost is down")))
+	time.Sleep(time.Millisecond)
+
+	err = m2m.Run()
+	assert.Nil(t, err)
+
+	// the profiles are checked while the outbox waits for mattermost
+	health := m2m.Health()
+	assert.False(t, delivered.IsZero())
+	assert.False(t, health[0].LastSuccess.IsZero())
+	assert.False(t, health[1].LastSuccess.IsZero())
+	assert.True(t, health[0].LastSuccess.Before(delivered))
+	assert.True(t, health[1].LastSuccess.Before(delivered))
+}
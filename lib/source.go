@@ -0,0 +1,188 @@
+package mail2most
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/textproto"
+)
+
+// sourceFolder is the folder name used in the state of sources without folders
+const sourceFolder = "INBOX"
+
+// sourceMessage is a mail of a source without uids
+type sourceMessage struct {
+	// id identifies the mail across checks, e.g. the UIDL of POP3 mails
+	id string
+	// read returns the raw mail
+	read func() (io.Reader, error)
+}
+
+// source returns the mail source of a profile, profiles without Source use IMAP
+func (m Mail2Most) source(profile int) string {
+	if m.Config.Profiles[profile].Mail.Source == "" {
+		return SOURCEIMAP
+	}
+	return m.Config.Profiles[profile].Mail.Source
+}
+
+// mailServer returns the address of the mail server of a profile, the path of local sources
+func (m Mail2Most) mailServer(profile int) string {
+	switch m.source(profile) {
+	case SOURCEPOP3:
+		return m.Config.Profiles[profile].Mail.Pop3Server
+	case SOURCEJMAP:
+		return m.Config.Profiles[profile].Mail.JmapURL
+	case SOURCEMAILDIR, SOURCEMBOX:
+		return m.Config.Profiles[profile].Mail.Path
+	case SOURCERECEIVER:
+		return m.Config.Receiver.Listen
+	default:
+		return m.Config.Profiles[profile].Mail.ImapServer
+	}
+}
+
+// keepsPostedMails reports whether posted mails are fetched again, sources without a server side search
+// only skip them by their state
+// received mails are never fetched again, their Message-Id only catches retries of the mail server
+func (m Mail2Most) keepsPostedMails(profile int) bool {
+	mail := m.Config.Profiles[profile].Mail
+	switch m.source(profile) {
+	case SOURCEPOP3, SOURCEMAILDIR:
+		return !mail.OnSuccess.Delete || mail.ReadOnly
+	case SOURCEMBOX:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkSource validates the mail source of a profile
+func (m Mail2Most) checkSource(profile int) error {
+	mail := m.Config.Profiles[profile].Mail
+	name := m.Config.Profiles[profile].Name
+	// pruned mails would be posted again by sources which fetch all mails on every check
+	if m.Config.General.StateRetention != "" && m.keepsPostedMails(profile) {
+		return fmt.Errorf("profile %s: StateRetention can not be used with the %s source unless posted mails are deleted", name, m.source(profile))
+	}
+	switch m.source(profile) {
+	case SOURCEIMAP:
+		return m.checkTLS(profile)
+	case SOURCEPOP3:
+		if mail.Pop3Server == "" {
+			return fmt.Errorf("profile %s: Pop3Server is not set", name)
+		}
+		// POP3 has no flags or folders, mails can only be deleted
+		for _, action := range []mailAction{mail.OnSuccess, mail.OnFailure} {
+			if action != (mailAction{Delete: action.Delete}) {
+				return fmt.Errorf("profile %s: pop3 only supports the Delete action", name)
+			}
+		}
+		return m.checkTLS(profile)
+	case SOURCEJMAP:
+		if mail.JmapURL == "" {
+			return fmt.Errorf("profile %s: JmapURL is not set", name)
+		}
+		return nil
+	case SOURCEMAILDIR:
+		if mail.Path == "" {
+			return fmt.Errorf("profile %s: Path is not set", name)
+		}
+		for _, action := range []mailAction{mail.OnSuccess, mail.OnFailure} {
+			if action != (mailAction{Seen: action.Seen, Flagged: action.Flagged, Delete: action.Delete}) {
+				return fmt.Errorf("profile %s: maildir only supports the Seen, Flagged and Delete actions", name)
+			}
+		}
+		return nil
+	case SOURCEMBOX:
+		if mail.Path == "" {
+			return fmt.Errorf("profile %s: Path is not set", name)
+		}
+		// the mbox file belongs to the mail delivery agent, it is never changed
+		if !mail.OnSuccess.isZero() || !mail.OnFailure.isZero() {
+			return fmt.Errorf("profile %s: mbox does not support actions", name)
+		}
+		return nil
+	case SOURCERECEIVER:
+		// received mails are not stored anywhere
+		if !mail.OnSuccess.isZero() || !mail.OnFailure.isZero() {
+			return fmt.Errorf("profile %s: receiver does not support actions", name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("profile %s: unknown mail source: %s", name, mail.Source)
+	}
+}
+
+// messageID identifies a raw mail by its Message-Id, mails without one are identified by a hash of their content
+func messageID(raw []byte) string {
+	h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if id := h.Get("Message-Id"); id != "" {
+		return id
+	}
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// fetchSourceMails reads the mails of a source without uids which are not marked as sent in the state
+// mails not passing the filters are returned as examined so they are not read again
+func (m Mail2Most) fetchSourceMails(profile int, state StateStore, msgs []sourceMessage) ([]Mail, folderSync, error) {
+	key := StateKey{Profile: m.Config.Profiles[profile].Name, Folder: sourceFolder}
+	sync := folderSync{key: key}
+
+	var unknown []sourceMessage
+	for _, msg := range msgs {
+		if state != nil {
+			sent, err := state.SentID(key, msg.id)
+			if err != nil {
+				return nil, sync, err
+			}
+			if sent {
+				continue
+			}
+		}
+		unknown = append(unknown, msg)
+	}
+	// messages are ordered by arrival, the newest mails are kept
+	limit := int(m.Config.Profiles[profile].Mail.Limit)
+	if limit > 0 && len(unknown) > limit {
+		unknown = unknown[len(unknown)-limit:]
+	}
+	m.Info("processing mails", map[string]interface{}{
+		"server": m.mailServer(profile),
+		"new":    len(unknown),
+	})
+
+	var mails []Mail
+	for _, msg := range unknown {
+		r, err := msg.read()
+		if err != nil {
+			return nil, sync, err
+		}
+		mail, ok, err := m.parseMail(r, profile)
+		if err != nil {
+			return nil, sync, err
+		}
+		mail.Folder = sourceFolder
+		mail.SourceID = msg.id
+		if ok {
+			ok, err = m.checkFilters(profile, mail)
+			if err != nil {
+				return nil, sync, err
+			}
+		}
+		if !ok {
+			m.Debug("message not passing the filter", map[string]interface{}{"subject": mail.Subject, "id": msg.id})
+			sync.examined = append(sync.examined, msg.id)
+			continue
+		}
+		m.Info("found mail", map[string]interface{}{
+			"subject": mail.Subject, "id": msg.id,
+		})
+		mails = append(mails, mail)
+	}
+	return mails, sync, nil
+}
@@ -0,0 +1,414 @@
+package mail2most
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateVersion is the layout version of the delivery state file
+const stateVersion = 2
+
+// StateKey identifies a mailbox in the delivery state
+type StateKey struct {
+	Profile     string
+	Folder      string
+	UIDValidity uint32
+}
+
+// StateStore persists which mails were already delivered to mattermost
+type StateStore interface {
+	// Folder prepares the state of a mailbox
+	// if the UIDVALIDITY of the mailbox changed all known uids are dropped and reset is true
+	Folder(key StateKey) (reset bool, err error)
+	// Sent reports whether the uid was already delivered
+	Sent(key StateKey, uid uint32) (bool, error)
+	// MarkSent stores the uid as delivered
+	MarkSent(key StateKey, uid uint32) error
+	// SentID reports whether the mail was already delivered, it is used for sources identifying mails by strings (e.g. POP3 UIDL)
+	SentID(key StateKey, id string) (bool, error)
+	// MarkSentID stores the id as delivered
+	MarkSentID(key StateKey, id string) error
+	// Sync returns the synchronisation state of a mailbox
+	Sync(key StateKey) (FolderSync, error)
+	// SetSync stores the synchronisation state of a mailbox
+	SetSync(key StateKey, sync FolderSync) error
+	// Thread returns the root post of a mattermost thread, the RootID is empty for unknown threads
+	Thread(key ThreadKey) (ThreadPost, error)
+	// SetThread stores the root post of a mattermost thread
+	SetThread(key ThreadKey, post ThreadPost) error
+	// Prune removes all uids, ids and threads delivered before the given time and returns the number of removed entries
+	Prune(before time.Time) (int, error)
+	Close() error
+}
+
+// FolderSync is the synchronisation state of a mailbox, it is dropped if the UIDVALIDITY changes
+type FolderSync struct {
+	// LastUID is the highest uid already examined, the next check starts at LastUID+1
+	LastUID uint32
+	// HighestModSeq is the HIGHESTMODSEQ of the mailbox (CONDSTORE), 0 if the server does not support it
+	HighestModSeq uint64
+	// State is the Email state string of JMAP accounts, the next check only examines the changes since then
+	State string
+}
+
+// ThreadKey identifies a thread of mails in a mattermost channel
+// ID is either a Message-Id in angle brackets or a normalized subject prefixed with "subject:"
+type ThreadKey struct {
+	Channel string
+	ID      string
+}
+
+// ThreadPost is the root post of a thread
+type ThreadPost struct {
+	RootID string `json:"root"`
+	// Time is the last time a mail was posted to the thread
+	Time time.Time `json:"time"`
+}
+
+// isSent reports whether a mail was already delivered, mails with a SourceID are identified by it instead of their uid
+func isSent(state StateStore, key StateKey, mail Mail) (bool, error) {
+	if mail.SourceID != "" {
+		return state.SentID(key, mail.SourceID)
+	}
+	return state.Sent(key, mail.ID)
+}
+
+// markSent stores a mail as delivered
+func markSent(state StateStore, key StateKey, mail Mail) error {
+	if mail.SourceID != "" {
+		return state.MarkSentID(key, mail.SourceID)
+	}
+	return state.MarkSent(key, mail.ID)
+}
+
+// openStateStore opens the state store defined by General.StateBackend
+func (m Mail2Most) openStateStore() (StateStore, error) {
+	switch m.Config.General.StateBackend {
+	case "", STATEJSON:
+		return m.openJSONStateStore(m.Config.General.File)
+	case STATEBOLT:
+		return m.openBoltStateStore(m.boltStateFile(), m.Config.General.File)
+	default:
+		return nil, configError{fmt.Errorf("unknown state backend: %s", m.Config.General.StateBackend)}
+	}
+}
+
+// boltStateFile returns the path of the bolt database, it never is the json File
+func (m Mail2Most) boltStateFile() string {
+	if m.Config.General.StateFile != "" {
+		return m.Config.General.StateFile
+	}
+	file := m.Config.General.File
+	db := strings.TrimSuffix(file, filepath.Ext(file)) + ".db"
+	if db == file {
+		db += ".db"
+	}
+	return db
+}
+
+// deliverStateFile returns the bolt database of the deliver command
+// it is not shared with the daemon, which keeps its state open while running
+func (m Mail2Most) deliverStateFile() string {
+	if m.Config.General.DeliverStateFile != "" {
+		return m.Config.General.DeliverStateFile
+	}
+	file := m.Config.General.File
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".deliver.db"
+}
+
+// pruneState removes delivered uids older than General.StateRetention
+func (m Mail2Most) pruneState(store StateStore) error {
+	if m.Config.General.StateRetention == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(m.Config.General.StateRetention)
+	if err != nil {
+		return configError{err}
+	}
+	n, err := store.Prune(time.Now().Add(-d))
+	if err != nil {
+		return err
+	}
+	m.Debug("pruned delivery state", map[string]interface{}{
+		"retention": m.Config.General.StateRetention,
+		"removed":   n,
+	})
+	return nil
+}
+
+// deliveryState keeps track of all mails already sent to mattermost
+// mails are identified by the profile name, the mailbox name and the UIDVALIDITY of that mailbox
+// since UIDs are only unique inside one mailbox with the same UIDVALIDITY
+type deliveryState struct {
+	Version  int                      `json:"version"`
+	Profiles map[string]*profileState `json:"profiles"`
+	// Threads are the root posts of threads by channel and thread id
+	Threads map[string]map[string]ThreadPost `json:"threads,omitempty"`
+}
+
+type profileState struct {
+	Folders map[string]*folderState `json:"folders"`
+}
+
+type folderState struct {
+	// UIDValidity 0 means the UIDVALIDITY is not known yet (e.g. after a migration)
+	// and the first value seen is adopted
+	UIDValidity   uint32               `json:"uidvalidity"`
+	LastUID       uint32               `json:"lastuid,omitempty"`
+	HighestModSeq uint64               `json:"highestmodseq,omitempty"`
+	State         string               `json:"state,omitempty"`
+	Sent          map[uint32]time.Time `json:"sent"`
+	SentIDs       map[string]time.Time `json:"sentids,omitempty"`
+}
+
+func newDeliveryState() *deliveryState {
+	return &deliveryState{
+		Version:  stateVersion,
+		Profiles: make(map[string]*profileState),
+	}
+}
+
+// folder returns the state of a mailbox
+// if the UIDVALIDITY of the mailbox changed all known UIDs are dropped and reset is true
+func (s *deliveryState) folder(profile, folder string, uidValidity uint32) (*folderState, bool) {
+	p, ok := s.Profiles[profile]
+	if !ok {
+		p = &profileState{Folders: make(map[string]*folderState)}
+		s.Profiles[profile] = p
+	}
+	f, ok := p.Folders[folder]
+	if !ok {
+		f = &folderState{UIDValidity: uidValidity, Sent: make(map[uint32]time.Time)}
+		p.Folders[folder] = f
+		return f, false
+	}
+	if f.Sent == nil {
+		f.Sent = make(map[uint32]time.Time)
+	}
+	if f.UIDValidity == 0 {
+		f.UIDValidity = uidValidity
+		return f, false
+	}
+	if f.UIDValidity != uidValidity {
+		*f = folderState{UIDValidity: uidValidity, Sent: make(map[uint32]time.Time)}
+		return f, true
+	}
+	return f, false
+}
+
+// jsonStateStore keeps the delivery state in memory and rewrites the whole file on every change
+type jsonStateStore struct {
+	mu       sync.Mutex
+	filename string
+	state    *deliveryState
+}
+
+func (m Mail2Most) openJSONStateStore(filename string) (*jsonStateStore, error) {
+	state, err := m.loadState(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonStateStore{filename: filename, state: state}, nil
+}
+
+func (s *jsonStateStore) Folder(key StateKey) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, reset := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	return reset, nil
+}
+
+func (s *jsonStateStore) Sent(key StateKey, uid uint32) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, _ := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	_, ok := f.Sent[uid]
+	return ok, nil
+}
+
+func (s *jsonStateStore) MarkSent(key StateKey, uid uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, _ := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	f.Sent[uid] = time.Now()
+	return writeToFile(s.state, s.filename)
+}
+
+func (s *jsonStateStore) SentID(key StateKey, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, _ := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	_, ok := f.SentIDs[id]
+	return ok, nil
+}
+
+func (s *jsonStateStore) MarkSentID(key StateKey, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, _ := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	if f.SentIDs == nil {
+		f.SentIDs = make(map[string]time.Time)
+	}
+	f.SentIDs[id] = time.Now()
+	return writeToFile(s.state, s.filename)
+}
+
+func (s *jsonStateStore) Sync(key StateKey) (FolderSync, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.state.Profiles[key.Profile]
+	if !ok {
+		return FolderSync{}, nil
+	}
+	f, ok := p.Folders[key.Folder]
+	if !ok || f.UIDValidity != key.UIDValidity {
+		return FolderSync{}, nil
+	}
+	return FolderSync{LastUID: f.LastUID, HighestModSeq: f.HighestModSeq, State: f.State}, nil
+}
+
+func (s *jsonStateStore) SetSync(key StateKey, sync FolderSync) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, _ := s.state.folder(key.Profile, key.Folder, key.UIDValidity)
+	if f.LastUID == sync.LastUID && f.HighestModSeq == sync.HighestModSeq && f.State == sync.State {
+		return nil
+	}
+	f.LastUID = sync.LastUID
+	f.HighestModSeq = sync.HighestModSeq
+	f.State = sync.State
+	return writeToFile(s.state, s.filename)
+}
+
+func (s *jsonStateStore) Thread(key ThreadKey) (ThreadPost, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.Threads[key.Channel][key.ID], nil
+}
+
+func (s *jsonStateStore) SetThread(key ThreadKey, post ThreadPost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Threads == nil {
+		s.state.Threads = make(map[string]map[string]ThreadPost)
+	}
+	if s.state.Threads[key.Channel] == nil {
+		s.state.Threads[key.Channel] = make(map[string]ThreadPost)
+	}
+	s.state.Threads[key.Channel][key.ID] = post
+	return writeToFile(s.state, s.filename)
+}
+
+func (s *jsonStateStore) Prune(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for channel, threads := range s.state.Threads {
+		for id, post := range threads {
+			if post.Time.Before(before) {
+				delete(threads, id)
+				n++
+			}
+		}
+		if len(threads) == 0 {
+			delete(s.state.Threads, channel)
+		}
+	}
+	for _, p := range s.state.Profiles {
+		for _, f := range p.Folders {
+			for uid, t := range f.Sent {
+				// migrated uids have no delivery time and are kept
+				if !t.IsZero() && t.Before(before) {
+					delete(f.Sent, uid)
+					n++
+				}
+			}
+			for id, t := range f.SentIDs {
+				if t.Before(before) {
+					delete(f.SentIDs, id)
+					n++
+				}
+			}
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, writeToFile(s.state, s.filename)
+}
+
+func (s *jsonStateStore) Close() error {
+	return nil
+}
+
+// loadState reads the delivery state from filename
+// files written by older versions (a list of uids per profile index) are migrated
+func (m Mail2Most) loadState(filename string) (*deliveryState, error) {
+	state := newDeliveryState()
+	if _, err := os.Stat(filename); err != nil {
+		return state, nil
+	}
+
+	bv, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(bv), []byte("[")) {
+		var legacy [][]uint32
+		err = json.Unmarshal(bv, &legacy)
+		if err != nil {
+			return nil, err
+		}
+		m.migrateState(state, legacy)
+		err = writeToFile(state, filename)
+		if err != nil {
+			return nil, err
+		}
+		m.Info("data.json migrated", map[string]interface{}{
+			"file":    filename,
+			"version": stateVersion,
+		})
+		return state, nil
+	}
+
+	err = json.Unmarshal(bv, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Profiles == nil {
+		state.Profiles = make(map[string]*profileState)
+	}
+	return state, nil
+}
+
+// migrateState converts the legacy state layout which was indexed by the profile position
+// legacy uids were not stored per folder so they are assigned to every folder of the profile
+func (m Mail2Most) migrateState(state *deliveryState, legacy [][]uint32) {
+	for p, uids := range legacy {
+		if p >= len(m.Config.Profiles) {
+			m.Error("data.json error", map[string]interface{}{
+				"error":  "data.json contains more profile information than defined in the config",
+				"cause":  "this happens if profiles are deleted from the config file",
+				"status": "dropping the state of the deleted profiles",
+			})
+			break
+		}
+		for _, folder := range m.folders(p) {
+			if isFolderPattern(folder) {
+				continue
+			}
+			f, _ := state.folder(m.Config.Profiles[p].Name, folder, 0)
+			for _, uid := range uids {
+				f.Sent[uid] = time.Time{}
+			}
+		}
+	}
+}
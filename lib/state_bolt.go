@@ -0,0 +1,368 @@
+package mail2most
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltFoldersBucket = []byte("folders")
+	boltThreadsBucket = []byte("threads")
+	boltSentBucket    = []byte("sent")
+	boltSentIDsBucket = []byte("sentids")
+	boltUIDValidity   = []byte("uidvalidity")
+	boltLastUID       = []byte("lastuid")
+	boltHighestModSeq = []byte("highestmodseq")
+	boltState         = []byte("state")
+)
+
+// boltStateStore keeps the delivery state in an embedded bolt database
+// every mailbox has its own bucket so lookups are indexed by uid
+// and every change is committed in its own crash-safe transaction
+type boltStateStore struct {
+	db *bolt.DB
+}
+
+// openBoltStateStore opens the database filename, a new database imports the json state file jsonFile
+// the json state file is left untouched
+func (m Mail2Most) openBoltStateStore(filename, jsonFile string) (*boltStateStore, error) {
+	var imported *deliveryState
+	if _, err := os.Stat(filename); os.IsNotExist(err) && jsonFile != "" {
+		if _, err := os.Stat(jsonFile); err == nil {
+			imported, err = m.loadState(jsonFile)
+			if err != nil {
+				return nil, err
+			}
+			m.Info("importing json state into bolt database", map[string]interface{}{
+				"file":     jsonFile,
+				"database": filename,
+			})
+		}
+	}
+
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltStateStore{db: db}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(boltFoldersBucket)
+		if err != nil {
+			return err
+		}
+		threads, err := tx.CreateBucketIfNotExists(boltThreadsBucket)
+		if err != nil {
+			return err
+		}
+		if imported == nil {
+			return nil
+		}
+		for channel, posts := range imported.Threads {
+			for id, post := range posts {
+				err = threads.Put(threadKey(ThreadKey{Channel: channel, ID: id}), threadValue(post))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for profile, p := range imported.Profiles {
+			for folder, f := range p.Folders {
+				b, err := s.folderBucket(root, StateKey{Profile: profile, Folder: folder, UIDValidity: f.UIDValidity})
+				if err != nil {
+					return err
+				}
+				err = s.putSync(b, FolderSync{LastUID: f.LastUID, HighestModSeq: f.HighestModSeq, State: f.State})
+				if err != nil {
+					return err
+				}
+				sent := b.Bucket(boltSentBucket)
+				for uid, t := range f.Sent {
+					err = sent.Put(uidKey(uid), timeValue(t))
+					if err != nil {
+						return err
+					}
+				}
+				sent = b.Bucket(boltSentIDsBucket)
+				for id, t := range f.SentIDs {
+					err = sent.Put([]byte(id), timeValue(t))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func folderKey(key StateKey) []byte {
+	return []byte(key.Profile + "\x00" + key.Folder)
+}
+
+func uidKey(uid uint32) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, uid)
+	return k
+}
+
+// timeValue encodes the delivery time, the zero time is stored as 0
+func timeValue(t time.Time) []byte {
+	v := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+	}
+	return v
+}
+
+func threadKey(key ThreadKey) []byte {
+	return []byte(key.Channel + "\x00" + key.ID)
+}
+
+// threadValue encodes the time of the last post followed by the id of the root post
+func threadValue(post ThreadPost) []byte {
+	return append(timeValue(post.Time), post.RootID...)
+}
+
+// folderBucket returns the bucket of a mailbox and resets it if the UIDVALIDITY changed
+func (s *boltStateStore) folderBucket(root *bolt.Bucket, key StateKey) (*bolt.Bucket, error) {
+	fb, err := root.CreateBucketIfNotExists(folderKey(key))
+	if err != nil {
+		return nil, err
+	}
+	v := fb.Get(boltUIDValidity)
+	if v == nil || binary.BigEndian.Uint32(v) == 0 || binary.BigEndian.Uint32(v) != key.UIDValidity {
+		if v != nil && binary.BigEndian.Uint32(v) != 0 {
+			for _, name := range [][]byte{boltSentBucket, boltSentIDsBucket} {
+				if fb.Bucket(name) != nil {
+					err = fb.DeleteBucket(name)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			err = s.putSync(fb, FolderSync{})
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = fb.Put(boltUIDValidity, uidKey(key.UIDValidity))
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = fb.CreateBucketIfNotExists(boltSentBucket)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fb.CreateBucketIfNotExists(boltSentIDsBucket)
+	return fb, err
+}
+
+// putSync stores the synchronisation state in the bucket of a mailbox
+func (s *boltStateStore) putSync(fb *bolt.Bucket, sync FolderSync) error {
+	err := fb.Put(boltLastUID, uidKey(sync.LastUID))
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, sync.HighestModSeq)
+	err = fb.Put(boltHighestModSeq, v)
+	if err != nil {
+		return err
+	}
+	return fb.Put(boltState, []byte(sync.State))
+}
+
+func (s *boltStateStore) Folder(key StateKey) (bool, error) {
+	var known bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		fb := tx.Bucket(boltFoldersBucket).Bucket(folderKey(key))
+		if fb == nil {
+			return nil
+		}
+		v := fb.Get(boltUIDValidity)
+		known = v != nil && binary.BigEndian.Uint32(v) == key.UIDValidity
+		return nil
+	})
+	if err != nil || known {
+		return false, err
+	}
+
+	var reset bool
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltFoldersBucket)
+		if fb := root.Bucket(folderKey(key)); fb != nil {
+			v := fb.Get(boltUIDValidity)
+			reset = v != nil && binary.BigEndian.Uint32(v) != 0
+		}
+		_, err := s.folderBucket(root, key)
+		return err
+	})
+	return reset, err
+}
+
+func (s *boltStateStore) Sent(key StateKey, uid uint32) (bool, error) {
+	return s.sent(key, boltSentBucket, uidKey(uid))
+}
+
+func (s *boltStateStore) MarkSent(key StateKey, uid uint32) error {
+	return s.markSent(key, boltSentBucket, uidKey(uid))
+}
+
+func (s *boltStateStore) SentID(key StateKey, id string) (bool, error) {
+	return s.sent(key, boltSentIDsBucket, []byte(id))
+}
+
+func (s *boltStateStore) MarkSentID(key StateKey, id string) error {
+	return s.markSent(key, boltSentIDsBucket, []byte(id))
+}
+
+// sent looks up a delivered mail in the bucket of a mailbox
+func (s *boltStateStore) sent(key StateKey, bucket, k []byte) (bool, error) {
+	var sent bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		fb := tx.Bucket(boltFoldersBucket).Bucket(folderKey(key))
+		if fb == nil {
+			return nil
+		}
+		v := fb.Get(boltUIDValidity)
+		if v == nil || (binary.BigEndian.Uint32(v) != 0 && binary.BigEndian.Uint32(v) != key.UIDValidity) {
+			return nil
+		}
+		b := fb.Bucket(bucket)
+		sent = b != nil && b.Get(k) != nil
+		return nil
+	})
+	return sent, err
+}
+
+// markSent stores a delivered mail in the bucket of a mailbox
+func (s *boltStateStore) markSent(key StateKey, bucket, k []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fb, err := s.folderBucket(tx.Bucket(boltFoldersBucket), key)
+		if err != nil {
+			return err
+		}
+		return fb.Bucket(bucket).Put(k, timeValue(time.Now()))
+	})
+}
+
+func (s *boltStateStore) Sync(key StateKey) (FolderSync, error) {
+	var sync FolderSync
+	err := s.db.View(func(tx *bolt.Tx) error {
+		fb := tx.Bucket(boltFoldersBucket).Bucket(folderKey(key))
+		if fb == nil {
+			return nil
+		}
+		v := fb.Get(boltUIDValidity)
+		if v == nil || binary.BigEndian.Uint32(v) != key.UIDValidity {
+			return nil
+		}
+		if v := fb.Get(boltLastUID); v != nil {
+			sync.LastUID = binary.BigEndian.Uint32(v)
+		}
+		if v := fb.Get(boltHighestModSeq); v != nil {
+			sync.HighestModSeq = binary.BigEndian.Uint64(v)
+		}
+		sync.State = string(fb.Get(boltState))
+		return nil
+	})
+	return sync, err
+}
+
+func (s *boltStateStore) SetSync(key StateKey, sync FolderSync) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fb, err := s.folderBucket(tx.Bucket(boltFoldersBucket), key)
+		if err != nil {
+			return err
+		}
+		return s.putSync(fb, sync)
+	})
+}
+
+func (s *boltStateStore) Thread(key ThreadKey) (ThreadPost, error) {
+	var post ThreadPost
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltThreadsBucket).Get(threadKey(key))
+		if len(v) < 8 {
+			return nil
+		}
+		post.Time = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		post.RootID = string(v[8:])
+		return nil
+	})
+	return post, err
+}
+
+func (s *boltStateStore) SetThread(key ThreadKey, post ThreadPost) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltThreadsBucket).Put(threadKey(key), threadValue(post))
+	})
+}
+
+func (s *boltStateStore) Prune(before time.Time) (int, error) {
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		threads := tx.Bucket(boltThreadsBucket)
+		var expired [][]byte
+		err := threads.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || time.Unix(0, int64(binary.BigEndian.Uint64(v))).Before(before) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = threads.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		n += len(expired)
+
+		return tx.Bucket(boltFoldersBucket).ForEach(func(k, _ []byte) error {
+			for _, name := range [][]byte{boltSentBucket, boltSentIDsBucket} {
+				b := tx.Bucket(boltFoldersBucket).Bucket(k).Bucket(name)
+				if b == nil {
+					continue
+				}
+				var expired [][]byte
+				err := b.ForEach(func(uid, v []byte) error {
+					t := int64(binary.BigEndian.Uint64(v))
+					// migrated uids have no delivery time and are kept
+					if t != 0 && time.Unix(0, t).Before(before) {
+						expired = append(expired, append([]byte(nil), uid...))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				for _, uid := range expired {
+					err = b.Delete(uid)
+					if err != nil {
+						return err
+					}
+				}
+				n += len(expired)
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+func (s *boltStateStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,71 @@
+package mail2most
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStateStore(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.StateBackend = STATEBOLT
+
+	// the database does not replace the json file
+	s, err := m2m.openStateStore()
+	assert.Nil(t, err)
+	assert.FileExists(t, dir+"/data.db")
+	_, err = os.Stat(dir + "/data.json")
+	assert.True(t, os.IsNotExist(err))
+	testStateStore(t, s)
+
+	m2m.Config.General.File = dir + "/data.db"
+	assert.Equal(t, dir+"/data.db.db", m2m.boltStateFile())
+	m2m.Config.General.StateFile = dir + "/state"
+	assert.Equal(t, dir+"/state", m2m.boltStateFile())
+}
+
+func TestBoltStateStoreImport(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	err = ioutil.WriteFile(dir+"/data.json", []byte("[[1,2]]"), 0644)
+	assert.Nil(t, err)
+
+	s, err := m2m.openBoltStateStore(dir+"/data.db", dir+"/data.json")
+	assert.Nil(t, err)
+
+	key := StateKey{Profile: m2m.Config.Profiles[0].Name, Folder: m2m.folders(0)[0], UIDValidity: 7}
+	reset, err := s.Folder(key)
+	assert.Nil(t, err)
+	assert.False(t, reset)
+
+	sent, err := s.Sent(key, 2)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	// the json file stays in place for other tools
+	state, err := m2m.loadState(dir + "/data.json")
+	assert.Nil(t, err)
+	assert.Len(t, state.Profiles, 1)
+	assert.Nil(t, s.Close())
+
+	// an existing database is not imported into again
+	assert.Nil(t, ioutil.WriteFile(dir+"/data.json", []byte("[[3,4]]"), 0644))
+	s, err = m2m.openBoltStateStore(dir+"/data.db", dir+"/data.json")
+	assert.Nil(t, err)
+	sent, err = s.Sent(key, 4)
+	assert.Nil(t, err)
+	assert.False(t, sent)
+	assert.Nil(t, s.Close())
+}
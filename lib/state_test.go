@@ -0,0 +1,257 @@
+package mail2most
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryState(t *testing.T) {
+	s := newDeliveryState()
+
+	f, reset := s.folder("profile", "INBOX", 1)
+	assert.False(t, reset)
+	f.Sent[42] = testDate
+
+	// same uid in another folder or profile is a different mail
+	f, _ = s.folder("profile", "Archive", 1)
+	_, ok := f.Sent[42]
+	assert.False(t, ok)
+	f, _ = s.folder("other", "INBOX", 1)
+	_, ok = f.Sent[42]
+	assert.False(t, ok)
+
+	f, reset = s.folder("profile", "INBOX", 1)
+	assert.False(t, reset)
+	_, ok = f.Sent[42]
+	assert.True(t, ok)
+
+	// a changed uidvalidity invalidates all known uids
+	f, reset = s.folder("profile", "INBOX", 2)
+	assert.True(t, reset)
+	_, ok = f.Sent[42]
+	assert.False(t, ok)
+}
+
+func TestLoadStateMigration(t *testing.T) {
+	defer filet.CleanUp(t)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	file := filet.TmpFile(t, "", "[[1,2],[3]]")
+	s, err := m2m.loadState(file.Name())
+	assert.Nil(t, err)
+
+	for _, folder := range m2m.folders(0) {
+		f, reset := s.folder(m2m.Config.Profiles[0].Name, folder, 1234)
+		assert.False(t, reset)
+		assert.Equal(t, uint32(1234), f.UIDValidity)
+		_, ok := f.Sent[1]
+		assert.True(t, ok)
+		_, ok = f.Sent[3]
+		assert.False(t, ok)
+	}
+	f, _ := s.folder(m2m.Config.Profiles[1].Name, m2m.folders(1)[0], 1234)
+	_, ok := f.Sent[3]
+	assert.True(t, ok)
+
+	// the migrated state is written back in the new format
+	bv, err := ioutil.ReadFile(file.Name())
+	assert.Nil(t, err)
+	assert.Contains(t, string(bv), `"version": 2`)
+
+	s, err = m2m.loadState(file.Name())
+	assert.Nil(t, err)
+	f, _ = s.folder(m2m.Config.Profiles[1].Name, m2m.folders(1)[0], 1234)
+	_, ok = f.Sent[3]
+	assert.True(t, ok)
+
+	s, err = m2m.loadState("/tmp/doesnotexists/data.json")
+	assert.Nil(t, err)
+	assert.Empty(t, s.Profiles)
+}
+
+func TestSetProfileNames(t *testing.T) {
+	profiles := []profile{
+		profile{Mail: maildata{ImapServer: "mail.example.com:993", Username: "user"}},
+		profile{Name: "named"},
+		profile{Mail: maildata{ImapServer: "mail.example.com:993", Username: "user"}, Name: "second"},
+		profile{Mail: maildata{Source: SOURCEPOP3, Pop3Server: "mail.example.com:995", Username: "user"}},
+		profile{Mail: maildata{Source: SOURCEJMAP, JmapURL: "https://mail.example.com/jmap", Username: "user"}},
+		profile{Mail: maildata{Source: SOURCEMAILDIR, Path: "/var/mail/user"}},
+		profile{Mail: maildata{Source: SOURCEMBOX, Path: "/var/mail/user"}},
+		profile{Mail: maildata{Source: SOURCERECEIVER, Recipients: []string{"alerts@example.com", "ops@example.com"}}},
+	}
+	err := setProfileNames(profiles)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"user@mail.example.com:993",
+		"named",
+		"second",
+		"user@mail.example.com:995",
+		"user@https://mail.example.com/jmap",
+		"maildir:/var/mail/user",
+		"mbox:/var/mail/user",
+		"receiver:alerts@example.com,ops@example.com",
+	}, []string{
+		profiles[0].Name, profiles[1].Name, profiles[2].Name, profiles[3].Name,
+		profiles[4].Name, profiles[5].Name, profiles[6].Name, profiles[7].Name,
+	})
+
+	// profiles of the same mail account are told apart by their filters and destinations, not by their position
+	alerts := profile{Mail: maildata{ImapServer: "mail.example.com:993", Username: "user"}, Filter: filter{Subject: []string{"alert"}}}
+	ops := profile{Mail: alerts.Mail, Mattermost: mattermost{Channels: []string{"ops"}}}
+	profiles = []profile{alerts, ops}
+	assert.Nil(t, setProfileNames(profiles))
+	reordered := []profile{ops, alerts}
+	assert.Nil(t, setProfileNames(reordered))
+	assert.Equal(t, profiles[0].Name, reordered[1].Name)
+	assert.Equal(t, profiles[1].Name, reordered[0].Name)
+	assert.NotEqual(t, profiles[0].Name, profiles[1].Name)
+	assert.True(t, strings.HasPrefix(profiles[0].Name, "user@mail.example.com:993#"))
+
+	// identical profiles and names taken by other profiles get unique names as well
+	p := profile{Mail: maildata{Source: SOURCEMAILDIR, Path: "/var/mail/user"}}
+	profiles = []profile{p, p, profile{Name: "maildir:/var/mail/user"}}
+	assert.Nil(t, setProfileNames(profiles))
+	assert.Equal(t, "maildir:/var/mail/user#"+profileHash(p), profiles[0].Name)
+	assert.Equal(t, "maildir:/var/mail/user#"+profileHash(p)+"#2", profiles[1].Name)
+
+	profiles = []profile{profile{Name: "named"}, profile{Name: "named"}}
+	err = setProfileNames(profiles)
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "duplicate profile name: named", err.Error())
+	}
+}
+
+// testStateStore runs the behaviour every StateStore has to implement
+func testStateStore(t *testing.T, s StateStore) {
+	key := StateKey{Profile: "profile", Folder: "INBOX", UIDValidity: 1}
+
+	reset, err := s.Folder(key)
+	assert.Nil(t, err)
+	assert.False(t, reset)
+
+	sent, err := s.Sent(key, 42)
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	err = s.MarkSent(key, 42)
+	assert.Nil(t, err)
+
+	sent, err = s.Sent(key, 42)
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	other := StateKey{Profile: "profile", Folder: "Archive", UIDValidity: 1}
+	sent, err = s.Sent(other, 42)
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	// mails identified by strings (e.g. POP3 UIDL)
+	sent, err = s.SentID(key, "uidl-1")
+	assert.Nil(t, err)
+	assert.False(t, sent)
+	err = s.MarkSentID(key, "uidl-1")
+	assert.Nil(t, err)
+	sent, err = s.SentID(key, "uidl-1")
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	sent, err = s.SentID(other, "uidl-1")
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	// threads are kept per channel
+	thread := ThreadKey{Channel: "channel", ID: "<1@example.com>"}
+	post, err := s.Thread(thread)
+	assert.Nil(t, err)
+	assert.Equal(t, "", post.RootID)
+	err = s.SetThread(thread, ThreadPost{RootID: "root", Time: time.Now()})
+	assert.Nil(t, err)
+	post, err = s.Thread(thread)
+	assert.Nil(t, err)
+	assert.Equal(t, "root", post.RootID)
+	assert.WithinDuration(t, time.Now(), post.Time, time.Minute)
+	post, err = s.Thread(ThreadKey{Channel: "other", ID: "<1@example.com>"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", post.RootID)
+
+	// nothing is older than an hour
+	n, err := s.Prune(time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = s.Prune(time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	post, err = s.Thread(thread)
+	assert.Nil(t, err)
+	assert.Equal(t, "", post.RootID)
+
+	sent, err = s.Sent(key, 42)
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	err = s.MarkSent(key, 43)
+	assert.Nil(t, err)
+	err = s.MarkSentID(key, "uidl-2")
+	assert.Nil(t, err)
+
+	sync, err := s.Sync(key)
+	assert.Nil(t, err)
+	assert.Equal(t, FolderSync{}, sync)
+	err = s.SetSync(key, FolderSync{LastUID: 43, HighestModSeq: 1 << 40, State: "s42"})
+	assert.Nil(t, err)
+	sync, err = s.Sync(key)
+	assert.Nil(t, err)
+	assert.Equal(t, FolderSync{LastUID: 43, HighestModSeq: 1 << 40, State: "s42"}, sync)
+
+	// the synchronisation state of another uidvalidity is unknown
+	sync, err = s.Sync(StateKey{Profile: "profile", Folder: "INBOX", UIDValidity: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, FolderSync{}, sync)
+
+	key.UIDValidity = 2
+	reset, err = s.Folder(key)
+	assert.Nil(t, err)
+	assert.True(t, reset)
+
+	sent, err = s.Sent(key, 43)
+	assert.Nil(t, err)
+	assert.False(t, sent)
+	sent, err = s.SentID(key, "uidl-2")
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	sync, err = s.Sync(key)
+	assert.Nil(t, err)
+	assert.Equal(t, FolderSync{}, sync)
+
+	assert.Nil(t, s.Close())
+}
+
+func TestJSONStateStore(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	s, err := m2m.openJSONStateStore(dir + "/data.json")
+	assert.Nil(t, err)
+	testStateStore(t, s)
+
+	m2m.Config.General.File = dir + "/data.json"
+	m2m.Config.General.StateBackend = "foo"
+	_, err = m2m.openStateStore()
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "unknown state backend: foo", err.Error())
+	}
+}
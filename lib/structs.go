@@ -11,15 +11,37 @@ import (
 type Mail2Most struct {
 	Config config
 	Logger *log.Logger
+
+	// pool keeps the imap connections between checks
+	pool *imapPool
+	// tokens caches oauth2 access tokens between checks
+	tokens *tokenCache
+	// health tracks failing profiles
+	health *healthTracker
+	// mattermost keeps the logged in mattermost clients between posts
+	mattermost *mattermostPool
 }
 
 // Mail contains mail information
 type Mail struct {
 	ID            uint32
+	Folder        string
+	UIDValidity   uint32
 	Subject, Body string
-	From, To      []*imap.Address
+	From, To, Cc  []*imap.Address
 	Date          time.Time
 	Attachments   []Attachment
+
+	// Header contains all header fields by their canonical key
+	Header map[string][]string
+
+	// SourceID identifies mails of sources without uids (e.g. the UIDL of POP3 mails)
+	SourceID string
+
+	// MessageID, InReplyTo and References are the thread headers without angle brackets
+	MessageID  string
+	InReplyTo  []string
+	References []string
 }
 
 // Attachment .
@@ -0,0 +1,174 @@
+package mail2most
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	imap "github.com/emersion/go-imap"
+)
+
+// defaultTemplate renders the classic layout controlled by the SubjectOnly, HideSubject, HideFrom, HideFromEmail
+// and ConvertToMarkdown options
+const defaultTemplate = `:email: {{if not .Options.HideFrom}}{{.From}}{{end}}
+{{- if and .Options.SubjectOnly (not .Options.HideSubject)}}
+>_{{.Mail.Subject}}_
+
+{{else}}
+{{- if .Options.HideSubject}}
+
+
+
+
+{{else}}
+>_{{.Mail.Subject}}_
+
+{{end}}
+{{- if .Options.ConvertToMarkdown}}
+{{.Body}}
+{{else}}` + codeFence + `
+{{.Body}}` + codeFence + `
+{{end}}
+{{- end}}`
+
+// postData is the data post templates are executed with
+type postData struct {
+	// Mail is the posted mail, its Body is not converted
+	Mail Mail
+	// Body is converted to markdown or stripped of html depending on the profile
+	Body string
+	// From is the from line of the default template, Sender is the mattermost user (e.g. "@alice") or the name of the sender
+	From, Sender string
+	// Profile is the name of the profile, Channel the channel or user the post is sent to
+	Profile, Channel string
+	// Options are the mattermost settings of the profile
+	Options mattermost
+}
+
+// templateFuncs are the helper functions available in post templates
+var templateFuncs = template.FuncMap{
+	"address":   formatAddress,
+	"addresses": formatAddresses,
+	"email":     emailAddress,
+	"header":    headerValue,
+	"date":      func(layout string, t time.Time) string { return t.Format(layout) },
+	"quote":     quote,
+	"code":      func(s string) string { return codeFence + "\n" + strings.TrimSuffix(s, "\n") + "\n" + codeFence },
+	"truncate":  truncate,
+	"join":      func(sep string, s []string) string { return strings.Join(s, sep) },
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+}
+
+// emailAddress returns the address without the name
+func emailAddress(a *imap.Address) string {
+	if a == nil {
+		return ""
+	}
+	if a.HostName == "" {
+		return a.MailboxName
+	}
+	return a.MailboxName + "@" + a.HostName
+}
+
+// formatAddress returns the address including the name (e.g. "Alice <alice@example.com>")
+func formatAddress(a *imap.Address) string {
+	if a == nil {
+		return ""
+	}
+	if a.PersonalName == "" {
+		return emailAddress(a)
+	}
+	return fmt.Sprintf("%s <%s>", a.PersonalName, emailAddress(a))
+}
+
+// formatAddresses returns a comma separated list of addresses
+func formatAddresses(list []*imap.Address) string {
+	var s []string
+	for _, a := range list {
+		s = append(s, formatAddress(a))
+	}
+	return strings.Join(s, ", ")
+}
+
+// headerValue returns the first value of a header field
+func headerValue(header map[string][]string, key string) string {
+	if v := header[textproto.CanonicalMIMEHeaderKey(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// quote prefixes every line with "> "
+func quote(s string) string {
+	return "> " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n> ")
+}
+
+// truncate cuts s after n runes and appends an ellipsis
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+// postTemplate returns the template of a channel or user, the template of the profile or the default template
+func (m Mail2Most) postTemplate(profile int, channel string) (*template.Template, error) {
+	conf := m.Config.Profiles[profile].Mattermost
+	text := defaultTemplate
+	if conf.Render == RENDERATTACHMENT {
+		text = defaultAttachmentTemplate
+	}
+	if t, ok := conf.ChannelTemplates[channel]; ok {
+		text = t
+	} else if conf.Template != "" {
+		text = conf.Template
+	}
+	return template.New(channel).Funcs(templateFuncs).Parse(text)
+}
+
+// postMessage renders the post of a mail for a channel or user and applies the Broadcast and Overflow settings
+// in the attachment render mode the Broadcast is applied by newPost
+func (m Mail2Most) postMessage(profile int, channel string, data postData) ([]string, *Attachment, error) {
+	t, err := m.postTemplate(profile, channel)
+	if err != nil {
+		return nil, nil, configError{err}
+	}
+	data.Channel = channel
+	var b bytes.Buffer
+	err = t.Execute(&b, data)
+	if err != nil {
+		return nil, nil, configError{err}
+	}
+	msg := b.String()
+	if m.Config.Profiles[profile].Mattermost.Render == RENDERATTACHMENT {
+		return m.overflow(profile, msg, data.Body)
+	}
+	for _, b := range m.Config.Profiles[profile].Mattermost.Broadcast {
+		msg = b + " " + msg
+	}
+	return m.overflow(profile, msg, data.Body)
+}
+
+// checkTemplates parses the templates of all profiles
+func checkTemplates(profiles []profile) error {
+	for _, p := range profiles {
+		templates := map[string]string{"Template": p.Mattermost.Template}
+		for channel, t := range p.Mattermost.ChannelTemplates {
+			templates["ChannelTemplates."+channel] = t
+		}
+		for name, t := range templates {
+			_, err := template.New(name).Funcs(templateFuncs).Parse(t)
+			if err != nil {
+				return fmt.Errorf("profile %s: %s: %v", p.Name, name, err)
+			}
+		}
+	}
+	return nil
+}
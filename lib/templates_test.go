@@ -0,0 +1,111 @@
+package mail2most
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+// classicPost is the layout posted before templates were introduced
+func classicPost(o mattermost, from, subject, body string) string {
+	msg := ":email: "
+	if !o.HideFrom {
+		msg += from
+	}
+	if o.SubjectOnly && !o.HideSubject {
+		return msg + fmt.Sprintf("\n>_%s_\n\n", subject)
+	}
+	if o.HideSubject {
+		subject = "\n\n\n\n\n"
+	} else {
+		subject = fmt.Sprintf("\n>_%s_\n\n", subject)
+	}
+	if o.ConvertToMarkdown {
+		return msg + fmt.Sprintf("%s\n%s\n", subject, body)
+	}
+	return msg + fmt.Sprintf("%s```\n%s```\n", subject, body)
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	data := postData{
+		Mail: Mail{Subject: "hello"},
+		Body: "some body\n",
+		From: "_From: **<Alice> alice@example.com**_",
+	}
+	for i := 0; i < 16; i++ {
+		o := mattermost{SubjectOnly: i&1 != 0, HideSubject: i&2 != 0, HideFrom: i&4 != 0, ConvertToMarkdown: i&8 != 0}
+		m2m.Config.Profiles[0].Mattermost = o
+		data.Options = o
+		parts, _, err := m2m.postMessage(0, "#some-channel", data)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{classicPost(o, data.From, "hello", data.Body)}, parts, "%+v", o)
+	}
+
+	m2m.Config.Profiles[0].Mattermost.Broadcast = []string{"@all", "@channel"}
+	parts, _, err := m2m.postMessage(0, "#some-channel", data)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(parts[0], "@channel @all :email: "))
+}
+
+func TestTemplates(t *testing.T) {
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#some-channel", "#alerts"}
+	m2m.Config.Profiles[0].Mattermost.Template = `{{.Sender}} to {{addresses .Mail.To}} cc {{addresses .Mail.Cc}}: {{.Mail.Subject}}`
+	m2m.Config.Profiles[0].Mattermost.ChannelTemplates = map[string]string{
+		"#alerts": `{{upper .Mail.Subject}} {{header .Mail.Header "x-priority"}} {{email (index .Mail.From 0)}} {{date "2006-01-02" .Mail.Date}}
+{{quote (truncate 5 (trim .Body))}}`,
+	}
+	mail := Mail{
+		Subject: "disk full",
+		Body:    "hello world",
+		Date:    time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		From:    []*imap.Address{imapAddress("Alice", "alice@example.com")},
+		To:      []*imap.Address{imapAddress("Bob", "bob@example.com"), imapAddress("", "ops@example.com")},
+		Cc:      []*imap.Address{imapAddress("Carol", "carol@example.com")},
+		Header:  map[string][]string{"X-Priority": {"1"}},
+	}
+	assert.Nil(t, m2m.PostMattermost(0, mail))
+	assert.Equal(t, []string{
+		"Alice to Bob <bob@example.com>, ops@example.com cc Carol <carol@example.com>: disk full",
+		"DISK FULL 1 alice@example.com 2020-01-02\n> hello…",
+	}, mm.messages())
+
+	m2m.Config.Profiles[0].Mattermost.Template = `{{.Mail.Missing}}`
+	assert.NotNil(t, m2m.PostMattermost(0, mail))
+}
+
+func TestCheckTemplates(t *testing.T) {
+	assert.Nil(t, checkTemplates([]profile{{Mattermost: mattermost{Template: defaultTemplate}}}))
+	assert.NotNil(t, checkTemplates([]profile{{Mattermost: mattermost{Template: "{{.Body"}}}))
+	assert.NotNil(t, checkTemplates([]profile{{Mattermost: mattermost{ChannelTemplates: map[string]string{"#alerts": "{{unknown .Body}}"}}}}))
+}
+
+func TestHeaderFields(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	raw := "From: alice@example.com\r\n" +
+		"Cc: Carol <carol@example.com>\r\n" +
+		"Subject: =?utf-8?q?gr=C3=BC=C3=9Fe?=\r\n" +
+		"x-list: one\r\n" +
+		"X-List: two\r\n" +
+		"Content-Type: text/plain\r\n\r\nbody\r\n"
+	mail, ok, err := m2m.parseMail(strings.NewReader(raw), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Carol <carol@example.com>", formatAddresses(mail.Cc))
+	assert.Equal(t, "grüße", headerValue(mail.Header, "subject"))
+	assert.Len(t, mail.Header["X-List"], 2)
+}
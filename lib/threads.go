@@ -0,0 +1,136 @@
+package mail2most
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	gomail "github.com/emersion/go-message/mail"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// defaultThreadWindow is used if Mattermost.ThreadWindow is not set
+const defaultThreadWindow = 24 * time.Hour
+
+// replyPrefix matches reply and forward prefixes of subjects (e.g. "Re: ", "AW: ", "Fwd[2]: ")
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|wg|sv|antw)\s*(\[\d+\]|\(\d+\))?\s*:\s*`)
+
+// setThreadHeaders copies the thread headers of a mail, invalid headers are ignored
+func setThreadHeaders(mail *Mail, h gomail.Header) {
+	mail.MessageID, _ = h.MessageID()
+	mail.InReplyTo, _ = h.MsgIDList("In-Reply-To")
+	mail.References, _ = h.MsgIDList("References")
+}
+
+// normalizeSubject removes reply prefixes, case and repeated whitespace from a subject
+func normalizeSubject(subject string) string {
+	for {
+		s := replyPrefix.ReplaceAllString(subject, "")
+		if s == subject {
+			break
+		}
+		subject = s
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+// threadIDs returns the ids identifying the thread of a mail, the parent first
+func threadIDs(mail Mail) []string {
+	var ids []string
+	for _, id := range mail.InReplyTo {
+		ids = append(ids, "<"+id+">")
+	}
+	for i := len(mail.References) - 1; i >= 0; i-- {
+		ids = append(ids, "<"+mail.References[i]+">")
+	}
+	return ids
+}
+
+// threadRoot returns the root post of the thread a mail belongs to in a channel, it is empty for new threads
+// mails without thread headers join the thread of the last mail with the same subject within the ThreadWindow
+func (m Mail2Most) threadRoot(state StateStore, profile int, channel string, mail Mail) string {
+	if state == nil || !m.Config.Profiles[profile].Mattermost.Threads {
+		return ""
+	}
+	ids := threadIDs(mail)
+	if len(ids) == 0 {
+		subject := normalizeSubject(mail.Subject)
+		if subject == "" {
+			return ""
+		}
+		window := defaultThreadWindow
+		if w := m.Config.Profiles[profile].Mattermost.ThreadWindow; w != "" {
+			d, err := time.ParseDuration(w)
+			if err != nil {
+				m.Error("thread error", map[string]interface{}{"error": err, "profile": m.Config.Profiles[profile].Name})
+				return ""
+			}
+			window = d
+		}
+		post, err := state.Thread(ThreadKey{Channel: channel, ID: "subject:" + subject})
+		if err != nil {
+			m.Error("thread error", map[string]interface{}{"error": err, "channel": channel})
+			return ""
+		}
+		if time.Since(post.Time) > window {
+			return ""
+		}
+		return post.RootID
+	}
+
+	for _, id := range ids {
+		post, err := state.Thread(ThreadKey{Channel: channel, ID: id})
+		if err != nil {
+			m.Error("thread error", map[string]interface{}{"error": err, "channel": channel})
+			return ""
+		}
+		if post.RootID != "" {
+			return post.RootID
+		}
+	}
+	return ""
+}
+
+// rememberThread stores the root post of a mail posted to a channel, so replies and mails with the same subject find it
+func (m Mail2Most) rememberThread(state StateStore, profile int, channel string, mail Mail, rootID string) {
+	if state == nil || !m.Config.Profiles[profile].Mattermost.Threads || rootID == "" {
+		return
+	}
+	post := ThreadPost{RootID: rootID, Time: time.Now()}
+	var keys []ThreadKey
+	if mail.MessageID != "" {
+		keys = append(keys, ThreadKey{Channel: channel, ID: "<" + mail.MessageID + ">"})
+	}
+	if subject := normalizeSubject(mail.Subject); subject != "" {
+		keys = append(keys, ThreadKey{Channel: channel, ID: "subject:" + subject})
+	}
+	for _, key := range keys {
+		err := state.SetThread(key, post)
+		if err != nil {
+			m.Error("thread error", map[string]interface{}{"error": err, "channel": channel})
+		}
+	}
+}
+
+// threadRootID returns the root post of the thread a post started or was posted to
+func threadRootID(post *model.Post) string {
+	if post == nil {
+		return ""
+	}
+	if post.RootId != "" {
+		return post.RootId
+	}
+	return post.Id
+}
+
+// createPost creates a post, replies to deleted root posts start a new thread instead
+func (m Mail2Most) createPost(c *model.Client4, post *model.Post) (*model.Post, *model.Response) {
+	p, resp := c.CreatePost(post)
+	if resp.Error != nil && resp.StatusCode == http.StatusBadRequest && post.RootId != "" {
+		m.Debug("thread not found", map[string]interface{}{"error": resp.Error, "root": post.RootId})
+		post.RootId = ""
+		p, resp = c.CreatePost(post)
+	}
+	return p, resp
+}
@@ -0,0 +1,104 @@
+package mail2most
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	filet "github.com/Flaque/filet"
+	imap "github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	for subject, normalized := range map[string]string{
+		"Disk full":                  "disk full",
+		"Re: Disk full":              "disk full",
+		"RE: Fwd: re:  Disk   full ": "disk full",
+		"AW: WG: Disk full":          "disk full",
+		"Re[2]: Disk full":           "disk full",
+		"Regarding: Disk full":       "regarding: disk full",
+		"Re: ":                       "",
+	} {
+		assert.Equal(t, normalized, normalizeSubject(subject), subject)
+	}
+}
+
+func TestThreadHeaders(t *testing.T) {
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	raw := "From: alice@example.com\r\n" +
+		"Subject: Re: hello\r\n" +
+		"Message-Id: <2@example.com>\r\n" +
+		"In-Reply-To: <1@example.com>\r\n" +
+		"References: <0@example.com> <1@example.com>\r\n" +
+		"Content-Type: text/plain\r\n\r\nbody\r\n"
+	mail, ok, err := m2m.parseMail(strings.NewReader(raw), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "2@example.com", mail.MessageID)
+	assert.Equal(t, []string{"1@example.com"}, mail.InReplyTo)
+	assert.Equal(t, []string{"0@example.com", "1@example.com"}, mail.References)
+	assert.Equal(t, []string{"<1@example.com>", "<1@example.com>", "<0@example.com>"}, threadIDs(mail))
+}
+
+func TestThreads(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	mm := newTestMattermost(t)
+	defer mm.Close()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testMattermostProfile(&m2m, mm)
+	m2m.Config.Profiles[0].Mattermost.Threads = true
+	state, err := m2m.openJSONStateStore(filepath.Join(dir, "data.json"))
+	assert.Nil(t, err)
+
+	from := []*imap.Address{imapAddress("Alice", "alice@example.com")}
+	post := func(mail Mail) string {
+		mail.From = from
+		mail.Body = "hello world"
+		assert.Nil(t, m2m.postMattermost(context.Background(), 0, mail, state, nil))
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+		root, _ := mm.posts[len(mm.posts)-1]["root_id"].(string)
+		return root
+	}
+
+	// replies are found by their parent or references, the root of the thread is used for replies to replies
+	assert.Equal(t, "", post(Mail{Subject: "hello", MessageID: "1@example.com"}))
+	assert.Equal(t, "post-1", post(Mail{Subject: "Re: hello", MessageID: "2@example.com", InReplyTo: []string{"1@example.com"}}))
+	assert.Equal(t, "post-1", post(Mail{Subject: "Re: hello", MessageID: "3@example.com", InReplyTo: []string{"2@example.com"}}))
+	assert.Equal(t, "post-1", post(Mail{Subject: "Re: hello", InReplyTo: []string{"unknown@example.com"}, References: []string{"1@example.com", "unknown@example.com"}}))
+	assert.Equal(t, "", post(Mail{Subject: "Re: hello", InReplyTo: []string{"unknown@example.com"}}))
+
+	// mails without thread headers join threads with the same subject
+	assert.Equal(t, "post-5", post(Mail{Subject: "RE: Hello"}))
+	assert.Equal(t, "post-5", post(Mail{Subject: "Fwd: hello"}))
+	assert.Equal(t, "", post(Mail{Subject: "other"}))
+	m2m.Config.Profiles[0].Mattermost.ThreadWindow = "1ns"
+	assert.Equal(t, "", post(Mail{Subject: "other"}))
+	m2m.Config.Profiles[0].Mattermost.ThreadWindow = "invalid"
+	assert.Equal(t, "", post(Mail{Subject: "other"}))
+	m2m.Config.Profiles[0].Mattermost.ThreadWindow = ""
+
+	// threads are kept per channel
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#another-channel"}
+	assert.Equal(t, "", post(Mail{Subject: "Re: hello", InReplyTo: []string{"1@example.com"}}))
+	m2m.Config.Profiles[0].Mattermost.Channels = []string{"#some-channel"}
+
+	// deleted root posts start a new thread
+	mm.mu.Lock()
+	mm.posts[0]["id"] = "deleted"
+	mm.mu.Unlock()
+	assert.Equal(t, "", post(Mail{Subject: "Re: hello", MessageID: "4@example.com", InReplyTo: []string{"1@example.com"}}))
+	assert.Equal(t, "post-12", post(Mail{Subject: "Re: hello", InReplyTo: []string{"4@example.com"}}))
+
+	// threads are not used without the Threads option
+	m2m.Config.Profiles[0].Mattermost.Threads = false
+	assert.Equal(t, "", post(Mail{Subject: "Re: hello", InReplyTo: []string{"1@example.com"}}))
+	assert.Len(t, mm.messages(), 14)
+}
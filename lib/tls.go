@@ -0,0 +1,87 @@
+package mail2most
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsMode returns the tls mode of a profile
+// profiles without TLSMode use implicit tls if ImapTLS is set
+func (m Mail2Most) tlsMode(profile int) string {
+	mail := m.Config.Profiles[profile].Mail
+	if mail.TLSMode != "" {
+		return mail.TLSMode
+	}
+	if mail.ImapTLS {
+		return TLSIMPLICIT
+	}
+	return TLSNONE
+}
+
+// checkTLS validates the tls options of a profile
+func (m Mail2Most) checkTLS(profile int) error {
+	mail := m.Config.Profiles[profile].Mail
+	if mail.ServerName != "" && !mail.VerifyTLS && mail.CAFile == "" {
+		return fmt.Errorf("profile %s: ServerName is used to verify the server certificate, set VerifyTLS or CAFile", m.Config.Profiles[profile].Name)
+	}
+	return nil
+}
+
+// tlsConfig returns the tls configuration to connect to server
+func (m Mail2Most) tlsConfig(profile int, server string) (*tls.Config, error) {
+	mail := m.Config.Profiles[profile].Mail
+	tlsconf := &tls.Config{ServerName: mail.ServerName}
+
+	// a private CA is only configured to verify the server with it
+	if !mail.VerifyTLS && mail.CAFile == "" {
+		tlsconf.InsecureSkipVerify = true
+	}
+
+	// the server name is needed to verify the certificate when using starttls
+	if tlsconf.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		tlsconf.ServerName = host
+	}
+
+	if mail.MinTLSVersion != "" {
+		v, ok := tlsVersions[mail.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version: %s", mail.MinTLSVersion)
+		}
+		tlsconf.MinVersion = v
+	}
+
+	if mail.CAFile != "" {
+		ca, err := ioutil.ReadFile(mail.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", mail.CAFile)
+		}
+	}
+
+	if mail.ClientCert != "" || mail.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(mail.ClientCert, mail.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsconf.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsconf, nil
+}
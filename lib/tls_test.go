@@ -0,0 +1,175 @@
+package mail2most
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	filet "github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate creates a certificate for 127.0.0.1 signed by parent (self-signed if parent is nil)
+// and writes it as <name>.crt and <name>.key into dir
+func testCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func TestTLSConfig(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	testCertificate(t, dir, "ca", nil, nil)
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+
+	m2m.Config.Profiles[0].Mail = maildata{ImapTLS: true}
+	assert.Equal(t, TLSIMPLICIT, m2m.tlsMode(0))
+	m2m.Config.Profiles[0].Mail = maildata{}
+	assert.Equal(t, TLSNONE, m2m.tlsMode(0))
+	m2m.Config.Profiles[0].Mail = maildata{ImapTLS: true, TLSMode: TLSSTARTTLS}
+	assert.Equal(t, TLSSTARTTLS, m2m.tlsMode(0))
+
+	tlsconf, err := m2m.tlsConfig(0, "mail.example.com:143")
+	assert.Nil(t, err)
+	assert.Equal(t, "mail.example.com", tlsconf.ServerName)
+	assert.True(t, tlsconf.InsecureSkipVerify)
+	assert.Nil(t, m2m.checkSource(0))
+
+	// a private CA verifies the server even without VerifyTLS
+	m2m.Config.Profiles[0].Mail.CAFile = filepath.Join(dir, "ca.crt")
+	tlsconf, err = m2m.tlsConfig(0, "mail.example.com:143")
+	assert.Nil(t, err)
+	assert.False(t, tlsconf.InsecureSkipVerify)
+
+	// a server name without verification has no effect
+	m2m.Config.Profiles[0].Mail = maildata{ServerName: "imap.example.com"}
+	assert.NotNil(t, m2m.checkSource(0))
+	m2m.Config.Profiles[0].Mail.Source = SOURCEPOP3
+	m2m.Config.Profiles[0].Mail.Pop3Server = "mail.example.com:995"
+	assert.NotNil(t, m2m.checkSource(0))
+
+	m2m.Config.Profiles[0].Mail = maildata{
+		VerifyTLS:     true,
+		ServerName:    "imap.example.com",
+		MinTLSVersion: "1.2",
+		CAFile:        filepath.Join(dir, "ca.crt"),
+	}
+	assert.Nil(t, m2m.checkSource(0))
+	tlsconf, err = m2m.tlsConfig(0, "mail.example.com:143")
+	assert.Nil(t, err)
+	assert.Equal(t, "imap.example.com", tlsconf.ServerName)
+	assert.False(t, tlsconf.InsecureSkipVerify)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsconf.MinVersion)
+	assert.NotNil(t, tlsconf.RootCAs)
+
+	m2m.Config.Profiles[0].Mail.MinTLSVersion = "2.0"
+	_, err = m2m.tlsConfig(0, "mail.example.com:143")
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "unknown tls version: 2.0", err.Error())
+	}
+
+	m2m.Config.Profiles[0].Mail.MinTLSVersion = ""
+	m2m.Config.Profiles[0].Mail.CAFile = filepath.Join(dir, "ca.key")
+	_, err = m2m.tlsConfig(0, "mail.example.com:143")
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Mail.CAFile = ""
+	m2m.Config.Profiles[0].Mail.ClientCert = filepath.Join(dir, "doesnotexists.crt")
+	_, err = m2m.tlsConfig(0, "mail.example.com:143")
+	assert.NotNil(t, err)
+}
+
+func TestStartTLS(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	ca, caKey := testCertificate(t, dir, "ca", nil, nil)
+	testCertificate(t, dir, "server", ca, caKey)
+	testCertificate(t, dir, "client", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	addr, _, stop := newTestIMAPServer(t)
+	defer stop()
+
+	m2m, err := New("../conf/mail2most.conf")
+	assert.Nil(t, err)
+	testIMAPProfile(&m2m, addr)
+
+	// the test server does not offer STARTTLS
+	m2m.Config.Profiles[0].Mail.TLSMode = TLSSTARTTLS
+	_, err = m2m.connect(context.Background(), 0)
+	assert.NotNil(t, err)
+
+	addr, stop = newTestIMAPServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	defer stop()
+	testIMAPProfile(&m2m, addr)
+	m2m.Config.Profiles[0].Mail.TLSMode = TLSSTARTTLS
+	m2m.Config.Profiles[0].Mail.VerifyTLS = true
+	m2m.Config.Profiles[0].Mail.CAFile = filepath.Join(dir, "ca.crt")
+
+	// the server requires a client certificate
+	_, err = m2m.connect(context.Background(), 0)
+	assert.NotNil(t, err)
+
+	m2m.Config.Profiles[0].Mail.ClientCert = filepath.Join(dir, "client.crt")
+	m2m.Config.Profiles[0].Mail.ClientKey = filepath.Join(dir, "client.key")
+	c, err := m2m.connect(context.Background(), 0)
+	assert.Nil(t, err)
+	if err == nil {
+		assert.True(t, c.IsTLS())
+		c.Logout()
+	}
+
+	m2m.Config.Profiles[0].Mail.TLSMode = "foo"
+	_, err = m2m.connect(context.Background(), 0)
+	assert.NotNil(t, err)
+	if err != nil {
+		assert.Equal(t, "unknown tls mode: foo", err.Error())
+	}
+}
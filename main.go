@@ -1,23 +1,129 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
 
 	m2m "github.com/justledbetter/mail2most/lib"
 )
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-c config] [command]\n\n", os.Args[0])
+	fmt.Fprintln(flag.CommandLine.Output(), "commands:")
+	fmt.Fprintln(flag.CommandLine.Output(), "  deadletters list          list mails that could not be delivered")
+	fmt.Fprintln(flag.CommandLine.Output(), "  deadletters retry <id>    move a dead letter back into the outbox (id \"all\" for every dead letter)")
+	fmt.Fprintln(flag.CommandLine.Output(), "  deadletters drop <id>     delete a dead letter (id \"all\" for every dead letter)")
+	fmt.Fprintln(flag.CommandLine.Output(), "  deliver -profile <name>   post a single mail read from stdin, exits with sysexits codes")
+	fmt.Fprintln(flag.CommandLine.Output(), "\nwithout a command mail2most is started\n\nflags:")
+	flag.PrintDefaults()
+}
+
 func main() {
 	confFile := flag.String("c", "conf/mail2most.conf", "path to config file")
+	flag.Usage = usage
 	flag.Parse()
 
 	m, err := m2m.New(*confFile)
 	if err != nil {
+		if flag.Arg(0) == "deliver" {
+			// the mail server keeps the mail until the config is fixed
+			log.Print(err)
+			os.Exit(m2m.EXCONFIG)
+		}
 		log.Fatal(err)
 	}
 
-	err = m.Run()
+	switch flag.Arg(0) {
+	case "":
+		ctx, stop := signalContext()
+		err = m.RunContext(ctx)
+		stop()
+	case "deadletters":
+		err = deadLetters(m, flag.Args()[1:])
+	case "deliver":
+		os.Exit(deliver(m, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// signalContext is cancelled on SIGINT or SIGTERM, a second signal exits immediately
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-sigs
+		if !ok {
+			return
+		}
+		log.Printf("received %s, shutting down", sig)
+		cancel()
+		if _, ok := <-sigs; ok {
+			log.Fatal("received second signal, exiting")
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(sigs)
+		cancel()
+	}
+}
+
+// deliver posts a single mail read from stdin, the exit code tells the mail server whether to retry the delivery
+func deliver(m m2m.Mail2Most, args []string) int {
+	fs := flag.NewFlagSet("deliver", flag.ContinueOnError)
+	profile := fs.String("profile", "", "name of the profile posting the mail")
+	err := fs.Parse(args)
+	if err != nil {
+		return m2m.EXUSAGE
+	}
+	if *profile == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return m2m.EXUSAGE
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	err = m.Deliver(ctx, *profile, os.Stdin)
+	if err != nil {
+		log.Print(err)
+	}
+	return m2m.DeliveryExitCode(err)
+}
+
+func deadLetters(m m2m.Mail2Most, args []string) error {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		entries, err := m.DeadLetters()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROFILE\tATTEMPTS\tCREATED\tSUBJECT\tLAST ERROR")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", e.ID, e.Profile, e.Attempts, e.Created.Format("2006-01-02 15:04:05"), e.Mail.Subject, e.LastError)
+		}
+		return w.Flush()
+	case args[0] == "retry" && len(args) == 2:
+		return m.RetryDeadLetter(args[1])
+	case args[0] == "drop" && len(args) == 2:
+		return m.DropDeadLetter(args[1])
+	}
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}